@@ -0,0 +1,86 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * alloc samples the memory allocation rate of the exporter and relates it
+ * to the number of processed messages, to spot allocation regressions in
+ * the message parser.
+ */
+
+package main
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// allocInterval is the sample interval of the allocation rate
+const allocInterval = 10 * time.Second
+
+var allocPerMessage = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "exporter",
+	Name:      "alloc_bytes_per_message",
+	Help:      "Bytes allocated per processed message during the last sample interval.",
+})
+
+// runAllocMonitor updates allocPerMessage every allocInterval until ctx
+// is done. processed returns the number of messages processed so far.
+// Intervals without messages leave the gauge unchanged.
+func runAllocMonitor(ctx context.Context, processed func() uint64) {
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	lastAlloc := stats.TotalAlloc
+	lastMessages := processed()
+
+	ticker := time.NewTicker(allocInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		runtime.ReadMemStats(&stats)
+		messages := processed()
+		if messages > lastMessages {
+			allocPerMessage.Set(float64(stats.TotalAlloc-lastAlloc) / float64(messages-lastMessages))
+		}
+		lastAlloc = stats.TotalAlloc
+		lastMessages = messages
+	}
+
+} // End of runAllocMonitor
@@ -0,0 +1,293 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * dashboard implements the dashboard subcommand, which writes a Grafana
+ * dashboard of the exporter metrics to stdout. The metric names are built
+ * from the same namespaces as the collectors, so the queries follow them.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+const (
+	// dashboardSchemaVersion is the Grafana dashboard schema of the model
+	dashboardSchemaVersion = 39
+	// dashboardReportingWindow is the time, in which an exporter must
+	// have sent new counters to be shown as reporting, three nfcapd
+	// intervals of 5 minutes
+	dashboardReportingWindow = "15m"
+)
+
+type grafanaDashboard struct {
+	Title         string            `json:"title"`
+	UID           string            `json:"uid,omitempty"`
+	Tags          []string          `json:"tags"`
+	Timezone      string            `json:"timezone"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          grafanaTimeRange  `json:"time"`
+	Templating    grafanaTemplating `json:"templating"`
+	Panels        []grafanaPanel    `json:"panels"`
+}
+
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Datasource *grafanaDatasource `json:"datasource,omitempty"`
+	Query      string             `json:"query"`
+	Refresh    int                `json:"refresh,omitempty"`
+	Multi      bool               `json:"multi"`
+	IncludeAll bool               `json:"includeAll"`
+	Current    grafanaCurrent     `json:"current"`
+}
+
+type grafanaCurrent struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Type        string             `json:"type"`
+	Title       string             `json:"title"`
+	Datasource  grafanaDatasource  `json:"datasource"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	Targets     []grafanaTarget    `json:"targets"`
+	FieldConfig grafanaFieldConfig `json:"fieldConfig"`
+	Options     map[string]any     `json:"options,omitempty"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	RefID        string            `json:"refId"`
+	Datasource   grafanaDatasource `json:"datasource"`
+	Expr         string            `json:"expr"`
+	LegendFormat string            `json:"legendFormat,omitempty"`
+	Instant      bool              `json:"instant,omitempty"`
+	Format       string            `json:"format,omitempty"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults  grafanaFieldDefaults `json:"defaults"`
+	Overrides []any                `json:"overrides"`
+}
+
+type grafanaFieldDefaults struct {
+	Unit   string         `json:"unit,omitempty"`
+	Custom map[string]any `json:"custom,omitempty"`
+}
+
+// runDashboard parses the dashboard arguments, writes the dashboard and
+// returns the exit code
+func runDashboard(args []string) int {
+
+	flags := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	datasource := flags.String("datasource", "", "UID of the Prometheus data source in Grafana (required)")
+	idents := flags.String("idents", "", "Comma separated idents to choose from. Empty queries the idents from the data source")
+	title := flags.String("title", "nfsen", "Title of the dashboard")
+	uid := flags.String("uid", "", "UID of the dashboard. Empty lets Grafana assign one")
+	mode := flags.String("value-mode", exporter.ValueModeCounter, "-value-mode of the exporter: counter|gauge|both")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *datasource == "" {
+		fmt.Fprintf(os.Stderr, "Dashboard failed: -datasource is required\n")
+		return 2
+	}
+	switch *mode {
+	case exporter.ValueModeCounter, exporter.ValueModeGauge, exporter.ValueModeBoth:
+	default:
+		fmt.Fprintf(os.Stderr, "Dashboard failed: -value-mode %q: must be counter, gauge or both\n", *mode)
+		return 2
+	}
+
+	var identList []string
+	for _, ident := range strings.Split(*idents, ",") {
+		if ident = strings.TrimSpace(ident); ident != "" {
+			identList = append(identList, ident)
+		}
+	}
+	dashboard := buildDashboard(*title, *uid, grafanaDatasource{Type: "prometheus", UID: *datasource},
+		identList, *mode == exporter.ValueModeGauge)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(dashboard); err != nil {
+		fmt.Fprintf(os.Stderr, "Dashboard failed: %v\n", err)
+		return 1
+	}
+	return 0
+
+} // End of runDashboard
+
+// buildDashboard returns the dashboard for the idents, all idents of the
+// data source without. With gauges, the traffic panels show the
+// *_last_interval gauges instead of rates of the counters.
+func buildDashboard(title, uid string, ds grafanaDatasource, idents []string, gauges bool) grafanaDashboard {
+
+	collector := func(name string) string {
+		return prometheus.BuildFQName(metrics.Namespace, "collector", name)
+	}
+	flows, bytes := collector("flows"), collector("bytes")
+	selector := `{ident=~"$ident"}`
+
+	// traffic returns the expression of the traffic of family, summed by
+	// the labels
+	traffic := func(family, by string) string {
+		if gauges {
+			return fmt.Sprintf("sum by (%s) (%s_last_interval%s)", by, family, selector)
+		}
+		return fmt.Sprintf("sum by (%s) (rate(%s%s[$__rate_interval]))", by, family, selector)
+	}
+	bytesUnit, per, reported := "Bps", " per second", flows
+	if gauges {
+		bytesUnit, per, reported = "decbytes", " per interval", flows+"_last_interval"
+	}
+
+	variable := grafanaVariable{
+		Name:       "ident",
+		Label:      "Ident",
+		Multi:      true,
+		IncludeAll: true,
+		Current:    grafanaCurrent{Text: "All", Value: "$__all"},
+	}
+	if len(idents) > 0 {
+		variable.Type = "custom"
+		variable.Query = strings.Join(idents, ",")
+	} else {
+		variable.Type = "query"
+		variable.Datasource = &ds
+		variable.Query = fmt.Sprintf("label_values(%s, ident)", reported)
+		variable.Refresh = 1
+	}
+
+	var panels []grafanaPanel
+	add := func(kind, title, unit string, pos grafanaGridPos, targets ...grafanaTarget) *grafanaPanel {
+		for i := range targets {
+			targets[i].RefID = string(rune('A' + i))
+			targets[i].Datasource = ds
+		}
+		panels = append(panels, grafanaPanel{
+			ID:          len(panels) + 1,
+			Type:        kind,
+			Title:       title,
+			Datasource:  ds,
+			GridPos:     pos,
+			Targets:     targets,
+			FieldConfig: grafanaFieldConfig{Defaults: grafanaFieldDefaults{Unit: unit}, Overrides: []any{}},
+		})
+		return &panels[len(panels)-1]
+	}
+
+	// traffic per ident and exporter
+	add("timeseries", "Bytes"+per+" by ident", bytesUnit, grafanaGridPos{H: 8, W: 12, X: 0, Y: 0},
+		grafanaTarget{Expr: traffic(bytes, "ident"), LegendFormat: "{{ident}}"})
+	add("timeseries", "Flows"+per+" by ident", "short", grafanaGridPos{H: 8, W: 12, X: 12, Y: 0},
+		grafanaTarget{Expr: traffic(flows, "ident"), LegendFormat: "{{ident}}"})
+	add("timeseries", "Bytes"+per+" by exporter", bytesUnit, grafanaGridPos{H: 8, W: 12, X: 0, Y: 8},
+		grafanaTarget{Expr: traffic(bytes, "ident, exporter"), LegendFormat: "{{ident}}/{{exporter}}"})
+
+	// protocol mix as share of the flows
+	mix := add("timeseries", "Protocol mix (flows)", "short", grafanaGridPos{H: 8, W: 12, X: 12, Y: 8},
+		grafanaTarget{Expr: traffic(flows, "proto"), LegendFormat: "{{proto}}"})
+	mix.FieldConfig.Defaults.Custom = map[string]any{
+		"stacking":    map[string]any{"mode": "percent"},
+		"fillOpacity": 60,
+	}
+
+	// exporters with new counters within the reporting window
+	add("table", "Exporters reporting", "bool_yes_no", grafanaGridPos{H: 8, W: 12, X: 0, Y: 16},
+		grafanaTarget{
+			Expr:    fmt.Sprintf("max by (ident, exporter) (changes(%s%s[%s]) > bool 0)", reported, selector, dashboardReportingWindow),
+			Instant: true,
+			Format:  "table",
+		})
+
+	// collector health
+	self := func(name string) string {
+		return prometheus.BuildFQName(selfNamespace, "", name)
+	}
+	stat := func(title, expr, unit string, x, y int) {
+		add("stat", title, unit, grafanaGridPos{H: 4, W: 6, X: x, Y: y}, grafanaTarget{Expr: expr})
+	}
+	stat("Messages per second", fmt.Sprintf("sum(rate(%s[$__rate_interval]))", self("messages_received_total")), "short", 12, 16)
+	stat("Parse errors", fmt.Sprintf("sum(increase(%s[$__range]))", self("parse_errors_total")), "short", 18, 16)
+	stat("Dropped messages", fmt.Sprintf("sum(increase(%s[$__range]))",
+		prometheus.BuildFQName(metrics.Namespace, "socket", "dropped_messages_total")), "short", 12, 20)
+	stat("Tracked exporters", fmt.Sprintf("sum(%s)", self("tracked_exporters")), "short", 18, 20)
+
+	return grafanaDashboard{
+		Title:         title,
+		UID:           uid,
+		Tags:          []string{"nfsen", "netflow"},
+		Timezone:      "browser",
+		SchemaVersion: dashboardSchemaVersion,
+		Refresh:       "1m",
+		Time:          grafanaTimeRange{From: "now-6h", To: "now"},
+		Templating:    grafanaTemplating{List: []grafanaVariable{variable}},
+		Panels:        panels,
+	}
+
+} // End of buildDashboard
@@ -0,0 +1,94 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * descriptions replaces the help texts of metrics with the ones of a YAML
+ * file, e.g. to link internal runbooks or tickets.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// metricDescriptions maps metric names to the help text replacing the
+// built-in one. nil keeps all built-in texts.
+var metricDescriptions map[string]string
+
+// loadDescriptions reads a YAML file of metric names and help texts
+//
+//	nfsen_collector_flows: "Flows received by nfcapd, see TICKET-123"
+func loadDescriptions(path string) (map[string]string, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	descriptions := make(map[string]string)
+	if err := yaml.Unmarshal(data, &descriptions); err != nil {
+		return nil, err
+	}
+	for name, help := range descriptions {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return nil, fmt.Errorf("%q: not a valid metric name", name)
+		}
+		if help == "" {
+			return nil, fmt.Errorf("%q: empty help text", name)
+		}
+	}
+	return descriptions, nil
+
+} // End of loadDescriptions
+
+// describedGatherer replaces the help texts of the gathered families,
+// which have a description
+type describedGatherer struct {
+	gatherer     prometheus.Gatherer
+	descriptions map[string]string
+}
+
+func (g describedGatherer) Gather() ([]*dto.MetricFamily, error) {
+
+	families, err := g.gatherer.Gather()
+	for _, family := range families {
+		if help, ok := g.descriptions[family.GetName()]; ok {
+			family.Help = &help
+		}
+	}
+	return families, err
+
+} // End of Gather
@@ -0,0 +1,72 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * expvar publishes the state of the store and the socket listener as Go
+ * expvars under /debug/vars, for tooling built on expvar.
+ */
+
+package main
+
+import (
+	"expvar"
+
+	"nfsen_exporter/pkg/listener"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// expvarPath is the path of the expvar handler
+const expvarPath = "/debug/vars"
+
+// publishExpvar publishes the map nfexporter with the same statistics as
+// registerSelfStats, read on each request of /debug/vars
+func publishExpvar(store *metrics.Store, socket *listener.Listener, socketPath string) {
+
+	socketStatus := new(expvar.Map)
+	socketStatus.Set("path", expvarString(socketPath))
+	socketStatus.Set("active_readers", expvar.Func(func() any { return socket.Stats().Readers }))
+	socketStatus.Set("queue_length", expvar.Func(func() any { return socket.Stats().Queued }))
+
+	vars := expvar.NewMap("nfexporter")
+	vars.Set("messages_received", expvar.Func(func() any { return socket.Stats().Messages }))
+	vars.Set("parse_errors", expvar.Func(func() any { return socket.Stats().ParseErrors }))
+	vars.Set("tracked_idents", expvar.Func(func() any { return store.Stats().Idents }))
+	vars.Set("tracked_exporters", expvar.Func(func() any { return store.Stats().Exporters }))
+	vars.Set("state_bytes_estimate", expvar.Func(func() any { return store.Stats().Bytes }))
+	vars.Set("listener", socketStatus)
+
+} // End of publishExpvar
+
+// expvarString returns a fixed string var
+func expvarString(value string) *expvar.String {
+	v := new(expvar.String)
+	v.Set(value)
+	return v
+} // End of expvarString
@@ -0,0 +1,182 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * graphite sends the collector counters in the Carbon plaintext protocol
+ * to Graphite, for dashboards, which are not migrated to Prometheus yet.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// graphiteFirstBackoff is the delay before the first reconnect. It
+// doubles with each failed attempt, until the next send is due.
+const graphiteFirstBackoff = time.Second
+
+var graphiteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "exporter",
+	Name:      "graphite_failures_total",
+	Help:      "How many connects and sends to Graphite failed.",
+})
+
+// graphiteSender keeps the connection to Carbon
+type graphiteSender struct {
+	address string
+	prefix  string
+	timeout time.Duration
+	conn    net.Conn
+}
+
+// runGraphite sends the counters of store to the Carbon plaintext
+// listener at address every interval until ctx is done
+func runGraphite(ctx context.Context, store *metrics.Store, address, prefix string, interval time.Duration, exporterLabel func(uint64) string) {
+
+	sender := &graphiteSender{address: address, prefix: prefix, timeout: interval}
+	defer sender.close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		snapshot, err := store.Snapshot(ctx)
+		if err != nil {
+			continue
+		}
+		sender.send(ctx, graphiteLines(prefix, withoutSelfTest(snapshot), exporterLabel), time.Now().Add(interval))
+	}
+
+} // End of runGraphite
+
+// send writes lines to Carbon. A broken connection is reconnected with
+// backoff until deadline, then the lines are dropped.
+func (g *graphiteSender) send(ctx context.Context, lines []string, deadline time.Time) {
+
+	backoff := graphiteFirstBackoff
+	for {
+		err := g.write(lines)
+		if err == nil {
+			return
+		}
+		graphiteFailures.Inc()
+		g.close()
+		if time.Now().Add(backoff).After(deadline) {
+			log.Printf("Graphite send to %s failed: %v\n", g.address, err)
+			return
+		}
+		log.Printf("Graphite send to %s failed, reconnect in %v: %v\n", g.address, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+} // End of send
+
+// write connects, if needed, and writes lines
+func (g *graphiteSender) write(lines []string) error {
+
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.address, g.timeout)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(g.timeout))
+	w := bufio.NewWriter(g.conn)
+	for _, line := range lines {
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+
+} // End of write
+
+func (g *graphiteSender) close() {
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+} // End of close
+
+// graphiteLines formats the counters of snapshot as Carbon plaintext
+// lines prefix.<ident>.<exporter>.<proto>.<family> with the time of
+// their message. exporterLabel formats the exporter like the scrape.
+func graphiteLines(prefix string, snapshot []metrics.Entry, exporterLabel func(uint64) string) []string {
+
+	lines := make([]string, 0, len(snapshot)*3*int(metrics.NumProtos))
+	for _, entry := range snapshot {
+		metric := entry.Metric
+		path := prefix + "." + graphiteName(entry.Ident) + "." + graphiteName(exporterLabel(metric.ExporterID))
+		timestamp := metric.LastUpdate.Unix()
+		for proto, counters := range metric.Protos {
+			protoPath := path + "." + metrics.Proto(proto).String()
+			lines = append(lines,
+				fmt.Sprintf("%s.flows %d %d\n", protoPath, counters.Flows, timestamp),
+				fmt.Sprintf("%s.packets %d %d\n", protoPath, counters.Packets, timestamp),
+				fmt.Sprintf("%s.bytes %d %d\n", protoPath, counters.Bytes, timestamp))
+		}
+	}
+	return lines
+
+} // End of graphiteLines
+
+// graphiteName replaces dots and white space, which would break the
+// metric path, with underscores
+func graphiteName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, name)
+} // End of graphiteName
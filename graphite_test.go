@@ -0,0 +1,186 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// fakeCarbon accepts Carbon plaintext connections on listener and
+// passes the received lines without newline to the returned channel
+func fakeCarbon(t *testing.T, listener net.Listener) <-chan string {
+
+	lines := make(chan string, 64)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return lines
+
+} // End of fakeCarbon
+
+// receiveLines returns the next n lines of carbon
+func receiveLines(t *testing.T, carbon <-chan string, n int) []string {
+
+	t.Helper()
+	var lines []string
+	timeout := time.After(5 * time.Second)
+	for len(lines) < n {
+		select {
+		case line := <-carbon:
+			lines = append(lines, line)
+		case <-timeout:
+			t.Fatalf("received %d lines %q, want %d", len(lines), lines, n)
+		}
+	}
+	return lines
+
+} // End of receiveLines
+
+func TestGraphite(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carbon := fakeCarbon(t, listener)
+
+	store := metrics.NewStore(metrics.Options{})
+	metric := metrics.Metric{ExporterID: 3, LastUpdate: time.Unix(1700000000, 0)}
+	metric.Protos[metrics.ProtoTCP] = metrics.Counters{Flows: 1, Packets: 2, Bytes: 3}
+	metric.Protos[metrics.ProtoUDP] = metrics.Counters{Flows: 4, Packets: 5, Bytes: 6}
+	store.Update("edge.router 1", []metrics.Metric{metric}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exp := exporter.New(store, exporter.Options{ValueMode: exporter.ValueModeCounter})
+	go runGraphite(ctx, store, listener.Addr().String(), "nfsen", 50*time.Millisecond, exp.ExporterLabel)
+
+	want := []string{
+		"nfsen.edge_router_1.3.tcp.flows 1 1700000000",
+		"nfsen.edge_router_1.3.tcp.packets 2 1700000000",
+		"nfsen.edge_router_1.3.tcp.bytes 3 1700000000",
+		"nfsen.edge_router_1.3.udp.flows 4 1700000000",
+		"nfsen.edge_router_1.3.udp.packets 5 1700000000",
+		"nfsen.edge_router_1.3.udp.bytes 6 1700000000",
+		"nfsen.edge_router_1.3.icmp.flows 0 1700000000",
+		"nfsen.edge_router_1.3.icmp.packets 0 1700000000",
+		"nfsen.edge_router_1.3.icmp.bytes 0 1700000000",
+		"nfsen.edge_router_1.3.other.flows 0 1700000000",
+		"nfsen.edge_router_1.3.other.packets 0 1700000000",
+		"nfsen.edge_router_1.3.other.bytes 0 1700000000",
+	}
+	// the second interval is sent on the same connection
+	for interval := 1; interval <= 2; interval++ {
+		lines := receiveLines(t, carbon, len(want))
+		for i := range want {
+			if lines[i] != want[i] {
+				t.Errorf("interval %d line %d = %q, want %q", interval, i, lines[i], want[i])
+			}
+		}
+	}
+
+} // End of TestGraphite
+
+// TestGraphiteExporterIDAsIP formats the exporter like the label of the
+// scrape with -exporter-id-as-ip. The dots of the address must not split
+// the metric path.
+func TestGraphiteExporterIDAsIP(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	exp := exporter.New(store, exporter.Options{ValueMode: exporter.ValueModeCounter, ExporterIDAsIP: true})
+	metric := metrics.Metric{ExporterID: 0x0a000001, LastUpdate: time.Unix(1700000000, 0)}
+	metric.Protos[metrics.ProtoTCP] = metrics.Counters{Flows: 1}
+
+	lines := graphiteLines("nfsen", []metrics.Entry{{Ident: "a", Metric: metric}}, exp.ExporterLabel)
+	if want := "nfsen.a.10_0_0_1.tcp.flows 1 1700000000\n"; lines[0] != want {
+		t.Errorf("first line = %q, want %q", lines[0], want)
+	}
+
+} // End of TestGraphiteExporterIDAsIP
+
+// TestGraphiteReconnect sends, while Carbon is down. The sender retries
+// with backoff and delivers the lines, once Carbon is up again.
+func TestGraphiteReconnect(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	failures := testutil.ToFloat64(graphiteFailures)
+	sender := &graphiteSender{address: address, prefix: "nfsen", timeout: time.Second}
+	defer sender.close()
+	sent := make(chan struct{})
+	go func() {
+		sender.send(context.Background(), []string{"nfsen.a.1.tcp.flows 1 1700000000\n"}, time.Now().Add(10*time.Second))
+		close(sent)
+	}()
+
+	// the first attempt fails before the backoff of a second has passed
+	time.Sleep(graphiteFirstBackoff / 2)
+	if got := testutil.ToFloat64(graphiteFailures) - failures; got != 1 {
+		t.Errorf("%v failures while Carbon is down, want 1", got)
+	}
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", address, err)
+	}
+	carbon := fakeCarbon(t, listener)
+	if lines := receiveLines(t, carbon, 1); lines[0] != "nfsen.a.1.tcp.flows 1 1700000000" {
+		t.Errorf("line after reconnect = %q", lines[0])
+	}
+	<-sent
+
+} // End of TestGraphiteReconnect
@@ -0,0 +1,131 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * health implements the /healthz and /readyz endpoints and the healthcheck
+ * subcommand, which probes them for container HEALTHCHECKs without the
+ * need for curl in the image.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// ready is true, while the collector socket accepts connections
+var ready atomic.Bool
+
+// healthHandler reports, that the HTTP server is alive
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK\n"))
+} // End of healthHandler
+
+// readyHandler reports, if the exporter accepts statistics from nfcapd
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK\n"))
+} // End of readyHandler
+
+// runHealthcheck probes the health endpoint of a running exporter and
+// returns the exit code
+func runHealthcheck(args []string) int {
+
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	listen := flags.String("listen", ":9141", "Address the exporter listens on for telemetry")
+	checkReady := flags.Bool("ready", false, "Check "+readyPath+" instead of "+healthPath)
+	prefix := flags.String("metrics-path-prefix", "", "Path prefix the exporter serves -listen below")
+	timeout := flags.Duration("timeout", 2*time.Second, "Timeout of the check")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := healthPath
+	if *checkReady {
+		path = readyPath
+	}
+	url, err := probeURL(*listen, *prefix+path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Healthcheck failed: %v\n", err)
+		return 1
+	}
+
+	if err := probe(url, *timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Healthcheck failed: %v\n", err)
+		return 1
+	}
+	return 0
+
+} // End of runHealthcheck
+
+// probeURL builds the URL of path for a listen address. A wildcard
+// listen address is probed on localhost.
+func probeURL(listen, path string) (string, error) {
+
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + path, nil
+
+} // End of probeURL
+
+// probe returns an error, unless url answers with 200 within timeout
+func probe(url string, timeout time.Duration) error {
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+
+} // End of probe
@@ -0,0 +1,135 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeURL(t *testing.T) {
+
+	cases := []struct {
+		listen string
+		path   string
+		want   string
+	}{
+		{":9141", healthPath, "http://localhost:9141/healthz"},
+		{"0.0.0.0:9141", readyPath, "http://localhost:9141/readyz"},
+		{"[::]:9141", healthPath, "http://localhost:9141/healthz"},
+		{"127.0.0.1:9141", "/nfexporter" + healthPath, "http://127.0.0.1:9141/nfexporter/healthz"},
+		{"[::1]:9141", healthPath, "http://[::1]:9141/healthz"},
+		{"exporter.example.com:9141", healthPath, "http://exporter.example.com:9141/healthz"},
+	}
+	for _, c := range cases {
+		got, err := probeURL(c.listen, c.path)
+		if err != nil || got != c.want {
+			t.Errorf("probeURL(%q, %q) = %q, %v, want %q", c.listen, c.path, got, err, c.want)
+		}
+	}
+	if _, err := probeURL("9141", healthPath); err == nil {
+		t.Errorf("probeURL without port: got no error")
+	}
+
+} // End of TestProbeURL
+
+func TestProbe(t *testing.T) {
+
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/unavailable", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer close(release)
+
+	if err := probe(server.URL+"/ok", time.Second); err != nil {
+		t.Errorf("probe 200: %v", err)
+	}
+	if err := probe(server.URL+"/unavailable", time.Second); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("probe 503: got %v, want the status", err)
+	}
+	start := time.Now()
+	if err := probe(server.URL+"/slow", 50*time.Millisecond); err == nil {
+		t.Errorf("probe timeout: got no error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probe timeout: returned after %v, want about 50ms", elapsed)
+	}
+
+} // End of TestProbe
+
+func TestRunHealthcheck(t *testing.T) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, healthHandler)
+	mux.HandleFunc(readyPath, readyHandler)
+	mux.HandleFunc("/nfexporter"+healthPath, healthHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	listen := strings.TrimPrefix(server.URL, "http://")
+
+	defer ready.Store(ready.Load())
+	ready.Store(false)
+
+	cases := []struct {
+		name  string
+		args  []string
+		ready bool
+		want  int
+	}{
+		{"health", []string{"-listen", listen}, false, 0},
+		{"not ready", []string{"-listen", listen, "-ready"}, false, 1},
+		{"ready", []string{"-listen", listen, "-ready"}, true, 0},
+		{"prefix", []string{"-listen", listen, "-metrics-path-prefix", "/nfexporter"}, false, 0},
+		{"wrong prefix", []string{"-listen", listen, "-metrics-path-prefix", "/other"}, false, 1},
+		{"bad listen", []string{"-listen", "9141"}, false, 1},
+		{"unknown flag", []string{"-tls"}, false, 2},
+	}
+	for _, c := range cases {
+		ready.Store(c.ready)
+		if got := runHealthcheck(c.args); got != c.want {
+			t.Errorf("%s: runHealthcheck(%v) = %d, want %d", c.name, c.args, got, c.want)
+		}
+	}
+
+} // End of TestRunHealthcheck
@@ -0,0 +1,221 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * influx writes the statistics of each received message as InfluxDB line
+ * protocol points. Points are buffered and written in batches, so a slow
+ * or failing InfluxDB never delays the message processing.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// influxFlushTimeout limits the final write on shutdown
+const influxFlushTimeout = 5 * time.Second
+
+var (
+	influxWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "influx_points_written_total",
+		Help:      "How many points have been written to InfluxDB.",
+	})
+	influxDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "influx_points_dropped_total",
+		Help:      "How many points have been dropped, because the buffer was full or the write failed.",
+	})
+)
+
+// influxFamily is a measurement of the line protocol output
+type influxFamily struct {
+	measurement string
+	value       func(metrics.Counters) uint64
+}
+
+var influxFamilies = []influxFamily{
+	{"nfsen_flows", func(c metrics.Counters) uint64 { return c.Flows }},
+	{"nfsen_packets", func(c metrics.Counters) uint64 { return c.Packets }},
+	{"nfsen_bytes", func(c metrics.Counters) uint64 { return c.Bytes }},
+}
+
+// influxTagEscaper escapes tag values of the line protocol
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+
+// influxWriter buffers points until they are written
+type influxWriter struct {
+	writeURL      string
+	token         string
+	maxPoints     int
+	exporterLabel func(uint64) string
+	client        *http.Client
+
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+	points int
+}
+
+// newInfluxWriter returns a writer for the InfluxDB v2 write API at
+// baseURL. At most maxPoints points are buffered. exporterLabel formats
+// the exporter tag like the exporter label of the scrape.
+func newInfluxWriter(baseURL, org, bucket, token string, maxPoints int, timeout time.Duration, exporterLabel func(uint64) string) *influxWriter {
+
+	query := url.Values{}
+	query.Set("org", org)
+	query.Set("bucket", bucket)
+	query.Set("precision", "ns")
+	return &influxWriter{
+		writeURL:      strings.TrimSuffix(baseURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:         token,
+		maxPoints:     maxPoints,
+		exporterLabel: exporterLabel,
+		client:        &http.Client{Timeout: timeout},
+	}
+
+} // End of newInfluxWriter
+
+// add buffers the points of a message. If the buffer is full, the points
+// are dropped. It is a listener.Options.OnMessage function.
+func (w *influxWriter) add(ident string, list []metrics.Metric) {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	points := len(list) * len(influxFamilies) * int(metrics.NumProtos)
+	if w.points+points > w.maxPoints {
+		influxDropped.Add(float64(points))
+		return
+	}
+	w.points += points
+
+	identTag := influxTagEscaper.Replace(ident)
+	for _, metric := range list {
+		timestamp := strconv.FormatInt(metric.LastUpdate.UnixNano(), 10)
+		exporter := w.exporterLabel(metric.ExporterID)
+		for _, family := range influxFamilies {
+			for proto, counters := range metric.Protos {
+				fmt.Fprintf(&w.buffer, "%s,ident=%s,exporter=%s,proto=%s value=%d %s\n",
+					family.measurement, identTag, exporter, metrics.Proto(proto), family.value(counters), timestamp)
+			}
+		}
+	}
+
+} // End of add
+
+// run writes the buffered points every interval until ctx is done. The
+// last write follows, when drained is closed, so it includes the messages
+// the listener applies on shutdown.
+func (w *influxWriter) run(ctx context.Context, interval time.Duration, drained <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			<-drained
+			flushCtx, cancel := context.WithTimeout(context.Background(), influxFlushTimeout)
+			w.flush(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			w.flush(ctx)
+		}
+	}
+
+} // End of run
+
+// flush writes the buffered points. Points of a failed write are dropped.
+func (w *influxWriter) flush(ctx context.Context) {
+
+	w.mutex.Lock()
+	body := append([]byte(nil), w.buffer.Bytes()...)
+	points := w.points
+	w.buffer.Reset()
+	w.points = 0
+	w.mutex.Unlock()
+
+	if points == 0 {
+		return
+	}
+	if err := w.write(ctx, body); err != nil {
+		influxDropped.Add(float64(points))
+		log.Printf("InfluxDB write of %d points failed: %v\n", points, err)
+		return
+	}
+	influxWritten.Add(float64(points))
+
+} // End of flush
+
+// write sends body to the write API
+func (w *influxWriter) write(ctx context.Context, body []byte) error {
+
+	ctx, cancel := context.WithTimeout(ctx, w.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "nfsen_exporter/"+version)
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+
+} // End of write
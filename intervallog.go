@@ -0,0 +1,158 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * intervallog writes one JSON line per received message with the deltas
+ * and rates of the ident, for sites which ship logs only.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// intervalLine is the schema of a line of -log-intervals. Fields are
+// only added, never renamed or removed, so log queries keep working.
+type intervalLine struct {
+	// Time is the time the message was received
+	Time time.Time `json:"time"`
+	// Msg is always "interval"
+	Msg   string `json:"msg"`
+	Ident string `json:"ident"`
+	// Exporters is the number of exporters with a previous message,
+	// which the deltas sum up
+	Exporters int `json:"exporters"`
+	// Seconds is the longest time between the messages of an exporter
+	Seconds float64 `json:"interval_seconds"`
+	// Flows, Packets and Bytes are the deltas of all protocols
+	Flows   uint64 `json:"flows"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	// the deltas per second over Seconds
+	FlowsPerSecond   float64 `json:"flows_per_second"`
+	PacketsPerSecond float64 `json:"packets_per_second"`
+	BytesPerSecond   float64 `json:"bytes_per_second"`
+	// Protos are the deltas per protocol: tcp, udp, icmp and other
+	Protos map[string]intervalCounters `json:"protos"`
+}
+
+type intervalCounters struct {
+	Flows   uint64 `json:"flows"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// intervalLogger sums the deltas of the exporters of a message
+type intervalLogger struct {
+	mutex   sync.Mutex
+	pending map[string]*intervalLine
+
+	// encoder writes the lines, guarded by writeMutex
+	writeMutex sync.Mutex
+	encoder    *json.Encoder
+}
+
+func newIntervalLogger(w io.Writer) *intervalLogger {
+	return &intervalLogger{
+		pending: make(map[string]*intervalLine),
+		encoder: json.NewEncoder(w),
+	}
+} // End of newIntervalLogger
+
+// update adds the deltas of an exporter to the line of ident. A
+// decreased counter counts from 0 after a reset of nfcapd. It is a
+// metrics.UpdateFunc.
+func (l *intervalLogger) update(ident string, previous, current metrics.Metric) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	line, ok := l.pending[ident]
+	if !ok {
+		line = &intervalLine{Msg: "interval", Ident: ident, Protos: make(map[string]intervalCounters, metrics.NumProtos)}
+		l.pending[ident] = line
+	}
+	line.Exporters++
+	if seconds := current.LastUpdate.Sub(previous.LastUpdate).Seconds(); seconds > line.Seconds {
+		line.Seconds = seconds
+	}
+	for proto, after := range current.Protos {
+		before := previous.Protos[proto]
+		name := metrics.Proto(proto).String()
+		counters := line.Protos[name]
+		counters.Flows += counterDelta(before.Flows, after.Flows)
+		counters.Packets += counterDelta(before.Packets, after.Packets)
+		counters.Bytes += counterDelta(before.Bytes, after.Bytes)
+		line.Protos[name] = counters
+	}
+
+} // End of update
+
+// write logs the line of ident after its message. Messages without an
+// exporter, which reported before, have no interval and are not logged.
+// It is a listener.Options.OnMessage function.
+func (l *intervalLogger) write(ident string, list []metrics.Metric) {
+
+	l.mutex.Lock()
+	line := l.pending[ident]
+	delete(l.pending, ident)
+	l.mutex.Unlock()
+
+	if line == nil {
+		return
+	}
+	if len(list) > 0 {
+		line.Time = list[0].LastUpdate.UTC()
+	}
+	for _, counters := range line.Protos {
+		line.Flows += counters.Flows
+		line.Packets += counters.Packets
+		line.Bytes += counters.Bytes
+	}
+	if line.Seconds > 0 {
+		line.FlowsPerSecond = float64(line.Flows) / line.Seconds
+		line.PacketsPerSecond = float64(line.Packets) / line.Seconds
+		line.BytesPerSecond = float64(line.Bytes) / line.Seconds
+	}
+
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+	if err := l.encoder.Encode(line); err != nil {
+		log.Printf("Write interval log of ident %q failed: %v\n", ident, err)
+	}
+
+} // End of write
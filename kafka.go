@@ -0,0 +1,180 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * kafka publishes the statistics of each received message as a JSON
+ * message to a Kafka topic, keyed by ident. The Kafka client is compiled
+ * in with the build tag kafka only, see kafka_client.go.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+const (
+	// kafkaBatchSize is the maximum number of messages per write
+	kafkaBatchSize = 100
+	// kafkaFlushTimeout limits the final write on shutdown
+	kafkaFlushTimeout = 5 * time.Second
+)
+
+var errKafkaUnsupported = errors.New("built without Kafka support - build with -tags kafka")
+
+var (
+	kafkaWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "kafka_messages_written_total",
+		Help:      "How many messages have been written to Kafka.",
+	})
+	kafkaDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "kafka_messages_dropped_total",
+		Help:      "How many messages have been dropped, because the buffer was full or the write failed.",
+	})
+)
+
+// kafkaMessage is a message of the topic
+type kafkaMessage struct {
+	key   []byte
+	value []byte
+}
+
+// kafkaClient writes messages to the topic. It is implemented by the
+// Kafka client, if compiled in.
+type kafkaClient interface {
+	write(ctx context.Context, messages []kafkaMessage) error
+	close() error
+}
+
+// kafkaProducer buffers the messages until they are written
+type kafkaProducer struct {
+	client kafkaClient
+	queue  chan kafkaMessage
+	deltas *deltaRecorder
+}
+
+func newKafkaProducer(client kafkaClient, bufferSize int) *kafkaProducer {
+	return &kafkaProducer{
+		client: client,
+		queue:  make(chan kafkaMessage, bufferSize),
+		deltas: newDeltaRecorder(),
+	}
+} // End of newKafkaProducer
+
+// update keeps the deltas of an exporter for the message of ident. It
+// is a metrics.UpdateFunc.
+func (k *kafkaProducer) update(ident string, previous, current metrics.Metric) {
+	k.deltas.update(ident, previous, current)
+} // End of update
+
+// add queues the message of ident with the deltas collected by update.
+// If the buffer is full, the message is dropped. It is a
+// listener.Options.OnMessage function.
+func (k *kafkaProducer) add(ident string, list []metrics.Metric) {
+
+	value, err := json.Marshal(k.deltas.interval(ident, list))
+	if err != nil {
+		kafkaDropped.Inc()
+		log.Printf("Encode Kafka message of ident %q failed: %v\n", ident, err)
+		return
+	}
+
+	select {
+	case k.queue <- kafkaMessage{key: []byte(ident), value: value}:
+	default:
+		kafkaDropped.Inc()
+	}
+
+} // End of add
+
+// run writes the queued messages in batches until ctx is done. The
+// queue is emptied, when drained is closed, so it includes the messages
+// the listener applies on shutdown.
+func (k *kafkaProducer) run(ctx context.Context, drained <-chan struct{}) {
+
+	defer k.client.close()
+	for {
+		select {
+		case <-ctx.Done():
+			<-drained
+			flushCtx, cancel := context.WithTimeout(context.Background(), kafkaFlushTimeout)
+			for k.flush(flushCtx, nil) {
+			}
+			cancel()
+			return
+		case first := <-k.queue:
+			k.flush(ctx, &first)
+		}
+	}
+
+} // End of run
+
+// flush writes first, if not nil, and up to a batch of queued messages.
+// It returns false, if there was nothing to write.
+func (k *kafkaProducer) flush(ctx context.Context, first *kafkaMessage) bool {
+
+	batch := make([]kafkaMessage, 0, kafkaBatchSize)
+	if first != nil {
+		batch = append(batch, *first)
+	}
+collect:
+	for len(batch) < kafkaBatchSize {
+		select {
+		case message := <-k.queue:
+			batch = append(batch, message)
+		default:
+			break collect
+		}
+	}
+	if len(batch) == 0 {
+		return false
+	}
+
+	if err := k.client.write(ctx, batch); err != nil {
+		kafkaDropped.Add(float64(len(batch)))
+		log.Printf("Kafka write of %d messages failed: %v\n", len(batch), err)
+		return true
+	}
+	kafkaWritten.Add(float64(len(batch)))
+	return true
+
+} // End of flush
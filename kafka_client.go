@@ -0,0 +1,81 @@
+//go:build kafka
+
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * kafka_client implements the kafkaClient with kafka-go. It is compiled
+ * with the build tag kafka only, so default builds do not carry the
+ * Kafka client.
+ */
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaSupported tells, whether the Kafka client is compiled in
+const kafkaSupported = true
+
+// kafkaWriter writes to a topic with the kafka-go Writer
+type kafkaWriter struct {
+	writer *kafka.Writer
+}
+
+// newKafkaClient returns a client for topic on brokers. Messages with
+// the same key are written to the same partition.
+func newKafkaClient(brokers []string, topic string, timeout time.Duration) kafkaClient {
+	return &kafkaWriter{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: 10 * time.Millisecond,
+		WriteTimeout: timeout,
+		RequiredAcks: kafka.RequireOne,
+	}}
+} // End of newKafkaClient
+
+func (w *kafkaWriter) write(ctx context.Context, messages []kafkaMessage) error {
+
+	batch := make([]kafka.Message, len(messages))
+	for i, message := range messages {
+		batch[i] = kafka.Message{Key: message.key, Value: message.value}
+	}
+	return w.writer.WriteMessages(ctx, batch...)
+
+} // End of write
+
+func (w *kafkaWriter) close() error {
+	return w.writer.Close()
+} // End of close
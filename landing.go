@@ -0,0 +1,120 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * landing renders the landing page at / from an html/template. The
+ * built-in template can be replaced with -web-landing-template.
+ */
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const defaultLandingTemplate = `<html>
+<head><title>NfSen Metric Exporter</title></head>
+<body>
+<h1>NfSen Metric Exporter</h1>
+<p>Instance {{.Instance}}, version {{.Version}}</p>
+<ul>
+<li><a href='{{.MetricsPath}}'>Metrics</a></li>
+<li><a href='{{.HealthPath}}'>Health</a></li>
+<li><a href='{{.ReadyPath}}'>Readiness</a></li>
+</ul>
+</body>
+</html>
+`
+
+// landingData is passed to the landing page template
+type landingData struct {
+	Instance    string
+	Version     string
+	MetricsPath string
+	HealthPath  string
+	ReadyPath   string
+}
+
+// loadLandingTemplate parses the template file given by path or the
+// built-in template, if path is empty
+func loadLandingTemplate(path string) (*template.Template, error) {
+
+	if path == "" {
+		return template.New("landing").Parse(defaultLandingTemplate)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("landing").Parse(string(data))
+
+} // End of loadLandingTemplate
+
+// landingHandler renders the landing page. The page is rendered into a
+// buffer first, so a template error returns 500 instead of a partial page.
+// The links include -metrics-path-prefix, as seen by the browser.
+func landingHandler(tmpl *template.Template) http.HandlerFunc {
+
+	// the admin endpoints of -split-listen are not below the prefix
+	adminPrefix := *metricsPathPrefix
+	if *splitListen {
+		adminPrefix = ""
+	}
+	instance, _ := os.Hostname()
+	data := landingData{
+		Instance:    instance,
+		Version:     version,
+		MetricsPath: *metricsPathPrefix + *metricsURI,
+		HealthPath:  adminPrefix + healthPath,
+		ReadyPath:   adminPrefix + readyPath,
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		var page bytes.Buffer
+		if err := tmpl.Execute(&page, data); err != nil {
+			log.Printf("Render landing page failed: %v\n", err)
+			http.Error(w, "landing page template error", http.StatusInternalServerError)
+			return
+		}
+		w.Write(page.Bytes())
+	}
+
+} // End of landingHandler
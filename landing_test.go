@@ -0,0 +1,133 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// landingLinks matches the links of the landing page
+var landingLinks = regexp.MustCompile(`href='([^']*)'`)
+
+// newPrefixServer serves the landing page, a metrics stub and the health
+// endpoints like main below prefix
+func newPrefixServer(t *testing.T, prefix string, split bool) *httptest.Server {
+
+	savedPrefix, savedSplit := *metricsPathPrefix, *splitListen
+	*metricsPathPrefix, *splitListen = prefix, split
+	t.Cleanup(func() { *metricsPathPrefix, *splitListen = savedPrefix, savedSplit })
+
+	tmpl, err := loadLandingTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(*metricsURI, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "metrics at "+r.URL.Path)
+	})
+	mux.HandleFunc("/", landingHandler(tmpl))
+	mux.HandleFunc(healthPath, healthHandler)
+	server := httptest.NewServer(withPathPrefix(prefix, mux))
+	t.Cleanup(server.Close)
+	return server
+
+} // End of newPrefixServer
+
+// fetch returns the status and body of a request to url without redirects
+func fetch(t *testing.T, url string) (int, string, string) {
+
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), resp.Header.Get("Location")
+
+} // End of fetch
+
+func TestPathPrefix(t *testing.T) {
+
+	server := newPrefixServer(t, "/nfexporter", false)
+
+	status, page, _ := fetch(t, server.URL+"/nfexporter/")
+	if status != http.StatusOK {
+		t.Fatalf("landing page = %d, want 200", status)
+	}
+	var links []string
+	for _, match := range landingLinks.FindAllStringSubmatch(page, -1) {
+		links = append(links, match[1])
+	}
+	want := []string{"/nfexporter" + *metricsURI, "/nfexporter" + healthPath, "/nfexporter" + readyPath}
+	if strings.Join(links, " ") != strings.Join(want, " ") {
+		t.Errorf("landing page links %v, want %v", links, want)
+	}
+
+	// the handlers get the path without prefix
+	if status, body, _ := fetch(t, server.URL+links[0]); status != http.StatusOK || body != "metrics at "+*metricsURI {
+		t.Errorf("%s = %d %q, want the metrics at %s", links[0], status, body, *metricsURI)
+	}
+	if status, _, _ := fetch(t, server.URL+links[1]); status != http.StatusOK {
+		t.Errorf("%s = %d, want 200", links[1], status)
+	}
+
+	// the prefix without slash is redirected, paths outside are not found
+	if status, _, location := fetch(t, server.URL+"/nfexporter"); status != http.StatusMovedPermanently || location != "/nfexporter/" {
+		t.Errorf("/nfexporter = %d to %q, want a redirect to /nfexporter/", status, location)
+	}
+	for _, path := range []string{"/", *metricsURI, healthPath, "/nfexporterx/"} {
+		if status, _, _ := fetch(t, server.URL+path); status != http.StatusNotFound {
+			t.Errorf("%s = %d, want 404 outside the prefix", path, status)
+		}
+	}
+
+} // End of TestPathPrefix
+
+// TestPathPrefixSplitListen checks, that the links to the admin
+// endpoints of -split-listen have no prefix
+func TestPathPrefixSplitListen(t *testing.T) {
+
+	server := newPrefixServer(t, "/nfexporter", true)
+	_, page, _ := fetch(t, server.URL+"/nfexporter/")
+	for _, link := range []string{"/nfexporter" + *metricsURI, healthPath, readyPath} {
+		if !strings.Contains(page, "href='"+link+"'") {
+			t.Errorf("landing page lacks link %s:\n%s", link, page)
+		}
+	}
+
+} // End of TestPathPrefixSplitListen
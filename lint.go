@@ -0,0 +1,108 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * lint checks the exposed metric families with promlint for -lint-metrics,
+ * so names and help texts, which break the Prometheus conventions, are
+ * found before they are released.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+
+	"nfsen_exporter/pkg/exporter"
+)
+
+// lintInterval is the interval of the lint runs. The collector families
+// appear with the first messages, so a run at the start does not see them.
+const lintInterval = time.Minute
+
+// lintNoTotal is the finding of a counter without _total suffix
+const lintNoTotal = `counter metrics should have "_total" suffix`
+
+// lintSuppressed are the findings, which are kept on purpose, with the
+// reason
+var lintSuppressed = map[promlint.Problem]string{
+	{Metric: "nfsen_collector_flows", Text: lintNoTotal}:   "name of the first release, used by dashboards",
+	{Metric: "nfsen_collector_packets", Text: lintNoTotal}: "name of the first release, used by dashboards",
+	{Metric: "nfsen_collector_bytes", Text: lintNoTotal}:   "name of the first release, used by dashboards",
+
+	{Metric: "nfsen_collector_bytes_per_flow_histogram", Text: "metric name should not include type 'histogram'"}: "released name",
+}
+
+// runMetricsLint lints the metrics of exp at the start and every
+// lintInterval until ctx is done. Each finding is logged once.
+func runMetricsLint(ctx context.Context, exp *exporter.Exporter) {
+
+	logged := make(map[promlint.Problem]bool)
+	ticker := time.NewTicker(lintInterval)
+	defer ticker.Stop()
+
+	for {
+		lintMetrics(ctx, exp, logged)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+} // End of runMetricsLint
+
+// lintMetrics logs the findings, which are neither suppressed nor in
+// logged, and adds them to logged
+func lintMetrics(ctx context.Context, exp *exporter.Exporter, logged map[promlint.Problem]bool) {
+
+	// all families, the changes of -export-only-changed stay with the scrape
+	families, err := gathererOf(exp.AllWithContext(ctx)).Gather()
+	if err != nil {
+		log.Printf("Lint metrics: gather failed: %v\n", err)
+		return
+	}
+	problems, err := promlint.NewWithMetricFamilies(families).Lint()
+	if err != nil {
+		log.Printf("Lint metrics failed: %v\n", err)
+		return
+	}
+	for _, problem := range problems {
+		if _, ok := lintSuppressed[problem]; ok || logged[problem] {
+			continue
+		}
+		logged[problem] = true
+		log.Printf("Lint metric %s: %s\n", problem.Metric, problem.Text)
+	}
+
+} // End of lintMetrics
@@ -0,0 +1,169 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * logfile writes the log to -log-file instead of stderr, for deployments
+ * without journald or a log shipper. The file is rotated by size, keeping
+ * -log-max-backups old files, and reopened on SIGUSR1 for logrotate.
+ * stderr is redirected to the file as well, so panics of the runtime
+ * land in it.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// logFile is a log file, which is rotated, before it exceeds maxSize
+type logFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// openLogFile opens the log file at path for appending. maxSize 0
+// disables the rotation.
+func openLogFile(path string, maxSize int64, backups int) (*logFile, error) {
+
+	f := &logFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+
+} // End of openLogFile
+
+// open opens the file at path and points stderr to it
+func (f *logFile) open() error {
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := redirectStderr(file); err != nil {
+		file.Close()
+		return fmt.Errorf("redirect stderr: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+
+} // End of open
+
+// Write implements io.Writer for the logger. If the file cannot be
+// rotated or reopened, the log goes to the file still open as stderr.
+func (f *logFile) Write(p []byte) (int, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Rotate log file %s failed: %v\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		return os.Stderr.Write(p)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+
+} // End of Write
+
+// rotate renames the file to path.1, the older ones to path.2 and so on,
+// dropping the oldest, and opens a new file. Without backups, the file
+// is truncated.
+func (f *logFile) rotate() error {
+
+	f.file.Close()
+	f.file = nil
+	if f.backups == 0 {
+		if err := os.Truncate(f.path, 0); err != nil {
+			return err
+		}
+		return f.open()
+	}
+	for i := f.backups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+
+} // End of rotate
+
+// reopen closes the file and opens path again, after logrotate moved it
+func (f *logFile) reopen() error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+
+} // End of reopen
+
+// reopenOnSignal reopens the log file on each SIGUSR1 for the life of
+// the process
+func (f *logFile) reopenOnSignal() {
+
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	for range usr1 {
+		if err := f.reopen(); err != nil {
+			fmt.Fprintf(os.Stderr, "Reopen log file %s failed: %v\n", f.path, err)
+			continue
+		}
+		log.Printf("Reopened log file %s\n", f.path)
+	}
+
+} // End of reopenOnSignal
@@ -28,158 +28,894 @@
  */
 
 /*
- * Poc to implement a metric exporter for nfcapd collectors to Prometheus
+ * Poc to implement a metric exporter for nfcapd collectors to Prometheus.
+ * main wires the socket listener, the metric store and the Prometheus
+ * exporter from the packages in pkg/.
  */
 
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
-	"sync"
+	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/listener"
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/nfsocktest"
 )
 
-const namespace = "nfsen"
+// shutdownTimeout limits the wait for running scrapes on shutdown
+const shutdownTimeout = 5 * time.Second
 
-var mutex *sync.Mutex
+// exit codes for the failed component
+const (
+	exitConfig     = 1
+	exitSocket     = 2
+	exitHTTP       = 3
+	exitProfile    = 4
+	exitSelfTest   = 5
+	exitPrivileges = 6
+)
 
 var (
-	listenAddress = flag.String("listen", ":9141", "Address to listen on for telemetry")
-	metricsURI    = flag.String("path", "/metrics", "Path under which to expose metrics")
-	socketPath    = flag.String("socket", "/tmp/nfsen.sock", "Path for nfcapd collectors to connect")
+	listenAddress        = flag.String("listen", ":9141", "Address to listen on for telemetry")
+	splitListen          = flag.Bool("split-listen", false, "Serve the health, ready and expvar endpoints on -admin-listen instead of -listen, which serves the metrics only")
+	adminAddress         = flag.String("admin-listen", "127.0.0.1:9142", "Address of the health, ready and expvar endpoints with -split-listen")
+	metricsURI           = flag.String("path", "/metrics", "Path under which to expose metrics")
+	metricsPathPrefix    = flag.String("metrics-path-prefix", "", "Serve -path, the landing page and, without -split-listen, the admin endpoints below this prefix, e.g. /nfexporter behind a reverse proxy, which passes the path unchanged")
+	socketPath           = flag.String("socket", "/tmp/nfsen.sock", "Path for nfcapd collectors to connect")
+	socketSELinuxLabel   = flag.String("socket-selinux-label", "", "SELinux context of the -socket file, e.g. system_u:object_r:nfsen_var_run_t:s0, for nfcapd to connect with SELinux enforcing")
+	socketMkdir          = flag.Bool("socket-mkdir", true, "Create missing parent directories of -socket before binding and remove them on shutdown, if they are empty")
+	socketDirMode        = flag.String("socket-dir-mode", "0755", "Octal permissions of the directories created by -socket-mkdir")
+	socketWatchdog       = flag.Bool("socket-watchdog", true, "Check the -socket file every -socket-watchdog-interval and create the socket again, if it was removed or replaced")
+	socketCheckInterval  = flag.Duration("socket-watchdog-interval", 30*time.Second, "Interval of the checks of -socket-watchdog")
+	socketAbstract       = flag.Bool("socket-abstract", false, "Create -socket as Linux abstract socket without a file system entry. Collectors connect to @<socket>")
+	runAsUser            = flag.String("run-as-user", "", "Drop root privileges to this user name or uid, after the socket and the HTTP listeners are bound")
+	runAsGroup           = flag.String("run-as-group", "", "Group name or gid to drop root privileges to with -run-as-user. Defaults to the primary group of the user")
+	socketBacklog        = flag.Int("socket-backlog", 128, "Depth of the listen queue of the socket for connecting collectors. Linux caps it at net.core.somaxconn")
+	scrapeTimeout        = flag.Duration("scrape-timeout", 10*time.Second, "Abort scrapes, which take longer than this duration. 0 disables the timeout")
+	terminationDrain     = flag.Duration("termination-drain", 0, "On SIGTERM or SIGINT, report not ready on /readyz, but keep the socket and the metrics working for this duration before the shutdown. A second signal ends the drain")
+	metricTTL            = flag.Duration("metric-ttl", 15*time.Minute, "Remove exporters, which did not report for this duration. 0 keeps them forever")
+	maxTrackedSeries     = flag.Int("max-tracked-series", 0, "Evict the least recently updated exporters beyond this number of ident and exporter pairs. 0 is unlimited")
+	exportOnlyChanged    = flag.Bool("export-only-changed", false, "Expose the series of an exporter only, if its counters changed since the previous scrape. WARNING: breaks the staleness handling of Prometheus, see the README")
+	timestampedMetrics   = flag.Bool("timestamped-metrics", false, "Expose the collector series with the time their message was received. Such samples go stale differently, see the README")
+	monotonic            = flag.Bool("monotonic", false, "Keep the counters from decreasing after a nfcapd restart by adding the last value before the reset")
+	alertFlowDrop        = flag.Bool("alert-on-flow-drop", false, "Count and log decreasing counters, e.g. after a nfcapd restart")
+	maxConnIdle          = flag.Duration("max-connection-idle", 120*time.Second, "Close collector connections without a message for this duration. 0 disables")
+	maxQueue             = flag.Int("max-message-queue", 1024, "Number of received messages waiting for each parse worker, before messages are dropped")
+	parseWorkers         = flag.Int("parse-workers", 0, "Number of goroutines, which decode the received messages. Messages of an ident are decoded by the same worker. 0 uses the number of CPUs")
+	stateFilePath        = flag.String("state-file", "", "Save the metric state to this file on shutdown and load it at startup")
+	stateMaxAge          = flag.Duration("state-max-age", time.Hour, "Ignore a state file older than this. 0 accepts any age")
+	stateInterval        = flag.Duration("state-interval", time.Minute, "Interval to save the state file in addition to shutdown")
+	valueMode            = flag.String("value-mode", "counter", "Expose the totals as counters, the last interval as gauges or both: counter|gauge|both")
+	landingTemplatePath  = flag.String("web-landing-template", "", "html/template file for the landing page instead of the built-in page")
+	descriptionsPath     = flag.String("metric-descriptions-file", "", "YAML file of metric names and help texts to replace the built-in ones")
+	dryRun               = flag.Bool("dry-run", false, "Validate the configuration, print what would be started and exit")
+	onceMode             = flag.Bool("once", false, "Collect metrics for -wait, print them to stdout and exit")
+	onceWait             = flag.Duration("wait", 70*time.Second, "How long to collect metrics in -once mode")
+	dryRunSocket         = flag.Bool("dry-run-socket", false, "Read the collector messages from stdin instead of -socket, e.g. for tests without nfcapd. With -once, the end of stdin ends -wait")
+	remoteWriteURL       = flag.String("remote-write-url", "", "Push the metrics to this Prometheus remote write URL in addition to serving them")
+	remoteWriteInterval  = flag.Duration("remote-write-interval", 30*time.Second, "Interval to push the metrics with -remote-write-url")
+	remoteWriteUser      = flag.String("remote-write-username", "", "Basic auth user name for -remote-write-url")
+	remoteWritePassword  = flag.String("remote-write-password", "", "Basic auth password for -remote-write-url")
+	remoteWriteQueue     = flag.Int("remote-write-queue", 10, "Number of gathered remote write requests waiting for the sender, before requests are dropped")
+	remoteWriteCAFile    = flag.String("remote-write-tls-ca-file", "", "PEM file with the CA certificates to verify the -remote-write-url server. Empty uses the system CAs")
+	remoteWriteCertFile  = flag.String("remote-write-tls-cert-file", "", "PEM client certificate file for -remote-write-url")
+	remoteWriteKeyFile   = flag.String("remote-write-tls-key-file", "", "PEM client key file for -remote-write-tls-cert-file")
+	remoteWriteInsecure  = flag.Bool("remote-write-tls-insecure-skip-verify", false, "Do not verify the certificate of the -remote-write-url server")
+	vmImportURL          = flag.String("vm-import-url", "", "Push the metrics to this VictoriaMetrics JSON line import URL, e.g. http://victoriametrics:8428/api/v1/import")
+	vmImportInterval     = flag.Duration("vm-import-interval", time.Minute, "Interval to push the metrics with -vm-import-url")
+	vmSpoolDir           = flag.String("vm-spool-dir", "", "Directory to keep the batches waiting for -vm-import-url across restarts. Empty keeps them in memory")
+	vmSpoolMaxBytes      = flag.Int64("vm-spool-max-bytes", 64<<20, "Maximum size of the batches waiting for -vm-import-url, beyond the oldest are dropped")
+	pushURL              = flag.String("push-url", "", "Push the metrics to this Prometheus Pushgateway URL in addition to serving them")
+	pushInterval         = flag.Duration("push-interval", 30*time.Second, "Interval to push the metrics with -push-url")
+	pushJob              = flag.String("push-job", "nfsen_exporter", "Job name of the metrics pushed with -push-url")
+	exporterIDAsIP       = flag.Bool("exporter-id-as-ip", false, "Format the exporter label as dotted IPv4 address for exporter IDs, which fit into 32 bits, e.g. 167772161 as 10.0.0.1")
+	histogramMode        = flag.Bool("enable-histogram-mode", false, "Expose the flows, packets and bytes as native and classic histograms of the differences between the messages instead of counters")
+	perIdentHistograms   = flag.Bool("enable-per-ident-histograms", false, "Expose the histogram of the average bytes per flow per ident and protocol. Adds a series per bucket, ident and protocol")
+	histogramBuckets     = flag.String("histogram-buckets", "100,1000,10000,100000,1000000", "Comma separated upper bounds of the buckets of -enable-per-ident-histograms")
+	emaAlpha             = flag.Float64("ema-alpha", 0.2, "Weight of the latest rate in the nfsen_collector_flows_ema moving average, between 0 and 1. 0 disables the average")
+	goRuntimeMetrics     = flag.Bool("enable-go-runtime-metrics", true, "Expose the go_* runtime and process_* metrics of the exporter. Disable to save series in resource constrained environments")
+	otlpEndpoint         = flag.String("otlp-endpoint", "", "Export the collector counters to this OTLP/HTTP metrics URL, e.g. http://otel-collector:4318/v1/metrics")
+	otlpInterval         = flag.Duration("otlp-interval", 30*time.Second, "Interval to export the counters with -otlp-endpoint")
+	otlpTemporality      = flag.String("otlp-temporality", "cumulative", "Aggregation temporality of the OTLP sums: cumulative|delta")
+	influxURL            = flag.String("influx-url", "", "Write the statistics of each message to this InfluxDB v2 URL, e.g. http://influxdb:8086")
+	influxOrg            = flag.String("influx-org", "", "Organization of -influx-bucket")
+	influxBucket         = flag.String("influx-bucket", "", "Bucket to write the points of -influx-url to")
+	influxToken          = flag.String("influx-token", "", "API token for -influx-url")
+	influxInterval       = flag.Duration("influx-interval", 10*time.Second, "Interval to write the buffered points to -influx-url")
+	influxMaxPoints      = flag.Int("influx-max-points", 100000, "Number of buffered points for -influx-url, before points are dropped")
+	graphiteHost         = flag.String("graphite-host", "", "Send the collector counters to this Carbon plaintext host:port")
+	graphitePrefix       = flag.String("graphite-prefix", "nfsen", "Prefix of the metric paths sent to -graphite-host")
+	graphiteInterval     = flag.Duration("graphite-interval", time.Minute, "Interval to send the counters to -graphite-host")
+	textfilePath         = flag.String("textfile-path", "", "Write the metrics to this *.prom file for the node_exporter textfile collector, e.g. /var/lib/node_exporter/textfile/nfsen.prom")
+	textfileInterval     = flag.Duration("textfile-interval", 0, "Interval to write -textfile-path. 0 writes after each message")
+	textfileMode         = flag.String("textfile-mode", "0644", "Octal file permissions of -textfile-path")
+	webhookConfigPath    = flag.String("webhook-config", "", "YAML file of a webhook, which is notified, when an ident stops sending messages and when it recovers")
+	lintMetricsFlag      = flag.Bool("lint-metrics", false, "Check the exposed metrics with promlint at the start and every minute and log each finding once")
+	selfTest             = flag.Bool("self-test", false, "After the start, send test messages to the socket and check them in a scrape of -listen. Exits with 5, if the check fails")
+	recordFile           = flag.String("record-file", "", "Append the raw collector messages to this file for the replay subcommand")
+	logIntervals         = flag.Bool("log-intervals", false, "Write a JSON line with the deltas and rates of each message to stdout")
+	kafkaBrokers         = flag.String("kafka-brokers", "", "Comma separated Kafka brokers host:port to publish the statistics of each message to. Needs a build with -tags kafka")
+	kafkaTopic           = flag.String("kafka-topic", "nfsen", "Kafka topic of -kafka-brokers")
+	kafkaBuffer          = flag.Int("kafka-buffer", 1000, "Maximum number of messages waiting for -kafka-brokers, further ones are dropped")
+	kafkaTimeout         = flag.Duration("kafka-timeout", 10*time.Second, "Timeout of a write to -kafka-brokers")
+	mqttBroker           = flag.String("mqtt-broker", "", "MQTT broker URL tcp://host:1883 or ssl://host:8883 to publish the statistics of each message to, as retained message per ident")
+	mqttTopicPrefix      = flag.String("mqtt-topic-prefix", "nfsen", "Topic prefix of -mqtt-broker, messages are published to <prefix>/<ident>/stats")
+	mqttQoS              = flag.Int("mqtt-qos", 1, "QoS 0, 1 or 2 of the messages published to -mqtt-broker")
+	mqttClientID         = flag.String("mqtt-client-id", "", "Client ID at -mqtt-broker. Empty uses nfsen_exporter-<hostname>")
+	mqttUser             = flag.String("mqtt-username", "", "User name for -mqtt-broker")
+	mqttPassword         = flag.String("mqtt-password", "", "Password for -mqtt-broker")
+	mqttTimeout          = flag.Duration("mqtt-timeout", 10*time.Second, "Timeout of a connect and a publish to -mqtt-broker")
+	mqttCAFile           = flag.String("mqtt-tls-ca-file", "", "PEM file with the CA certificates to verify the ssl:// -mqtt-broker. Empty uses the system CAs")
+	mqttCertFile         = flag.String("mqtt-tls-cert-file", "", "PEM client certificate file for -mqtt-broker")
+	mqttKeyFile          = flag.String("mqtt-tls-key-file", "", "PEM client key file for -mqtt-tls-cert-file")
+	mqttInsecure         = flag.Bool("mqtt-tls-insecure-skip-verify", false, "Do not verify the certificate of the -mqtt-broker")
+	statsdHost           = flag.String("statsd-host", "", "Send the deltas of each message as StatsD counters to this UDP host:port")
+	statsdPrefix         = flag.String("statsd-prefix", "nfsen", "Prefix of the metric names sent to -statsd-host")
+	statsdTags           = flag.String("statsd-tags", "dogstatsd", "Format of the labels sent to -statsd-host: dogstatsd tags|plain metric names")
+	enableExpvar         = flag.Bool("enable-expvar", false, "Serve the exporter statistics as Go expvars under /debug/vars on -listen")
+	logFilePath          = flag.String("log-file", "", "Write the log to this file instead of stderr, rotated by size and reopened on SIGUSR1")
+	logMaxSizeMB         = flag.Int("log-max-size-mb", 100, "Rotate -log-file, before it exceeds this size in MiB. 0 disables the rotation")
+	logMaxBackups        = flag.Int("log-max-backups", 5, "Number of rotated files of -log-file to keep")
+	remoteConfigURL      = flag.String("remote-config-url", "", "Fetch flag values as YAML from this http(s) URL on startup. Flags on the command line take precedence")
+	remoteConfigRetries  = flag.Int("remote-config-retries", 3, "Retry fetching -remote-config-url this often, before falling back to the local configuration")
+	profileAddress       = flag.String("profile-addr", "", "Serve pprof with mutex and block profiling on this address. Slows down the exporter, use for profiling sessions only")
+	mutexProfileFraction = flag.Int("mutex-profile-fraction", 5, "Sample one in this many mutex contention events with -profile-addr")
 )
 
-var (
+// gatherer returns the default registry together with the exporter
+// metrics, collected with ctx, and the help texts of
+// -metric-descriptions-file
+func gatherer(ctx context.Context, exp *exporter.Exporter) prometheus.Gatherer {
+	return gathererOf(exp.WithContext(ctx))
+} // End of gatherer
 
-	// Metrics
-	uptime = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "collector", "uptime"),
-		"nfsen uptime.",
-		[]string{"version"}, nil,
-	)
-	flowsReceived = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "collector", "flows"),
-		"How many flows have been received (per ident and protocol (tcp/udp/icmp/other)).",
-		[]string{"ident", "exporter", "proto"}, nil,
-	)
-	packetsReceived = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "collector", "packets"),
-		"How many packets have been received (per ident and protocol) (tcp/udp/icmp/other).",
-		[]string{"ident", "exporter", "proto"}, nil,
-	)
-	bytesReceived = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "collector", "bytes"),
-		"How many bytes have been received (per ident and protocol) (tcp/udp/icmp/other).",
-		[]string{"ident", "exporter", "proto"}, nil,
-	)
-)
+// gathererOf works like gatherer for a collector of the exporter metrics
+func gathererOf(collector prometheus.Collector) prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	// checked at startup by registration.checkOnly
+	if err := registry.Register(collector); err != nil {
+		log.Printf("Skip the exporter metrics: %v\n", err)
+	}
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	if metricDescriptions != nil {
+		return describedGatherer{gatherer: gatherers, descriptions: metricDescriptions}
+	}
+	return gatherers
+} // End of gathererOf
+
+// outputGatherer works like gatherer for the outputs besides the
+// scrape. With -self-test, they do not get the self-test ident.
+func outputGatherer(ctx context.Context, exp *exporter.Exporter) prometheus.Gatherer {
+	if *selfTest {
+		return selfTestFilter{gatherer: gatherer(ctx, exp)}
+	}
+	return gatherer(ctx, exp)
+} // End of outputGatherer
+
+// resetOnHangup resets the flow rate variances on SIGHUP until ctx is done
+func resetOnHangup(ctx context.Context, exp *exporter.Exporter) {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			exp.ResetFlowRateStats()
+			log.Printf("SIGHUP: reset the flow rate variances\n")
+		}
+	}
+
+} // End of resetOnHangup
+
+// chainUpdates returns an UpdateFunc, which calls all fns in order, nil
+// without fns
+func chainUpdates(fns ...metrics.UpdateFunc) metrics.UpdateFunc {
 
-type Exporter struct {
+	switch len(fns) {
+	case 0:
+		return nil
+	case 1:
+		return fns[0]
+	}
+	return func(ident string, previous, current metrics.Metric) {
+		for _, fn := range fns {
+			fn(ident, previous, current)
+		}
+	}
+
+} // End of chainUpdates
+
+// chainMessages returns an OnMessage function, which calls all fns in
+// order, nil without fns
+func chainMessages(fns ...func(ident string, list []metrics.Metric)) func(ident string, list []metrics.Metric) {
+
+	switch len(fns) {
+	case 0:
+		return nil
+	case 1:
+		return fns[0]
+	}
+	return func(ident string, list []metrics.Metric) {
+		for _, fn := range fns {
+			fn(ident, list)
+		}
+	}
+
+} // End of chainMessages
+
+// registerRuntimeCollectors registers the Go runtime and process
+// collectors, if enabled. The default registry of client_golang may
+// contain them already, so they are replaced explicitly.
+func registerRuntimeCollectors(registrations *registration, enabled bool) {
+
+	goCollector := collectors.NewGoCollector()
+	processCollector := collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})
+	prometheus.Unregister(goCollector)
+	prometheus.Unregister(processCollector)
+	if !enabled {
+		log.Printf("Go runtime and process collectors disabled\n")
+		return
+	}
+	registrations.register("-enable-go-runtime-metrics", goCollector, processCollector)
+	log.Printf("Registered collectors: go runtime, process\n")
+
+} // End of registerRuntimeCollectors
+
+// metricsHandler serves the gatherer with the context of each scrape
+// request, limited to timeout, if it is positive
+func metricsHandler(exp *exporter.Exporter, timeout time.Duration) http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			promhttp.HandlerFor(gatherer(ctx, exp), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		}))
+} // End of metricsHandler
+
+// withPathPrefix serves handler below prefix, which is removed from the
+// path of each request. Paths outside of prefix are not found.
+func withPathPrefix(prefix string, handler http.Handler) http.Handler {
+
+	if prefix == "" {
+		return handler
+	}
+	// the mux redirects prefix to prefix/
+	mux := http.NewServeMux()
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, handler))
+	return mux
+
+} // End of withPathPrefix
+
+// componentError is the error of a failed component. Its code is the
+// exit code of the exporter.
+type componentError struct {
+	component string
+	code      int
+	err       error
 }
 
-func NewExporter() *Exporter {
-	return &Exporter{}
-} // End of NewExporter
-
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- uptime
-	ch <- flowsReceived
-	ch <- packetsReceived
-	ch <- bytesReceived
-} // End of Describe
-
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	/*
-		fmt.Printf("Ident     : %s\n", metric.ident)
-		fmt.Printf("Uptime    : %d\n", metric.uptime)
-		fmt.Printf("Flows tcp : %d\n", metric.numFlows_tcp)
-		fmt.Printf("Flows udp : %d\n", metric.numFlows_udp)
-		fmt.Printf("Flows icmp : %d\n", metric.numFlows_icmp)
-		fmt.Printf("Flows other : %d\n", metric.numFlows_other)
-		fmt.Printf("Bytes tcp : %d\n", metric.numBytes_tcp)
-		fmt.Printf("Bytes udp : %d\n", metric.numBytes_udp)
-		fmt.Printf("Bytes icmp : %d\n", metric.numBytes_icmp)
-		fmt.Printf("Bytes other : %d\n", metric.numBytes_other)
-		fmt.Printf("Packets tcp : %d\n", metric.numPackets_tcp)
-		fmt.Printf("Packets udp : %d\n", metric.numPackets_udp)
-		fmt.Printf("Packets icmp : %d\n", metric.numPackets_icmp)
-		fmt.Printf("Packets other : %d\n", metric.numPackets_other)
-	*/
-
-	mutex.Lock()
-	for ident, metrics := range metricList {
-		for _, metric := range metrics {
-			exporterStr := strconv.FormatUint(metric.exporterID, 10)
-			ch <- prometheus.MustNewConstMetric(flowsReceived, prometheus.CounterValue, float64(metric.numFlows_tcp), ident, exporterStr, "tcp")
-			ch <- prometheus.MustNewConstMetric(flowsReceived, prometheus.CounterValue, float64(metric.numFlows_udp), ident, exporterStr, "udp")
-			ch <- prometheus.MustNewConstMetric(flowsReceived, prometheus.CounterValue, float64(metric.numFlows_icmp), ident, exporterStr, "icmp")
-			ch <- prometheus.MustNewConstMetric(flowsReceived, prometheus.CounterValue, float64(metric.numFlows_other), ident, exporterStr, "other")
-
-			// packets
-			ch <- prometheus.MustNewConstMetric(packetsReceived, prometheus.CounterValue, float64(metric.numPackets_tcp), ident, exporterStr, "tcp")
-			ch <- prometheus.MustNewConstMetric(packetsReceived, prometheus.CounterValue, float64(metric.numPackets_udp), ident, exporterStr, "udp")
-			ch <- prometheus.MustNewConstMetric(packetsReceived, prometheus.CounterValue, float64(metric.numPackets_icmp), ident, exporterStr, "icmp")
-			ch <- prometheus.MustNewConstMetric(packetsReceived, prometheus.CounterValue, float64(metric.numPackets_other), ident, exporterStr, "other")
-
-			// bytes
-			ch <- prometheus.MustNewConstMetric(bytesReceived, prometheus.CounterValue, float64(metric.numBytes_tcp), ident, exporterStr, "tcp")
-			ch <- prometheus.MustNewConstMetric(bytesReceived, prometheus.CounterValue, float64(metric.numBytes_udp), ident, exporterStr, "udp")
-			ch <- prometheus.MustNewConstMetric(bytesReceived, prometheus.CounterValue, float64(metric.numPackets_icmp), ident, exporterStr, "icmp")
-			ch <- prometheus.MustNewConstMetric(bytesReceived, prometheus.CounterValue, float64(metric.numPackets_other), ident, exporterStr, "other")
-		}
-	}
-	mutex.Unlock()
-
-} // End of Collect
-
-// cleanup on signal TERM/cntrl-C
-func SetupCloseHandler(socketHandler *socketConf) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Printf("Exit exporter\n")
-		socketHandler.Close()
+func (e *componentError) Error() string {
+	return e.component + " failed: " + e.err.Error()
+}
+
+func (e *componentError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit code for the error of a component
+func exitCode(err error) int {
+	var componentErr *componentError
+	if errors.As(err, &componentErr) {
+		return componentErr.code
+	}
+	return exitConfig
+} // End of exitCode
+
+// removeSocket removes the socket file. An abstract socket has none.
+func removeSocket() {
+	if !*socketAbstract && !*dryRunSocket {
 		os.Remove(*socketPath)
-		os.Exit(0)
+		removeSocketDirs()
+	}
+} // End of removeSocket
+
+// drainOnSignal returns a context, which is done drain after signalCtx,
+// or at a second signal. In between, the exporter reports not ready, so
+// it is removed from the endpoints of a service, but still works.
+func drainOnSignal(signalCtx context.Context, drain time.Duration) context.Context {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		<-signalCtx.Done()
+
+		ready.Store(false)
+		log.Printf("Drain for %v before the shutdown, a second signal ends the drain\n", drain)
+		skip, stopSkip := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stopSkip()
+		timer := time.NewTimer(drain)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-skip.Done():
+			log.Printf("Drain ended by a second signal\n")
+		}
 	}()
-}
+	return ctx
+
+} // End of drainOnSignal
+
+// shutdown saves the state after the listener has applied all messages
+func shutdown(store *metrics.Store) {
+
+	removeSocket()
+	if *stateFilePath != "" {
+		if err := saveState(store, *stateFilePath); err != nil {
+			log.Printf("Save state file %s failed: %v\n", *stateFilePath, err)
+		}
+	}
+
+} // End of shutdown
 
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "send":
+			os.Exit(runSend(os.Args[2:]))
+		case "healthcheck":
+			os.Exit(runHealthcheck(os.Args[2:]))
+		case "dashboard":
+			os.Exit(runDashboard(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
-	exporter := NewExporter()
-	prometheus.MustRegister(exporter)
+	if *remoteConfigURL != "" {
+		if err := applyRemoteConfig(*remoteConfigURL, *remoteConfigRetries); err != nil {
+			log.Printf("WARNING: remote configuration from %s not applied, using the local configuration: %v\n", *remoteConfigURL, err)
+		}
+	}
 
-	mutex = new(sync.Mutex)
+	errs := validateFlags(!*dryRun)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+	}
+	if len(errs) > 0 {
+		os.Exit(exitConfig)
+	}
+	if *dryRun {
+		printSummary(os.Stdout)
+		os.Exit(0)
+	}
+	if *logFilePath != "" {
+		logs, err := openLogFile(*logFilePath, int64(*logMaxSizeMB)<<20, *logMaxBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Log file %s failed: %v\n", *logFilePath, err)
+			os.Exit(exitConfig)
+		}
+		log.SetOutput(logs)
+		go logs.reopenOnSignal()
+	}
 
-	socketHandler := New(*socketPath)
-	if err := socketHandler.Open(); err != nil {
-		log.Fatal("Socket handler failed: ", err)
+	landingTemplate, err := loadLandingTemplate(*landingTemplatePath)
+	if err != nil {
+		log.Fatal("Landing page template failed: ", err)
+	}
+	if *descriptionsPath != "" {
+		metricDescriptions, err = loadDescriptions(*descriptionsPath)
+		if err != nil {
+			log.Fatal("Metric descriptions failed: ", err)
+		}
 	}
-	SetupCloseHandler(socketHandler)
 
-	socketHandler.Run()
+	// the exporter forgets evicted exporters, it is created after the store
+	var exp *exporter.Exporter
+	store := metrics.NewStore(metrics.Options{
+		MaxEntries: *maxTrackedSeries,
+		OnEvict:    func(key metrics.Key) { exp.Forget(key) },
+		Monotonic:  *monotonic,
+	})
+	expOptions := exporter.Options{
+		TTL:            *metricTTL,
+		ValueMode:      *valueMode,
+		CounterResets:  *alertFlowDrop,
+		Timestamps:     *timestampedMetrics,
+		EMAAlpha:       *emaAlpha,
+		OnlyChanged:    *exportOnlyChanged,
+		Histograms:     *histogramMode,
+		ExporterIDAsIP: *exporterIDAsIP,
+	}
+	if *perIdentHistograms {
+		// validated by validateFlags
+		expOptions.BytesPerFlowBuckets, _ = parseBuckets(*histogramBuckets)
+	}
+	exp = exporter.New(store, expOptions)
 
-	http.Handle(*metricsURI, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>NfSen Metric Exporter</title></head>
-             <body>
-             <h1>NfSen Metric Exporter</h1>
-             <p><a href='` + *metricsURI + `'>Metrics</a></p>
-             </body>
-             </html>`))
+	workers := *parseWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	options := listener.Options{
+		Abstract:     *socketAbstract,
+		SELinuxLabel: *socketSELinuxLabel,
+		Backlog:      *socketBacklog,
+		QueueSize:    *maxQueue,
+		Workers:      workers,
+		IdleTimeout:  *maxConnIdle,
+		OnRemove:     exp.Forget,
+	}
+	if *dryRunSocket {
+		options.Input = os.Stdin
+	}
+	var recorder *messageRecorder
+	if *recordFile != "" {
+		if recorder, err = openRecorder(*recordFile); err != nil {
+			log.Printf("Open record file %s failed: %v\n", *recordFile, err)
+			os.Exit(exitConfig)
+		}
+		options.OnRead = skipSelfTestReads(recorder.record)
+	}
+	var onUpdate []metrics.UpdateFunc
+	if *alertFlowDrop {
+		onUpdate = append(onUpdate, exp.CheckCounterReset)
+	}
+	if *perIdentHistograms {
+		onUpdate = append(onUpdate, exp.ObserveBytesPerFlow)
+	}
+	if *histogramMode {
+		onUpdate = append(onUpdate, exp.ObserveIntervals)
+	}
+	if *emaAlpha > 0 {
+		onUpdate = append(onUpdate, exp.UpdateFlowsEMA)
+	}
+	onUpdate = append(onUpdate, exp.UpdateFlowRateStats)
+	// the byte total and the outputs do not get the self-test ident
+	outputs := []metrics.UpdateFunc{exp.CountBytes}
+	var intervals *intervalLogger
+	if *logIntervals {
+		intervals = newIntervalLogger(os.Stdout)
+		outputs = append(outputs, intervals.update)
+	}
+	var kafka *kafkaProducer
+	if *kafkaBrokers != "" {
+		client := newKafkaClient(strings.Split(*kafkaBrokers, ","), *kafkaTopic, *kafkaTimeout)
+		kafka = newKafkaProducer(client, *kafkaBuffer)
+		outputs = append(outputs, kafka.update)
+	}
+	var mqttClient *mqttPublisher
+	if *mqttBroker != "" {
+		// validated by validateFlags
+		tlsConfig, _ := loadTLSConfig(*mqttCAFile, *mqttCertFile, *mqttKeyFile, *mqttInsecure)
+		mqttClient = newMQTTPublisher(*mqttBroker, *mqttClientID, *mqttUser, *mqttPassword, tlsConfig,
+			*mqttTopicPrefix, byte(*mqttQoS), *mqttTimeout)
+		outputs = append(outputs, mqttClient.update)
+	}
+	var statsd *statsdEmitter
+	if *statsdHost != "" {
+		statsd = newStatsdEmitter(*statsdHost, *statsdPrefix, *statsdTags, exp.ExporterLabel)
+		outputs = append(outputs, statsd.update)
+	}
+	onUpdate = append(onUpdate, skipSelfTestUpdates(chainUpdates(outputs...)))
+	options.OnUpdate = chainUpdates(onUpdate...)
+
+	var onMessage []func(ident string, list []metrics.Metric)
+	var influx *influxWriter
+	if *influxURL != "" {
+		influx = newInfluxWriter(*influxURL, *influxOrg, *influxBucket, *influxToken, *influxMaxPoints, *influxInterval, exp.ExporterLabel)
+		onMessage = append(onMessage, influx.add)
+	}
+	if kafka != nil {
+		onMessage = append(onMessage, kafka.add)
+	}
+	if mqttClient != nil {
+		onMessage = append(onMessage, mqttClient.add)
+	}
+	if intervals != nil {
+		onMessage = append(onMessage, intervals.write)
+	}
+	var webhook *webhookNotifier
+	if *webhookConfigPath != "" {
+		// validated by validateFlags
+		config, _ := loadWebhookConfig(*webhookConfigPath)
+		webhook = newWebhookNotifier(config)
+		onMessage = append(onMessage, webhook.seen)
+		options.OnRemove = func(key metrics.Key) {
+			exp.Forget(key)
+			webhook.forget(key)
+		}
+	}
+	var textfile *textfileWriter
+	if *textfilePath != "" {
+		// validated by validateFlags
+		mode, _ := parseFileMode(*textfileMode)
+		textfile = newTextfileWriter(*textfilePath, mode)
+		onMessage = append(onMessage, textfile.notify)
+	}
+	options.OnMessage = skipSelfTestMessages(chainMessages(onMessage...))
+	socketHandler := listener.New(*socketPath, store, options)
+	registrations := newRegistration()
+	registerRuntimeCollectors(registrations, *goRuntimeMetrics)
+	registrations.register("socket handler", socketHandler)
+	registrations.register("allocation monitor", allocPerMessage)
+	registerSelfStats(registrations, store, socketHandler)
+	if *enableExpvar {
+		publishExpvar(store, socketHandler, *socketPath)
+	}
+	if *remoteWriteURL != "" {
+		registrations.register("-remote-write-url", remoteWriteFailures, remoteWriteDropped)
+	}
+	if *vmImportURL != "" {
+		registrations.register("-vm-import-url", vmImportFailures, vmImportDropped, vmSpoolBytes)
+	}
+	if *pushURL != "" {
+		registrations.register("-push-url", pushFailures)
+	}
+	if *otlpEndpoint != "" {
+		registrations.register("-otlp-endpoint", otlpFailures)
+	}
+	if influx != nil {
+		registrations.register("-influx-url", influxWritten, influxDropped)
+	}
+	if *graphiteHost != "" {
+		registrations.register("-graphite-host", graphiteFailures)
+	}
+	if statsd != nil {
+		registrations.register("-statsd-host", statsdPackets, statsdDropped)
+	}
+	if textfile != nil {
+		registrations.register("-textfile-path", textfileFailures)
+	}
+	if kafka != nil {
+		registrations.register("-kafka-brokers", kafkaWritten, kafkaDropped)
+	}
+	if mqttClient != nil {
+		registrations.register("-mqtt-broker", mqttPublished, mqttFailures)
+	}
+	if webhook != nil {
+		registrations.register("-webhook-config", webhookNotifications, webhookFailures)
+	}
+	if recorder != nil {
+		registrations.register("-record-file", recordFailures)
+	}
+	if watchSocket() {
+		registrations.register("-socket-watchdog", listenerRestarts)
+	}
+	registrations.checkOnly("exporter", exp)
+	for _, err := range registrations.errs {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+	}
+	if len(registrations.errs) > 0 {
+		os.Exit(exitConfig)
+	}
+
+	// cleanup on signal TERM/cntrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *terminationDrain > 0 {
+		ctx = drainOnSignal(ctx, *terminationDrain)
+	}
+
+	if *socketMkdir && !*socketAbstract && !*dryRunSocket {
+		// validated by validateFlags
+		mode, _ := parseFileMode(*socketDirMode)
+		if err := createSocketDirs(*socketPath, mode); err != nil {
+			log.Printf("Socket handler failed: create directory: %v\n", err)
+			removeSocketDirs()
+			os.Exit(exitSocket)
+		}
+	}
+	if err := socketHandler.Open(ctx); err != nil {
+		log.Printf("Socket handler failed: %v\n", err)
+		removeSocketDirs()
+		os.Exit(exitSocket)
+	}
+	if *dryRunSocket {
+		log.Printf("Read messages from stdin\n")
+	} else {
+		log.Printf("Socket backlog: %d\n", *socketBacklog)
+	}
+
+	// an own mux keeps the pprof handlers off the metrics listener
+	mux := http.NewServeMux()
+	mux.Handle(*metricsURI, metricsHandler(exp, *scrapeTimeout))
+	mux.HandleFunc("/", landingHandler(landingTemplate))
+	servers := []*http.Server{{Addr: *listenAddress, Handler: withPathPrefix(*metricsPathPrefix, mux)}}
+
+	// with -split-listen, the admin endpoints get an own server, e.g. on
+	// loopback only
+	adminMux := mux
+	if *splitListen {
+		adminMux = http.NewServeMux()
+		servers = append(servers, &http.Server{Addr: *adminAddress, Handler: adminMux})
+	}
+	adminMux.HandleFunc(healthPath, healthHandler)
+	adminMux.HandleFunc(readyPath, readyHandler)
+	if *enableExpvar {
+		adminMux.Handle(expvarPath, expvar.Handler())
+	}
+
+	// all listeners are bound before the privileges are dropped and
+	// before the notification of systemd. With -once, nothing is served.
+	var httpListeners []net.Listener
+	var profileListener net.Listener
+	if !*onceMode {
+		for _, server := range servers {
+			listener, err := net.Listen("tcp", server.Addr)
+			if err != nil {
+				log.Printf("HTTP server %s failed: %v\n", server.Addr, err)
+				removeSocket()
+				os.Exit(exitHTTP)
+			}
+			httpListeners = append(httpListeners, listener)
+		}
+		if *profileAddress != "" {
+			if profileListener, err = net.Listen("tcp", *profileAddress); err != nil {
+				log.Printf("Profile server failed: %v\n", err)
+				removeSocket()
+				os.Exit(exitProfile)
+			}
+		}
+	}
+	if *runAsUser != "" {
+		// validated by validateFlags
+		id, _ := lookupIdentity(*runAsUser, *runAsGroup)
+		var paths []string
+		if !*socketAbstract && !*dryRunSocket {
+			paths = append(append(paths, createdSocketDirs...), *socketPath)
+		}
+		if err := dropPrivileges(systemIdentity, id, paths); err != nil {
+			log.Printf("Drop privileges to %s failed: %v\n", id, err)
+			removeSocket()
+			os.Exit(exitPrivileges)
+		}
+	}
+
+	if *exportOnlyChanged {
+		log.Printf("WARNING: -export-only-changed omits unchanged series, Prometheus marks them stale and rate() has gaps\n")
+	}
+
+	if *stateFilePath != "" {
+		if err := loadState(store, *stateFilePath, *stateMaxAge); err != nil {
+			log.Printf("Ignore state file %s: %v\n", *stateFilePath, err)
+		}
+	}
+
+	// a failing component cancels ctx and shuts down all others
+	group, ctx := errgroup.WithContext(ctx)
+
+	listenerCtx, stopListener := context.WithCancel(ctx)
+	defer stopListener()
+	listenerDone := make(chan struct{})
+	group.Go(func() error {
+		defer close(listenerDone)
+		if err := socketHandler.Run(listenerCtx); err != nil {
+			return &componentError{component: "socket handler", code: exitSocket, err: err}
+		}
+		return nil
+	})
+	ready.Store(true)
+
+	if *stateFilePath != "" {
+		group.Go(func() error {
+			runStateSaver(ctx, store, *stateFilePath, *stateInterval)
+			return nil
+		})
+	}
+	group.Go(func() error {
+		runAllocMonitor(ctx, socketHandler.Processed)
+		return nil
+	})
+	group.Go(func() error {
+		resetOnHangup(ctx, exp)
+		return nil
+	})
+	if recorder != nil {
+		group.Go(func() error {
+			recorder.run(ctx, listenerDone)
+			return nil
+		})
+	}
+	if watchSocket() {
+		group.Go(func() error {
+			runSocketWatchdog(listenerCtx, socketHandler, *socketCheckInterval)
+			return nil
+		})
+	}
+
+	if *onceMode {
+		// the end of stdin ends the wait early
+		var inputDone <-chan struct{}
+		if *dryRunSocket {
+			inputDone = listenerDone
+		}
+		code := runOnce(ctx, os.Stdout, exp, store, inputDone, func() {
+			stopListener()
+			<-listenerDone
+		})
+		stop()
+		if err := group.Wait(); err != nil {
+			log.Printf("%v\n", err)
+			code = exitCode(err)
+		}
+		os.Exit(code)
+	}
+
+	if *remoteWriteURL != "" {
+		group.Go(func() error {
+			if err := runRemoteWrite(ctx, exp, *remoteWriteURL, *remoteWriteInterval, *remoteWriteQueue); err != nil {
+				return &componentError{component: "remote write", code: exitConfig, err: err}
+			}
+			return nil
+		})
+	}
+	if *vmImportURL != "" {
+		group.Go(func() error {
+			spool, err := newVMSpool(*vmSpoolDir, *vmSpoolMaxBytes)
+			if err != nil {
+				return &componentError{component: "VictoriaMetrics import", code: exitConfig, err: err}
+			}
+			runVMImport(ctx, exp, *vmImportURL, *vmImportInterval, spool)
+			return nil
+		})
+	}
+	if *pushURL != "" {
+		group.Go(func() error {
+			runPush(ctx, exp, *pushURL, *pushJob, *pushInterval)
+			return nil
+		})
+	}
+	if influx != nil {
+		group.Go(func() error {
+			influx.run(ctx, *influxInterval, listenerDone)
+			return nil
+		})
+	}
+	if *graphiteHost != "" {
+		group.Go(func() error {
+			runGraphite(ctx, store, *graphiteHost, *graphitePrefix, *graphiteInterval, exp.ExporterLabel)
+			return nil
+		})
+	}
+	if webhook != nil {
+		group.Go(func() error {
+			webhook.run(ctx)
+			return nil
+		})
+	}
+	if kafka != nil {
+		group.Go(func() error {
+			kafka.run(ctx, listenerDone)
+			return nil
+		})
+	}
+	if mqttClient != nil {
+		group.Go(func() error {
+			mqttClient.run(ctx, listenerDone)
+			return nil
+		})
+	}
+	if textfile != nil {
+		group.Go(func() error {
+			textfile.run(ctx, exp, *textfileInterval)
+			return nil
+		})
+	}
+	if statsd != nil {
+		group.Go(func() error {
+			if err := statsd.run(ctx, listenerDone); err != nil {
+				return &componentError{component: "statsd", code: exitConfig, err: err}
+			}
+			return nil
+		})
+	}
+	if *otlpEndpoint != "" {
+		group.Go(func() error {
+			runOTLP(ctx, store, *otlpEndpoint, *otlpInterval, *otlpTemporality, exp.ExporterLabel)
+			return nil
+		})
+	}
+	if profileListener != nil {
+		group.Go(func() error {
+			if err := runProfileServer(ctx, profileListener); err != nil {
+				return &componentError{component: "profile server", code: exitProfile, err: err}
+			}
+			return nil
+		})
+	}
+	for i, server := range servers {
+		server, listener := server, httpListeners[i]
+		group.Go(func() error {
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				return &componentError{component: "HTTP server " + server.Addr, code: exitHTTP, err: err}
+			}
+			return nil
+		})
+	}
+	sdNotify("READY=1")
+	if interval := watchdogInterval(); interval > 0 {
+		group.Go(func() error {
+			runWatchdog(ctx, store, interval)
+			return nil
+		})
+	}
+	if *lintMetricsFlag {
+		group.Go(func() error {
+			runMetricsLint(ctx, exp)
+			return nil
+		})
+	}
+	if *selfTest {
+		group.Go(func() error {
+			socket := *socketPath
+			if *socketAbstract {
+				socket = "@" + socket
+			}
+			// validated by validateFlags
+			url, _ := probeURL(*listenAddress, *metricsPathPrefix+*metricsURI)
+			expected := selfTestSamples(*valueMode, *histogramMode)
+			if err := runSelfTest(ctx, socket, url, nfsocktest.DefaultVersion, exp.ExporterLabel(selfTestExporter), expected); err != nil {
+				return &componentError{component: "self-test", code: exitSelfTest, err: err}
+			}
+			if ctx.Err() == nil {
+				log.Printf("Self-test passed: %d samples scraped from %s\n", len(expected), url)
+			}
+			return nil
+		})
+	}
+	group.Go(func() error {
+		<-ctx.Done()
+
+		// a further signal terminates immediately
+		stop()
+		fmt.Printf("Exit exporter\n")
+		ready.Store(false)
+		sdNotify("STOPPING=1")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Printf("HTTP shutdown of %s: %v\n", server.Addr, err)
+			}
+		}
+		return nil
 	})
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+
+	err = group.Wait()
+	shutdown(store)
+	if err != nil {
+		log.Printf("%v\n", err)
+		os.Exit(exitCode(err))
+	}
 }
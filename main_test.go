@@ -0,0 +1,94 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// TestMetricsHandler scrapes, while an eviction holds the store. The
+// scrape ends with the timeout of the handler or with the request.
+func TestMetricsHandler(t *testing.T) {
+
+	evicting := make(chan struct{})
+	release := make(chan struct{})
+	store := metrics.NewStore(metrics.Options{
+		MaxEntries: 1,
+		OnEvict: func(key metrics.Key) {
+			close(evicting)
+			<-release
+		},
+	})
+	exp := exporter.New(store, exporter.Options{ValueMode: exporter.ValueModeCounter})
+	store.Update("a", []metrics.Metric{{ExporterID: 1, LastUpdate: time.Now()}}, nil)
+	updated := make(chan struct{})
+	go func() {
+		store.Update("a", []metrics.Metric{{ExporterID: 2, LastUpdate: time.Now()}}, nil)
+		close(updated)
+	}()
+	<-evicting
+
+	scrape := func(handler http.Handler, ctx context.Context) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+		return recorder
+	}
+	recorder := scrape(metricsHandler(exp, 20*time.Millisecond), context.Background())
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), "deadline exceeded") {
+		t.Errorf("timed out scrape: got %d %q, want %d and the deadline", recorder.Code, recorder.Body, http.StatusInternalServerError)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder = scrape(metricsHandler(exp, 0), canceled)
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), "canceled") {
+		t.Errorf("canceled scrape: got %d %q, want %d and the cancellation", recorder.Code, recorder.Body, http.StatusInternalServerError)
+	}
+	close(release)
+	<-updated
+
+	recorder = scrape(metricsHandler(exp, time.Minute), context.Background())
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK || !strings.Contains(body, `nfsen_collector_flows{exporter="2"`) {
+		t.Errorf("scrape after the eviction: got %d, want %d with the flows of exporter 2:\n%s", recorder.Code, http.StatusOK, body)
+	}
+	if !strings.Contains(body, "nfsen_scrape_timeout_total 1\n") {
+		t.Errorf("scrape after the eviction: want one scrape timeout:\n%s", body)
+	}
+
+} // End of TestMetricsHandler
@@ -0,0 +1,275 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * mqtt publishes the statistics of each received message as a retained
+ * JSON message per ident to an MQTT broker. Only the latest message of
+ * each ident waits for the broker, so an outage delays, but never blocks
+ * the listener.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+const (
+	// mqttCheckInterval is the delay before waiting messages are published
+	// again, e.g. after the broker was disconnected
+	mqttCheckInterval = time.Second
+	// mqttConnectRetryInterval is the delay between the attempts of the
+	// first connect
+	mqttConnectRetryInterval = 5 * time.Second
+	// mqttMaxReconnectInterval limits the backoff of reconnects
+	mqttMaxReconnectInterval = time.Minute
+	// mqttFlushTimeout limits the final publish on shutdown
+	mqttFlushTimeout = 5 * time.Second
+	// mqttQuiesce is the time in ms to complete publishes on disconnect
+	mqttQuiesce = 250
+)
+
+var (
+	mqttPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "mqtt_messages_published_total",
+		Help:      "How many messages have been published to the MQTT broker.",
+	})
+	mqttFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "mqtt_publish_failures_total",
+		Help:      "How many publishes to the MQTT broker failed or timed out.",
+	})
+)
+
+// mqttSchemes are the broker URL schemes supported by the MQTT client
+var mqttSchemes = map[string]bool{
+	"tcp": true, "mqtt": true, "ssl": true, "tls": true, "mqtts": true, "ws": true, "wss": true,
+}
+
+// mqttPublisher keeps the latest message of each ident until it is
+// published
+type mqttPublisher struct {
+	client  mqtt.Client
+	prefix  string
+	qos     byte
+	timeout time.Duration
+	deltas  *deltaRecorder
+
+	// latest unpublished message per topic
+	mutex   sync.Mutex
+	pending map[string][]byte
+	ready   chan struct{}
+}
+
+// newMQTTPublisher returns a publisher to broker, a URL such as
+// tcp://host:1883 or ssl://host:8883. tlsConfig is used for ssl brokers,
+// an empty username disables the authentication.
+func newMQTTPublisher(broker, clientID, username, password string, tlsConfig *tls.Config,
+	prefix string, qos byte, timeout time.Duration) *mqttPublisher {
+
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = "nfsen_exporter-" + hostname
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetTLSConfig(tlsConfig).
+		SetConnectTimeout(timeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttConnectRetryInterval).
+		SetMaxReconnectInterval(mqttMaxReconnectInterval).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Printf("MQTT connected to %s\n", broker)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection to %s lost, reconnecting: %v\n", broker, err)
+		})
+	if username != "" {
+		options.SetUsername(username).SetPassword(password)
+	}
+
+	return &mqttPublisher{
+		client:  mqtt.NewClient(options),
+		prefix:  prefix,
+		qos:     qos,
+		timeout: timeout,
+		deltas:  newDeltaRecorder(),
+		pending: make(map[string][]byte),
+		ready:   make(chan struct{}, 1),
+	}
+
+} // End of newMQTTPublisher
+
+// update keeps the deltas of an exporter for the message of ident. It
+// is a metrics.UpdateFunc.
+func (p *mqttPublisher) update(ident string, previous, current metrics.Metric) {
+	p.deltas.update(ident, previous, current)
+} // End of update
+
+// add replaces the waiting message of ident with the message of list and
+// the deltas collected by update. It is a listener.Options.OnMessage
+// function.
+func (p *mqttPublisher) add(ident string, list []metrics.Metric) {
+
+	payload, err := json.Marshal(p.deltas.interval(ident, list))
+	if err != nil {
+		log.Printf("Encode MQTT message of ident %q failed: %v\n", ident, err)
+		return
+	}
+
+	p.mutex.Lock()
+	p.pending[p.topic(ident)] = payload
+	p.mutex.Unlock()
+
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+
+} // End of add
+
+// topic returns the topic of ident. The MQTT separator and wildcards
+// in the ident are replaced with _.
+func (p *mqttPublisher) topic(ident string) string {
+	level := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', 0:
+			return '_'
+		}
+		return r
+	}, ident)
+	return p.prefix + "/" + level + "/stats"
+} // End of topic
+
+// run connects to the broker and publishes the waiting messages until
+// ctx is done. The connection is retried in the background. When drained
+// is closed, the messages the listener applied on shutdown are
+// published, if the broker is connected.
+func (p *mqttPublisher) run(ctx context.Context, drained <-chan struct{}) {
+
+	p.client.Connect()
+	ticker := time.NewTicker(mqttCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			<-drained
+			p.publish(time.Now().Add(mqttFlushTimeout))
+			p.mutex.Lock()
+			if len(p.pending) > 0 {
+				log.Printf("MQTT: %d messages not published on shutdown\n", len(p.pending))
+			}
+			p.mutex.Unlock()
+			p.client.Disconnect(mqttQuiesce)
+			return
+		case <-p.ready:
+		case <-ticker.C:
+		}
+		p.publish(time.Time{})
+	}
+
+} // End of run
+
+// publish publishes the waiting messages, if the broker is connected,
+// until deadline, if not zero. Failed messages wait for the next
+// publish, unless a newer message of their ident arrived.
+func (p *mqttPublisher) publish(deadline time.Time) {
+
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+	p.mutex.Lock()
+	pending := p.pending
+	p.pending = make(map[string][]byte)
+	p.mutex.Unlock()
+
+	topics := make([]string, 0, len(pending))
+	for topic := range pending {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var err error
+	for i, topic := range topics {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			err = fmt.Errorf("flush timeout")
+		}
+		if err == nil {
+			err = p.send(topic, pending[topic])
+			if err == nil {
+				mqttPublished.Inc()
+				delete(pending, topic)
+				continue
+			}
+			mqttFailures.Inc()
+			log.Printf("MQTT publish to %s failed, %d messages wait: %v\n", topic, len(topics)-i, err)
+		}
+	}
+
+	p.mutex.Lock()
+	for topic, payload := range pending {
+		if _, newer := p.pending[topic]; !newer {
+			p.pending[topic] = payload
+		}
+	}
+	p.mutex.Unlock()
+
+} // End of publish
+
+// send publishes a retained message and waits for its acknowledgement
+// according to the QoS
+func (p *mqttPublisher) send(topic string, payload []byte) error {
+
+	token := p.client.Publish(topic, p.qos, true, payload)
+	if !token.WaitTimeout(p.timeout) {
+		return fmt.Errorf("timeout after %v", p.timeout)
+	}
+	return token.Error()
+
+} // End of send
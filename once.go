@@ -0,0 +1,89 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * once implements the one-shot mode: metrics are collected from the socket
+ * for a fixed time, printed in the Prometheus text format and the
+ * exporter exits without starting the HTTP server.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// runOnce waits for metrics, prints them to out and returns the exit
+// code. stopListener stops the listener and returns, when all received
+// messages are applied. A done ctx or a closed inputDone ends the wait
+// early.
+func runOnce(ctx context.Context, out io.Writer, exp *exporter.Exporter, store *metrics.Store, inputDone <-chan struct{}, stopListener func()) int {
+
+	select {
+	case <-time.After(*onceWait):
+	case <-ctx.Done():
+	case <-inputDone:
+	}
+
+	stopListener()
+	removeSocket()
+
+	received := store.Len() > 0
+
+	families, err := gatherer(context.Background(), exp).Gather()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Gather metrics failed: %v\n", err)
+		return 1
+	}
+
+	encoder := expfmt.NewEncoder(out, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			fmt.Fprintf(os.Stderr, "Encode metrics failed: %v\n", err)
+			return 1
+		}
+	}
+
+	if !received {
+		fmt.Fprintf(os.Stderr, "No metrics received within %v\n", *onceWait)
+		return 1
+	}
+	return 0
+
+} // End of runOnce
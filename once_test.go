@@ -0,0 +1,93 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+func TestRunOnce(t *testing.T) {
+
+	savedPath, savedWait := *socketPath, *onceWait
+	*socketPath = filepath.Join(t.TempDir(), "nfsen.sock")
+	*onceWait = time.Minute
+	t.Cleanup(func() { *socketPath, *onceWait = savedPath, savedWait })
+
+	for _, received := range []bool{true, false} {
+		if err := os.WriteFile(*socketPath, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		store := metrics.NewStore(metrics.Options{})
+		exp := exporter.New(store, exporter.Options{ValueMode: exporter.ValueModeCounter})
+		inputDone := make(chan struct{})
+		close(inputDone)
+		stopped := false
+		stopListener := func() {
+			// the last message is applied before the metrics are printed
+			if received {
+				store.Update("a", []metrics.Metric{{ExporterID: 1, LastUpdate: time.Now()}}, nil)
+			}
+			stopped = true
+		}
+
+		var out bytes.Buffer
+		code := runOnce(context.Background(), &out, exp, store, inputDone, stopListener)
+		if !stopped {
+			t.Errorf("received %v: the listener was not stopped", received)
+		}
+		if _, err := os.Stat(*socketPath); !os.IsNotExist(err) {
+			t.Errorf("received %v: the socket was not removed: %v", received, err)
+		}
+		wantCode, wantFlows := 1, false
+		if received {
+			wantCode, wantFlows = 0, true
+		}
+		if code != wantCode {
+			t.Errorf("received %v: got exit code %d, want %d", received, code, wantCode)
+		}
+		if flows := strings.Contains(out.String(), `nfsen_collector_flows{exporter="1"`); flows != wantFlows {
+			t.Errorf("received %v: got flows of exporter 1 %v, want %v:\n%s", received, flows, wantFlows, out.String())
+		}
+		if !strings.Contains(out.String(), "# TYPE nfsen_exporter_evicted_total counter\n") {
+			t.Errorf("received %v: the exporter metrics are missing:\n%s", received, out.String())
+		}
+	}
+
+} // End of TestRunOnce
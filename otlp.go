@@ -0,0 +1,303 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * otlp pushes the collector counters as OpenTelemetry Sum data points to
+ * an OTLP/HTTP endpoint. The protobuf messages are few and small, so they
+ * are encoded with protowire instead of pulling in the OpenTelemetry SDK.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// OTLP temporalities of -otlp-temporality
+const (
+	temporalityCumulative = "cumulative"
+	temporalityDelta      = "delta"
+)
+
+// AggregationTemporality values of the OTLP metrics proto
+const (
+	otlpDelta      = 1
+	otlpCumulative = 2
+)
+
+var otlpFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "exporter",
+	Name:      "otlp_failures_total",
+	Help:      "How many exports to the OTLP endpoint failed.",
+})
+
+// otlpFamily is a counter family of the OTLP export
+type otlpFamily struct {
+	name        string
+	description string
+	unit        string
+	value       func(metrics.Counters) uint64
+}
+
+var otlpFamilies = []otlpFamily{
+	{"nfsen_collector_flows", "How many flows have been received.", "{flows}",
+		func(c metrics.Counters) uint64 { return c.Flows }},
+	{"nfsen_collector_packets", "How many packets have been received.", "{packets}",
+		func(c metrics.Counters) uint64 { return c.Packets }},
+	{"nfsen_collector_bytes", "How many bytes have been received.", "By",
+		func(c metrics.Counters) uint64 { return c.Bytes }},
+}
+
+// otlpSeries is the export state of an exporter
+type otlpSeries struct {
+	// start of the cumulative counters, reset with the counters
+	start time.Time
+	// counters and time of the last export
+	last     [metrics.NumProtos]metrics.Counters
+	exported time.Time
+}
+
+// otlpExporter converts the store to OTLP requests
+type otlpExporter struct {
+	store         *metrics.Store
+	delta         bool
+	exporterLabel func(uint64) string
+	resource      []byte
+	series        map[metrics.Key]*otlpSeries
+}
+
+// runOTLP exports the counters of store to endpoint every interval until
+// ctx is done. exporterLabel formats the exporter attribute like the
+// exporter label of the scrape.
+func runOTLP(ctx context.Context, store *metrics.Store, endpoint string, interval time.Duration, temporality string, exporterLabel func(uint64) string) {
+
+	instance, _ := os.Hostname()
+	exporter := &otlpExporter{
+		store:         store,
+		delta:         temporality == temporalityDelta,
+		exporterLabel: exporterLabel,
+		resource: appendMessage(nil, 1, func(b []byte) []byte {
+			b = appendStringAttribute(b, 1, "service.name", "nfexporter")
+			b = appendStringAttribute(b, 1, "service.version", version)
+			return appendStringAttribute(b, 1, "host.name", instance)
+		}),
+		series: make(map[metrics.Key]*otlpSeries),
+	}
+	client := &http.Client{Timeout: interval}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := exporter.export(ctx, client, endpoint); err != nil {
+			otlpFailures.Inc()
+			log.Printf("OTLP export to %s failed: %v\n", endpoint, err)
+		}
+	}
+
+} // End of runOTLP
+
+// export sends the current counters to endpoint
+func (o *otlpExporter) export(ctx context.Context, client *http.Client, endpoint string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	snapshot, err := o.store.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	body := o.encode(withoutSelfTest(snapshot), time.Now())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "nfsen_exporter/"+version)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+
+} // End of export
+
+// encode builds an ExportMetricsServiceRequest of snapshot and advances
+// the export state of the series. Series no longer in the store are
+// forgotten.
+func (o *otlpExporter) encode(snapshot []metrics.Entry, now time.Time) []byte {
+
+	type point struct {
+		key     metrics.Key
+		series  *otlpSeries
+		current [metrics.NumProtos]metrics.Counters
+	}
+	points := make([]point, 0, len(snapshot))
+	seen := make(map[metrics.Key]bool, len(snapshot))
+	for _, entry := range snapshot {
+		key := metrics.Key{Ident: entry.Ident, ExporterID: entry.Metric.ExporterID}
+		seen[key] = true
+		series, ok := o.series[key]
+		if !ok {
+			series = &otlpSeries{start: now, exported: now}
+			o.series[key] = series
+		}
+		// a reset starts the cumulative counters anew
+		if decreased(series.last, entry.Metric.Protos) {
+			series.start = series.exported
+		}
+		points = append(points, point{key: key, series: series, current: entry.Metric.Protos})
+	}
+	for key := range o.series {
+		if !seen[key] {
+			delete(o.series, key)
+		}
+	}
+
+	temporality := uint64(otlpCumulative)
+	if o.delta {
+		temporality = otlpDelta
+	}
+	nowNano := uint64(now.UnixNano())
+
+	scope := appendMessage(nil, 1, func(b []byte) []byte {
+		b = appendString(b, 1, "nfsen_exporter")
+		return appendString(b, 2, version)
+	})
+	for _, family := range otlpFamilies {
+		scope = appendMessage(scope, 2, func(b []byte) []byte {
+			b = appendString(b, 1, family.name)
+			b = appendString(b, 2, family.description)
+			b = appendString(b, 3, family.unit)
+			return appendMessage(b, 7, func(b []byte) []byte {
+				for _, p := range points {
+					for proto, counters := range p.current {
+						value := family.value(counters)
+						start := p.series.start
+						if o.delta {
+							// after a reset, the delta is the new value
+							start = p.series.exported
+							if last := family.value(p.series.last[proto]); value >= last {
+								value -= last
+							}
+						}
+						b = appendMessage(b, 1, func(b []byte) []byte {
+							b = appendStringAttribute(b, 7, "ident", p.key.Ident)
+							b = appendStringAttribute(b, 7, "exporter", o.exporterLabel(p.key.ExporterID))
+							b = appendStringAttribute(b, 7, "proto", metrics.Proto(proto).String())
+							b = protowire.AppendTag(b, 2, protowire.Fixed64Type)
+							b = protowire.AppendFixed64(b, uint64(start.UnixNano()))
+							b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+							b = protowire.AppendFixed64(b, nowNano)
+							b = protowire.AppendTag(b, 6, protowire.Fixed64Type)
+							return protowire.AppendFixed64(b, value)
+						})
+					}
+				}
+				b = protowire.AppendTag(b, 2, protowire.VarintType)
+				b = protowire.AppendVarint(b, temporality)
+				b = protowire.AppendTag(b, 3, protowire.VarintType)
+				return protowire.AppendVarint(b, 1)
+			})
+		})
+	}
+
+	for _, p := range points {
+		p.series.last = p.current
+		p.series.exported = now
+	}
+
+	// ExportMetricsServiceRequest.resource_metrics
+	return appendMessage(nil, 1, func(b []byte) []byte {
+		b = append(b, o.resource...)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		return protowire.AppendBytes(b, scope)
+	})
+
+} // End of encode
+
+// decreased tells, if any counter of current is below last
+func decreased(last, current [metrics.NumProtos]metrics.Counters) bool {
+	for proto := range current {
+		if current[proto].Flows < last[proto].Flows ||
+			current[proto].Packets < last[proto].Packets ||
+			current[proto].Bytes < last[proto].Bytes {
+			return true
+		}
+	}
+	return false
+} // End of decreased
+
+// appendMessage appends the message built by fn as field num to b
+func appendMessage(b []byte, num protowire.Number, fn func([]byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, fn(nil))
+} // End of appendMessage
+
+// appendString appends s as field num to b
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+} // End of appendString
+
+// appendStringAttribute appends a KeyValue with a string value as field
+// num to b
+func appendStringAttribute(b []byte, num protowire.Number, key, value string) []byte {
+	return appendMessage(b, num, func(b []byte) []byte {
+		b = appendString(b, 1, key)
+		return appendMessage(b, 2, func(b []byte) []byte {
+			return appendString(b, 1, value)
+		})
+	})
+} // End of appendStringAttribute
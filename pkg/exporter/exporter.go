@@ -0,0 +1,758 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package exporter implements the Prometheus collector for the statistics
+// of a metrics.Store.
+package exporter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// Value modes select, how the nfcapd totals are exposed
+const (
+	// ValueModeCounter exposes the totals as counters
+	ValueModeCounter = "counter"
+	// ValueModeGauge exposes the difference to the previous message as gauges
+	ValueModeGauge = "gauge"
+	// ValueModeBoth exposes counters and gauges
+	ValueModeBoth = "both"
+)
+
+const namespace = metrics.Namespace
+
+// selfNamespace is the namespace of the metrics about the exporter itself
+const selfNamespace = "nfexporter"
+
+// reasonMetricCreation is the error reason for samples, which could not
+// be built, e.g. for an invalid label value
+const reasonMetricCreation = "metric_creation_error"
+
+var (
+
+	// Metrics
+	uptime = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "uptime"),
+		"nfsen uptime.",
+		[]string{"version"}, nil,
+	)
+	flowsReceived = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "flows"),
+		"How many flows have been received (per ident and protocol (tcp/udp/icmp/other)).",
+		[]string{"ident", "exporter", "proto"},
+	)
+	packetsReceived = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "packets"),
+		"How many packets have been received (per ident and protocol) (tcp/udp/icmp/other).",
+		[]string{"ident", "exporter", "proto"},
+	)
+	bytesReceived = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "bytes"),
+		"How many bytes have been received (per ident and protocol) (tcp/udp/icmp/other).",
+		[]string{"ident", "exporter", "proto"},
+	)
+
+	flowsLastInterval = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "flows_last_interval"),
+		"How many flows have been received in the last interval (per ident and protocol) (tcp/udp/icmp/other).",
+		[]string{"ident", "exporter", "proto"},
+	)
+	packetsLastInterval = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "packets_last_interval"),
+		"How many packets have been received in the last interval (per ident and protocol) (tcp/udp/icmp/other).",
+		[]string{"ident", "exporter", "proto"},
+	)
+	bytesLastInterval = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "bytes_last_interval"),
+		"How many bytes have been received in the last interval (per ident and protocol) (tcp/udp/icmp/other).",
+		[]string{"ident", "exporter", "proto"},
+	)
+
+	flowsEMA = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "flows_ema"),
+		"Exponential moving average of the flows per second between messages (per ident and protocol) (tcp/udp/icmp/other).",
+		[]string{"ident", "exporter", "proto"},
+	)
+
+	flowRateVariance = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "flow_rate_variance"),
+		"Variance of the flows per second between messages since start or SIGHUP (per ident and protocol) (tcp/udp/icmp/other).",
+		[]string{"ident", "exporter", "proto"},
+	)
+
+	flowRateStddev = newSeriesDesc(
+		prometheus.BuildFQName(namespace, "collector", "flow_rate_stddev"),
+		"Standard deviation of the flows per second between messages since start or SIGHUP (per ident and protocol) (tcp/udp/icmp/other).",
+		[]string{"ident", "exporter", "proto"},
+	)
+
+	evicted = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "evicted_total"),
+		"How many exporters have been evicted, because more than max-tracked-series were tracked.",
+		nil, nil,
+	)
+)
+
+// intervalBuckets are the classic buckets of the histograms of
+// Options.Histograms, a decade each up to 10^12
+var intervalBuckets = prometheus.ExponentialBuckets(1, 10, 13)
+
+// Options configure an Exporter
+type Options struct {
+	// TTL removes exporters, which did not report for this duration.
+	// 0 keeps them forever.
+	TTL time.Duration
+	// ValueMode is one of ValueModeCounter, ValueModeGauge or ValueModeBoth
+	ValueMode string
+	// CounterResets exposes the counter resets found by CheckCounterReset
+	CounterResets bool
+	// Timestamps sends the collector series with the time their message
+	// was received instead of the scrape time
+	Timestamps bool
+	// EMAAlpha is the weight of the latest rate in the flow rate average
+	// updated by UpdateFlowsEMA. 0 disables the average.
+	EMAAlpha float64
+	// OnlyChanged sends the series of an exporter only, if its counters
+	// changed since the previous Collect
+	OnlyChanged bool
+	// BytesPerFlowBuckets enables the bytes per flow histogram observed by
+	// ObserveBytesPerFlow with these buckets. nil disables it.
+	BytesPerFlowBuckets []float64
+	// ExporterIDAsIP sets the exporter label of IDs, which fit into 32
+	// bits, to the dotted IPv4 address of the ID, for collectors, which
+	// send the address of the exporter as its ID
+	ExporterIDAsIP bool
+	// Histograms replaces the flows, packets and bytes counters with
+	// histograms of the differences between the messages, observed by
+	// ObserveIntervals. Their sum is the total of the counter.
+	Histograms bool
+}
+
+// Exporter is a prometheus.Collector for the metrics of a store
+type Exporter struct {
+	store   *metrics.Store
+	options Options
+
+	expired        prometheus.Counter
+	scrapeTimeouts prometheus.Counter
+	errors         *prometheus.CounterVec
+	duplicates     prometheus.Counter
+	bytesTotal     prometheus.Counter
+	counterResets  *prometheus.CounterVec
+	bytesPerFlow   *prometheus.HistogramVec
+
+	// the histograms of Options.Histograms
+	flowsHistogram   *prometheus.HistogramVec
+	packetsHistogram *prometheus.HistogramVec
+	bytesHistogram   *prometheus.HistogramVec
+
+	// label pairs per exporter, removed by Forget
+	labelMutex sync.Mutex
+	labelCache map[metrics.Key]*seriesLabels
+
+	// flow rate averages per exporter, removed by Forget
+	emaMutex sync.Mutex
+	emas     map[metrics.Key]*[metrics.NumProtos]float64
+
+	// flow rate variances per exporter, removed by Forget
+	rateMutex sync.Mutex
+	rateStats map[metrics.Key]*[metrics.NumProtos]runningStats
+}
+
+// New returns an exporter for store
+func New(store *metrics.Store, options Options) *Exporter {
+	e := &Exporter{
+		store:      store,
+		options:    options,
+		labelCache: make(map[metrics.Key]*seriesLabels),
+		emas:       make(map[metrics.Key]*[metrics.NumProtos]float64),
+		rateStats:  make(map[metrics.Key]*[metrics.NumProtos]runningStats),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "expired_total",
+			Help:      "How many exporters have been removed after not reporting for metric-ttl.",
+		}),
+		scrapeTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_timeout_total",
+			Help:      "How many scrapes have been aborted, because they exceeded the scrape timeout.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "collector",
+			Name:      "errors_total",
+			Help:      "How many samples have been skipped in scrapes (per reason).",
+		}, []string{"reason"}),
+		duplicates: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: selfNamespace,
+			Name:      "duplicate_series_dropped_total",
+			Help:      "How many series have been dropped, because the same series was already sent in the scrape.",
+		}),
+		bytesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "collector",
+			Name:      "bytes_grand_total",
+			Help:      "How many bytes have been received by all idents, exporters and protocols since the exporter started.",
+		}),
+		counterResets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "collector",
+			Name:      "counter_resets_total",
+			Help:      "How often the counters of an exporter decreased (per ident and protocol) (tcp/udp/icmp/other).",
+		}, []string{"ident", "exporter", "proto"}),
+	}
+	if options.BytesPerFlowBuckets != nil {
+		e.bytesPerFlow = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "collector",
+			Name:      "bytes_per_flow_histogram",
+			Help:      "Average bytes per flow of each message interval (per ident and protocol) (tcp/udp/icmp/other).",
+			Buckets:   options.BytesPerFlowBuckets,
+		}, []string{"ident", "proto"})
+	}
+	if options.Histograms {
+		e.flowsHistogram = newIntervalHistogram("flows",
+			"How many flows have been received between two messages (per ident and protocol) (tcp/udp/icmp/other).")
+		e.packetsHistogram = newIntervalHistogram("packets",
+			"How many packets have been received between two messages (per ident and protocol) (tcp/udp/icmp/other).")
+		e.bytesHistogram = newIntervalHistogram("bytes",
+			"How many bytes have been received between two messages (per ident and protocol) (tcp/udp/icmp/other).")
+	}
+	// expose the error reasons before the first error
+	e.errors.WithLabelValues(reasonMetricCreation)
+	return e
+} // End of New
+
+// newIntervalHistogram returns a histogram of Options.Histograms, which
+// replaces the counter of the same name. It has the classic buckets for
+// Prometheus without native histograms and native buckets, whose
+// resolution is reduced instead of resetting the histogram.
+func newIntervalHistogram(name, help string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                      namespace,
+		Subsystem:                      "collector",
+		Name:                           name,
+		Help:                           help,
+		Buckets:                        intervalBuckets,
+		NativeHistogramBucketFactor:    1.1,
+		NativeHistogramMaxBucketNumber: 160,
+	}, []string{"ident", "exporter", "proto"})
+} // End of newIntervalHistogram
+
+// Describe implements prometheus.Collector
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- uptime
+	if e.options.Histograms {
+		e.flowsHistogram.Describe(ch)
+		e.packetsHistogram.Describe(ch)
+		e.bytesHistogram.Describe(ch)
+	} else {
+		ch <- flowsReceived
+		ch <- packetsReceived
+		ch <- bytesReceived
+	}
+	ch <- flowsLastInterval
+	ch <- packetsLastInterval
+	ch <- bytesLastInterval
+	if e.options.EMAAlpha > 0 {
+		ch <- flowsEMA
+	}
+	ch <- flowRateVariance
+	ch <- flowRateStddev
+	ch <- evicted
+	e.expired.Describe(ch)
+	e.scrapeTimeouts.Describe(ch)
+	e.errors.Describe(ch)
+	e.duplicates.Describe(ch)
+	e.bytesTotal.Describe(ch)
+	if e.options.CounterResets {
+		e.counterResets.Describe(ch)
+	}
+	if e.bytesPerFlow != nil {
+		e.bytesPerFlow.Describe(ch)
+	}
+} // End of Describe
+
+// Collect implements prometheus.Collector
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.CollectWithContext(context.Background(), ch)
+} // End of Collect
+
+// CollectWithContext works like Collect, but gives up waiting for the
+// store or for ch, if ctx is done before. It returns the error of ctx
+// then. An exceeded deadline of ctx is counted as scrape timeout.
+func (e *Exporter) CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric) error {
+	return e.collect(ctx, ch, e.options.OnlyChanged)
+} // End of CollectWithContext
+
+// collect sends the metrics of the store to ch, only the changed ones
+// with onlyChanged
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric, onlyChanged bool) (err error) {
+
+	defer func() {
+		if errors.Is(err, context.DeadlineExceeded) {
+			e.scrapeTimeouts.Inc()
+		}
+	}()
+
+	if e.options.TTL > 0 {
+		expired, err := e.store.Expire(ctx, time.Now(), e.options.TTL)
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			e.Forget(key)
+		}
+		e.expired.Add(float64(len(expired)))
+	}
+	e.expired.Collect(ch)
+	e.scrapeTimeouts.Collect(ch)
+	e.sendConstMetric(ch, evicted, prometheus.CounterValue, float64(e.store.Evicted()))
+	if e.options.CounterResets {
+		e.counterResets.Collect(ch)
+	}
+	if e.bytesPerFlow != nil {
+		e.bytesPerFlow.Collect(ch)
+	}
+	if e.options.Histograms {
+		e.flowsHistogram.Collect(ch)
+		e.packetsHistogram.Collect(ch)
+		e.bytesHistogram.Collect(ch)
+	}
+
+	// build the metrics from a copy, so the message processing is not
+	// blocked by a slow scrape
+	takeSnapshot := e.store.Snapshot
+	if onlyChanged {
+		takeSnapshot = e.store.SnapshotChanged
+	}
+	snapshot, err := takeSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	// all samples of the scrape in one allocation, for the families sent
+	// per exporter and proto
+	families := 2 // flow rate variance and standard deviation
+	if e.options.ValueMode != ValueModeCounter {
+		families += 3 // last interval gauges
+	}
+	if e.options.ValueMode != ValueModeGauge && !e.options.Histograms {
+		families += 3 // counters, replaced by the histograms
+	}
+	if e.options.EMAAlpha > 0 {
+		families++
+	}
+	size := len(snapshot) * families * int(metrics.NumProtos)
+	s := &scrape{
+		exporter: e,
+		ctx:      ctx,
+		ch:       ch,
+		samples:  make([]sample, size),
+		seen:     make(map[seriesKey]struct{}, size),
+	}
+
+	for _, entry := range snapshot {
+		if s.err != nil {
+			return s.err
+		}
+		metric := entry.Metric
+		labels := e.labels(metrics.Key{Ident: entry.Ident, ExporterID: metric.ExporterID})
+		if labels.err != nil {
+			e.errors.WithLabelValues(reasonMetricCreation).Inc()
+			log.Printf("Skip exporter %d of ident %q: %v\n", metric.ExporterID, entry.Ident, labels.err)
+			continue
+		}
+		if e.options.Timestamps {
+			s.timestampMs = metric.LastUpdate.UnixMilli()
+		}
+		if e.options.ValueMode != ValueModeCounter && metric.Previous != nil {
+			s.collectLastInterval(labels, metric)
+		}
+		key := metrics.Key{Ident: entry.Ident, ExporterID: metric.ExporterID}
+		if ema, ok := e.flowsEMA(key); ok {
+			for proto, rate := range ema {
+				s.send(flowsEMA, true, rate, labels.protos[proto])
+			}
+		}
+		if variance, stddev, ok := e.flowRateVariance(key); ok {
+			for proto := range variance {
+				s.send(flowRateVariance, true, variance[proto], labels.protos[proto])
+				s.send(flowRateStddev, true, stddev[proto], labels.protos[proto])
+			}
+		}
+		if e.options.ValueMode == ValueModeGauge || e.options.Histograms {
+			continue
+		}
+		for proto, counters := range metric.Protos {
+			s.send(flowsReceived, false, float64(counters.Flows), labels.protos[proto])
+			s.send(packetsReceived, false, float64(counters.Packets), labels.protos[proto])
+			s.send(bytesReceived, false, float64(counters.Bytes), labels.protos[proto])
+		}
+	}
+
+	if s.err != nil {
+		return s.err
+	}
+
+	// last, to include the errors of this scrape
+	e.errors.Collect(ch)
+	e.duplicates.Collect(ch)
+	e.bytesTotal.Collect(ch)
+	return nil
+
+} // End of collect
+
+// sendConstMetric sends a const metric to ch. A metric, which cannot be
+// built, e.g. for a wrong number of label values, is skipped, logged and
+// counted as error.
+func (e *Exporter) sendConstMetric(ch chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues ...string) {
+
+	metric, err := prometheus.NewConstMetric(desc, valueType, value, labelValues...)
+	if err != nil {
+		e.errors.WithLabelValues(reasonMetricCreation).Inc()
+		log.Printf("Skip %s: %v\n", desc, err)
+		return
+	}
+	ch <- metric
+
+} // End of sendConstMetric
+
+// collectLastInterval sends the difference to the previous message of the
+// exporter as gauges. Decreased counters after a reset are omitted.
+func (s *scrape) collectLastInterval(labels *seriesLabels, metric metrics.Metric) {
+
+	for proto, cur := range metric.Protos {
+		prev := metric.Previous.Protos[proto]
+		if cur.Flows >= prev.Flows {
+			s.send(flowsLastInterval, true, float64(cur.Flows-prev.Flows), labels.protos[proto])
+		}
+		if cur.Packets >= prev.Packets {
+			s.send(packetsLastInterval, true, float64(cur.Packets-prev.Packets), labels.protos[proto])
+		}
+		if cur.Bytes >= prev.Bytes {
+			s.send(bytesLastInterval, true, float64(cur.Bytes-prev.Bytes), labels.protos[proto])
+		}
+	}
+
+} // End of collectLastInterval
+
+// scrape holds the state of one collect pass
+type scrape struct {
+	exporter *Exporter
+	ctx      context.Context
+	ch       chan<- prometheus.Metric
+	// err is the error of ctx, after it was done during a send
+	err error
+	// preallocated samples, the next free one is samples[next]
+	samples []sample
+	next    int
+	// timestamp of the samples of the current exporter, 0 for none
+	timestampMs int64
+	// series sent so far, to drop duplicates, which fail the scrape
+	seen       map[seriesKey]struct{}
+	duplicates int
+}
+
+// seriesKey identifies a series by its descriptor and label values
+type seriesKey struct {
+	desc     *prometheus.Desc
+	ident    string
+	exporter string
+	proto    string
+}
+
+// send sends a sample to the scrape. A sample with a wrong number of
+// labels is skipped and counted as error. A series sent before in the
+// scrape is dropped and counted, the first duplicate of a scrape is
+// logged. If
+// ctx is done before the sample is taken, err is set and further samples
+// are not sent.
+func (s *scrape) send(desc *prometheus.Desc, isGauge bool, value float64, labels []*dto.LabelPair) {
+
+	if s.err != nil {
+		return
+	}
+
+	// like prometheus.NewConstMetric, reject a wrong number of labels
+	if len(labels) != len(seriesLabelNames[desc]) {
+		s.exporter.errors.WithLabelValues(reasonMetricCreation).Inc()
+		log.Printf("Skip %s: %d label values for %d variable labels\n", desc, len(labels), len(seriesLabelNames[desc]))
+		return
+	}
+
+	// the label pairs are sorted by name: exporter, ident, proto
+	key := seriesKey{
+		desc:     desc,
+		ident:    labels[1].GetValue(),
+		exporter: labels[0].GetValue(),
+		proto:    labels[2].GetValue(),
+	}
+	if _, ok := s.seen[key]; ok {
+		s.exporter.duplicates.Inc()
+		if s.duplicates == 0 {
+			log.Printf("Drop duplicate series %s %v\n", desc, labels)
+		}
+		s.duplicates++
+		return
+	}
+	s.seen[key] = struct{}{}
+
+	sample := &s.samples[s.next]
+	s.next++
+	sample.desc = desc
+	sample.labels = labels
+	sample.value = value
+	sample.isGauge = isGauge
+	sample.timestampMs = s.timestampMs
+	select {
+	case s.ch <- sample:
+	case <-s.ctx.Done():
+		s.err = s.ctx.Err()
+	}
+
+} // End of send
+
+// CheckCounterReset counts and logs each protocol, for which a counter
+// of the exporter decreased since the previous message. It is a
+// metrics.UpdateFunc.
+func (e *Exporter) CheckCounterReset(ident string, prev, cur metrics.Metric) {
+
+	exporterStr := e.ExporterLabel(cur.ExporterID)
+	for proto, after := range cur.Protos {
+		before := prev.Protos[proto]
+		if after.Flows < before.Flows || after.Packets < before.Packets || after.Bytes < before.Bytes {
+			protoStr := metrics.Proto(proto).String()
+			log.Printf("Counter reset ident: %s, exporter: %s, proto: %s - flows %d -> %d\n",
+				ident, exporterStr, protoStr, before.Flows, after.Flows)
+			e.counterResets.WithLabelValues(ident, exporterStr, protoStr).Inc()
+		}
+	}
+
+} // End of CheckCounterReset
+
+// CountBytes adds the bytes of all protocols received since the previous
+// message to the grand total. After a counter reset, the counter itself
+// is added. It is a metrics.UpdateFunc.
+func (e *Exporter) CountBytes(ident string, prev, cur metrics.Metric) {
+
+	var bytes uint64
+	for proto, after := range cur.Protos {
+		before := prev.Protos[proto].Bytes
+		if after.Bytes < before {
+			bytes += after.Bytes
+		} else {
+			bytes += after.Bytes - before
+		}
+	}
+	e.bytesTotal.Add(float64(bytes))
+
+} // End of CountBytes
+
+// UpdateFlowsEMA updates the moving average of the flow rate of each
+// protocol with the rate since the previous message. Decreased counters
+// are skipped. It is a metrics.UpdateFunc.
+func (e *Exporter) UpdateFlowsEMA(ident string, prev, cur metrics.Metric) {
+
+	rates, valid, ok := flowRates(prev, cur)
+	if !ok {
+		return
+	}
+	alpha := e.options.EMAAlpha
+	key := metrics.Key{Ident: ident, ExporterID: cur.ExporterID}
+
+	e.emaMutex.Lock()
+	defer e.emaMutex.Unlock()
+
+	ema, found := e.emas[key]
+	if !found {
+		ema = &[metrics.NumProtos]float64{}
+		e.emas[key] = ema
+	}
+	for proto, rate := range rates {
+		if !valid[proto] {
+			continue
+		}
+		if !found {
+			// the first rate starts the average
+			ema[proto] = rate
+			continue
+		}
+		ema[proto] = alpha*rate + (1-alpha)*ema[proto]
+	}
+
+} // End of UpdateFlowsEMA
+
+// flowsEMA returns the flow rate averages of an exporter, if it has any
+func (e *Exporter) flowsEMA(key metrics.Key) ([metrics.NumProtos]float64, bool) {
+
+	e.emaMutex.Lock()
+	defer e.emaMutex.Unlock()
+
+	ema, ok := e.emas[key]
+	if !ok {
+		return [metrics.NumProtos]float64{}, false
+	}
+	return *ema, true
+
+} // End of flowsEMA
+
+// ObserveBytesPerFlow observes the average bytes per flow of each
+// protocol in the interval since the previous message. nfcapd reports
+// totals only, so the size of single flows is unknown. Intervals without
+// flows and decreased counters are skipped. It is a metrics.UpdateFunc.
+func (e *Exporter) ObserveBytesPerFlow(ident string, prev, cur metrics.Metric) {
+
+	for proto, after := range cur.Protos {
+		before := prev.Protos[proto]
+		if after.Flows <= before.Flows || after.Bytes < before.Bytes {
+			continue
+		}
+		observer, err := e.bytesPerFlow.GetMetricWithLabelValues(ident, metrics.Proto(proto).String())
+		if err != nil {
+			continue
+		}
+		observer.Observe(float64(after.Bytes-before.Bytes) / float64(after.Flows-before.Flows))
+	}
+
+} // End of ObserveBytesPerFlow
+
+// ObserveIntervals observes the flows, packets and bytes of each protocol
+// received since the previous message in the histograms of
+// Options.Histograms. Decreased counters after a reset are skipped. It is
+// a metrics.UpdateFunc.
+func (e *Exporter) ObserveIntervals(ident string, prev, cur metrics.Metric) {
+
+	exporterStr := e.ExporterLabel(cur.ExporterID)
+	for proto, after := range cur.Protos {
+		before := prev.Protos[proto]
+		protoStr := metrics.Proto(proto).String()
+		observe(e.flowsHistogram, ident, exporterStr, protoStr, before.Flows, after.Flows)
+		observe(e.packetsHistogram, ident, exporterStr, protoStr, before.Packets, after.Packets)
+		observe(e.bytesHistogram, ident, exporterStr, protoStr, before.Bytes, after.Bytes)
+	}
+
+} // End of ObserveIntervals
+
+// observe observes the difference of a counter, unless it decreased
+func observe(histogram *prometheus.HistogramVec, ident, exporter, proto string, before, after uint64) {
+
+	if after < before {
+		return
+	}
+	observer, err := histogram.GetMetricWithLabelValues(ident, exporter, proto)
+	if err != nil {
+		return
+	}
+	observer.Observe(float64(after - before))
+
+} // End of observe
+
+// Forget removes the series of an exporter, which kept state beyond the
+// store, such as the counter resets. Call it for exporters removed from
+// the store, e.g. by metrics.Options.OnEvict.
+func (e *Exporter) Forget(key metrics.Key) {
+	e.labelMutex.Lock()
+	delete(e.labelCache, key)
+	e.labelMutex.Unlock()
+	e.emaMutex.Lock()
+	delete(e.emas, key)
+	e.emaMutex.Unlock()
+	e.rateMutex.Lock()
+	delete(e.rateStats, key)
+	e.rateMutex.Unlock()
+	labels := prometheus.Labels{"ident": key.Ident, "exporter": e.ExporterLabel(key.ExporterID)}
+	e.counterResets.DeletePartialMatch(labels)
+	if e.options.Histograms {
+		e.flowsHistogram.DeletePartialMatch(labels)
+		e.packetsHistogram.DeletePartialMatch(labels)
+		e.bytesHistogram.DeletePartialMatch(labels)
+	}
+} // End of Forget
+
+// ExporterLabel returns the value of the exporter label of id: the
+// decimal ID, or with Options.ExporterIDAsIP the IPv4 address of an ID,
+// which fits into 32 bits
+func (e *Exporter) ExporterLabel(id uint64) string {
+
+	if !e.options.ExporterIDAsIP || id > math.MaxUint32 {
+		return strconv.FormatUint(id, 10)
+	}
+	return net.IP([]byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}).String()
+
+} // End of ExporterLabel
+
+// WithContext returns a collector, which collects the exporter with ctx.
+// If ctx is done before the store is available, the scrape fails.
+func (e *Exporter) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{exporter: e, ctx: ctx, onlyChanged: e.options.OnlyChanged}
+} // End of WithContext
+
+// AllWithContext works like WithContext, but the collector sends all
+// metrics with Options.OnlyChanged as well and leaves the changes to the
+// next scrape, e.g. for checks of the exposed families
+func (e *Exporter) AllWithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{exporter: e, ctx: ctx}
+} // End of AllWithContext
+
+// contextCollector binds the exporter to the context of one scrape request
+type contextCollector struct {
+	exporter    *Exporter
+	ctx         context.Context
+	onlyChanged bool
+}
+
+func (c *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+} // End of Describe
+
+func (c *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	if err := c.exporter.collect(c.ctx, ch, c.onlyChanged); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("WARNING: scrape timed out: %v\n", err)
+		} else {
+			log.Printf("Scrape aborted: %v\n", err)
+		}
+		ch <- prometheus.NewInvalidMetric(flowsReceived, err)
+	}
+} // End of Collect
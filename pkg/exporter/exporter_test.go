@@ -0,0 +1,434 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package exporter_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/protocol"
+)
+
+// newTestExporter returns an exporter with options for a store, which
+// holds up to maxEntries exporters
+func newTestExporter(maxEntries int, options exporter.Options) (*exporter.Exporter, *metrics.Store) {
+	var exp *exporter.Exporter
+	store := metrics.NewStore(metrics.Options{
+		MaxEntries: maxEntries,
+		OnEvict:    func(key metrics.Key) { exp.Forget(key) },
+	})
+	if options.ValueMode == "" {
+		options.ValueMode = exporter.ValueModeCounter
+	}
+	exp = exporter.New(store, options)
+	return exp, store
+} // End of newTestExporter
+
+// testMetric returns a metric of exporter with flows in all protos
+func testMetric(exporterID, flows uint64, lastUpdate time.Time) metrics.Metric {
+	metric := metrics.Metric{ExporterID: exporterID, LastUpdate: lastUpdate}
+	for proto := range metric.Protos {
+		metric.Protos[proto] = metrics.Counters{Flows: flows}
+	}
+	return metric
+} // End of testMetric
+
+func TestEvictedAndExpiredTotal(t *testing.T) {
+
+	exp, store := newTestExporter(2, exporter.Options{TTL: time.Minute})
+	now := time.Now()
+	for exporterID := uint64(1); exporterID <= 3; exporterID++ {
+		store.Update("a", []metrics.Metric{testMetric(exporterID, 1, now)}, nil)
+	}
+	// exporter 1 is evicted, exporter 2 reports last an hour ago
+	store.Update("a", []metrics.Metric{testMetric(2, 2, now.Add(-time.Hour))}, nil)
+
+	want := `
+# HELP nfsen_exporter_evicted_total How many exporters have been evicted, because more than max-tracked-series were tracked.
+# TYPE nfsen_exporter_evicted_total counter
+nfsen_exporter_evicted_total 1
+# HELP nfsen_exporter_expired_total How many exporters have been removed after not reporting for metric-ttl.
+# TYPE nfsen_exporter_expired_total counter
+nfsen_exporter_expired_total 1
+`
+	for scrape := 1; scrape <= 2; scrape++ {
+		if err := testutil.CollectAndCompare(exp, strings.NewReader(want),
+			"nfsen_exporter_evicted_total", "nfsen_exporter_expired_total"); err != nil {
+			t.Errorf("scrape %d: %v", scrape, err)
+		}
+	}
+	if count := testutil.CollectAndCount(exp, "nfsen_collector_flows"); count != int(metrics.NumProtos) {
+		t.Errorf("got %d flows series, want %d of exporter 3", count, metrics.NumProtos)
+	}
+
+} // End of TestEvictedAndExpiredTotal
+
+// TestCollectWithContext collects, while an eviction holds the store. A
+// canceled scrape returns the error of its context, a scrape beyond its
+// deadline is counted as scrape timeout as well.
+func TestCollectWithContext(t *testing.T) {
+
+	evicting := make(chan struct{})
+	release := make(chan struct{})
+	store := metrics.NewStore(metrics.Options{
+		MaxEntries: 1,
+		OnEvict: func(key metrics.Key) {
+			close(evicting)
+			<-release
+		},
+	})
+	exp := exporter.New(store, exporter.Options{ValueMode: exporter.ValueModeCounter})
+	now := time.Now()
+	store.Update("a", []metrics.Metric{testMetric(1, 1, now)}, nil)
+	updated := make(chan struct{})
+	go func() {
+		store.Update("a", []metrics.Metric{testMetric(2, 1, now)}, nil)
+		close(updated)
+	}()
+	<-evicting
+
+	ch := make(chan prometheus.Metric, 100)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := exp.CollectWithContext(canceled, ch); err != context.Canceled {
+		t.Errorf("canceled scrape: got error %v, want %v", err, context.Canceled)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := exp.CollectWithContext(timeout, ch); err != context.DeadlineExceeded {
+		t.Errorf("timed out scrape: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	<-updated
+
+	want := `
+# HELP nfsen_scrape_timeout_total How many scrapes have been aborted, because they exceeded the scrape timeout.
+# TYPE nfsen_scrape_timeout_total counter
+nfsen_scrape_timeout_total 1
+`
+	if err := testutil.CollectAndCompare(exp, strings.NewReader(want), "nfsen_scrape_timeout_total"); err != nil {
+		t.Error(err)
+	}
+	if count := testutil.CollectAndCount(exp, "nfsen_collector_flows"); count != int(metrics.NumProtos) {
+		t.Errorf("got %d flows series after the eviction, want %d of exporter 2", count, metrics.NumProtos)
+	}
+
+} // End of TestCollectWithContext
+
+func TestDescribeMatchesCollect(t *testing.T) {
+
+	optionSets := []exporter.Options{
+		{ValueMode: exporter.ValueModeCounter},
+		{ValueMode: exporter.ValueModeGauge, Timestamps: true},
+		{ValueMode: exporter.ValueModeBoth, EMAAlpha: 0.5, CounterResets: true, ExporterIDAsIP: true},
+		{ValueMode: exporter.ValueModeBoth, Histograms: true, BytesPerFlowBuckets: []float64{100, 1000}},
+		{ValueMode: exporter.ValueModeGauge, Histograms: true, EMAAlpha: 0.5},
+		{ValueMode: exporter.ValueModeCounter, OnlyChanged: true, TTL: time.Hour},
+	}
+	for _, options := range optionSets {
+		t.Run(fmt.Sprintf("%+v", options), func(t *testing.T) {
+			exp, store := newTestExporter(0, options)
+			// the update functions as wired by main
+			update := func(ident string, previous, current metrics.Metric) {
+				exp.CheckCounterReset(ident, previous, current)
+				exp.CountBytes(ident, previous, current)
+				if options.EMAAlpha > 0 {
+					exp.UpdateFlowsEMA(ident, previous, current)
+				}
+				exp.UpdateFlowRateStats(ident, previous, current)
+				if options.BytesPerFlowBuckets != nil {
+					exp.ObserveBytesPerFlow(ident, previous, current)
+				}
+				if options.Histograms {
+					exp.ObserveIntervals(ident, previous, current)
+				}
+			}
+			now := time.Now()
+			for round := uint64(1); round <= 3; round++ {
+				store.Update("a", []metrics.Metric{testMetric(1, 10*round, now), testMetric(0x0a000001, 20*round, now)}, update)
+				now = now.Add(time.Minute)
+			}
+
+			// the pedantic registry fails for undescribed or inconsistent series
+			registry := prometheus.NewPedanticRegistry()
+			if err := registry.Register(exp); err != nil {
+				t.Fatal(err)
+			}
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(families) == 0 {
+				t.Errorf("no families gathered")
+			}
+		})
+	}
+
+} // End of TestDescribeMatchesCollect
+
+// TestGaugeHistograms collects the interval gauges together with the
+// histograms, which replace the counters. The samples of the scrape must
+// cover the gauges of every exporter.
+func TestGaugeHistograms(t *testing.T) {
+
+	exp, store := newTestExporter(0, exporter.Options{ValueMode: exporter.ValueModeGauge, Histograms: true})
+	now := time.Now()
+	for round := uint64(1); round <= 2; round++ {
+		store.Update("a", []metrics.Metric{testMetric(1, 10*round, now), testMetric(2, 20*round, now)}, exp.ObserveIntervals)
+		now = now.Add(time.Minute)
+	}
+
+	for _, family := range []string{"flows", "packets", "bytes"} {
+		name := "nfsen_collector_" + family + "_last_interval"
+		if count := testutil.CollectAndCount(exp, name); count != 2*int(metrics.NumProtos) {
+			t.Errorf("got %d %s series, want %d", count, name, 2*metrics.NumProtos)
+		}
+	}
+	if count := testutil.CollectAndCount(exp, "nfsen_collector_flows"); count != 2*int(metrics.NumProtos) {
+		t.Errorf("got %d flows histograms, want %d", count, 2*metrics.NumProtos)
+	}
+
+} // End of TestGaugeHistograms
+
+// TestTwelveSeries feeds one record with twelve distinct counters through
+// the parser and the store. Each family and proto must carry its own
+// value, e.g. the icmp bytes must not be the icmp packets.
+func TestTwelveSeries(t *testing.T) {
+
+	record := metrics.Metric{ExporterID: 7}
+	for proto := range record.Protos {
+		p := uint64(proto)
+		record.Protos[proto] = metrics.Counters{Flows: 101 + p, Packets: 201 + p, Bytes: 301 + p}
+	}
+	update, err := protocol.ParseMetricMessage(protocol.EncodeMessage("live", 1, 60, []metrics.Metric{record}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, store := newTestExporter(0, exporter.Options{})
+	store.Update(update.Ident, update.Metrics, nil)
+
+	var want strings.Builder
+	for _, family := range []string{"bytes", "flows", "packets"} {
+		name := "nfsen_collector_" + family
+		fmt.Fprintf(&want, "# HELP %s How many %s have been received (per ident and protocol", name, family)
+		if family == "flows" {
+			want.WriteString(" (tcp/udp/icmp/other)).\n")
+		} else {
+			want.WriteString(") (tcp/udp/icmp/other).\n")
+		}
+		fmt.Fprintf(&want, "# TYPE %s counter\n", name)
+		base := map[string]int{"flows": 101, "packets": 201, "bytes": 301}[family]
+		// sorted by proto label
+		for _, proto := range []metrics.Proto{metrics.ProtoICMP, metrics.ProtoOther, metrics.ProtoTCP, metrics.ProtoUDP} {
+			fmt.Fprintf(&want, "%s{exporter=\"7\",ident=\"live\",proto=%q} %d\n", name, proto, base+int(proto))
+		}
+	}
+	if err := testutil.CollectAndCompare(exp, strings.NewReader(want.String()),
+		"nfsen_collector_flows", "nfsen_collector_packets", "nfsen_collector_bytes"); err != nil {
+		t.Error(err)
+	}
+
+} // End of TestTwelveSeries
+
+// TestBadIdent scrapes an ident, which is no valid label value. The
+// scrape must succeed without the series of the ident and count the
+// skipped exporter.
+func TestBadIdent(t *testing.T) {
+
+	exp, store := newTestExporter(0, exporter.Options{})
+	now := time.Now()
+	store.Update("live", []metrics.Metric{testMetric(1, 5, now)}, nil)
+	store.Update("bad\xff", []metrics.Metric{testMetric(2, 5, now)}, nil)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exp)
+	recorder := httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scrape = %d %s, want 200", recorder.Code, recorder.Body)
+	}
+
+	body := recorder.Body.String()
+	series := 0
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "nfsen_collector_flows{") {
+			series++
+			if !strings.Contains(line, `ident="live"`) {
+				t.Errorf("unexpected series %s", line)
+			}
+		}
+	}
+	if series != int(metrics.NumProtos) {
+		t.Errorf("got %d flows series, want %d of ident live", series, metrics.NumProtos)
+	}
+	if want := `nfsen_collector_errors_total{reason="metric_creation_error"} 1`; !strings.Contains(body, want) {
+		t.Errorf("scrape lacks %s", want)
+	}
+
+} // End of TestBadIdent
+
+// BenchmarkCollect scrapes a store of 100 to 2000 exporters with two
+// messages each, in counter mode and with the interval gauges. Each
+// sample is written like the registry does.
+func BenchmarkCollect(b *testing.B) {
+
+	for _, mode := range []string{exporter.ValueModeCounter, exporter.ValueModeBoth} {
+		for _, size := range []int{100, 500, 2000} {
+			b.Run(fmt.Sprintf("mode=%s/exporters=%d", mode, size), func(b *testing.B) {
+				exp, store := newTestExporter(0, exporter.Options{ValueMode: mode})
+				now := time.Now()
+				for i := 0; i < size; i++ {
+					ident := fmt.Sprintf("ident%d", i%10)
+					store.Update(ident, []metrics.Metric{testMetric(uint64(i), 1, now)}, nil)
+					store.Update(ident, []metrics.Metric{testMetric(uint64(i), 2, now.Add(time.Minute))}, nil)
+				}
+
+				ch := make(chan prometheus.Metric, 64)
+				done := make(chan struct{})
+				go func() {
+					var out dto.Metric
+					for metric := range ch {
+						metric.Write(&out)
+						out.Reset()
+					}
+					close(done)
+				}()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					exp.Collect(ch)
+				}
+				b.StopTimer()
+				close(ch)
+				<-done
+			})
+		}
+	}
+
+} // End of BenchmarkCollect
+
+// BenchmarkUpdateDuringScrape updates the counters of 500 exporters
+// with the update functions of main, once without scrapes and once while
+// a slow client scrapes all the time, which takes 20µs per sample. It
+// reports the latency of the messages: ns/op is the mean, p99-ns and
+// max-ns are the slowest ones.
+func BenchmarkUpdateDuringScrape(b *testing.B) {
+
+	const exporters = 500
+
+	for _, slow := range []bool{false, true} {
+		b.Run(fmt.Sprintf("slow-scrape=%v", slow), func(b *testing.B) {
+			exp, store := newTestExporter(0, exporter.Options{ValueMode: exporter.ValueModeBoth, TTL: time.Hour})
+			update := func(ident string, previous, current metrics.Metric) {
+				exp.CountBytes(ident, previous, current)
+				exp.UpdateFlowRateStats(ident, previous, current)
+			}
+			now := time.Now()
+			idents := make([]string, exporters)
+			for i := range idents {
+				idents[i] = fmt.Sprintf("ident%d", i%10)
+				store.Update(idents[i], []metrics.Metric{testMetric(uint64(i), 1, now)}, update)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			scraped := make(chan struct{})
+			go func() {
+				defer close(scraped)
+				for slow && ctx.Err() == nil {
+					ch := make(chan prometheus.Metric)
+					go func() {
+						for range ch {
+							time.Sleep(20 * time.Microsecond)
+						}
+					}()
+					exp.CollectWithContext(ctx, ch)
+					close(ch)
+				}
+			}()
+
+			message := make([]metrics.Metric, 1)
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				id := n % exporters
+				message[0] = testMetric(uint64(id), uint64(n+2), now)
+				start := time.Now()
+				store.Update(idents[id], message, update)
+				latencies[n] = time.Since(start)
+			}
+			b.StopTimer()
+			cancel()
+			<-scraped
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+			b.ReportMetric(float64(latencies[len(latencies)-1]), "max-ns")
+		})
+	}
+
+} // End of BenchmarkUpdateDuringScrape
+
+// TestAllWithContext collects with Options.OnlyChanged. The collector of
+// AllWithContext sends the unchanged series as well and leaves the
+// changes to the next scrape.
+func TestAllWithContext(t *testing.T) {
+
+	exp, store := newTestExporter(0, exporter.Options{OnlyChanged: true})
+	now := time.Now()
+	store.Update("a", []metrics.Metric{testMetric(1, 1, now), testMetric(2, 1, now)}, nil)
+
+	all := exp.AllWithContext(context.Background())
+	for check := 1; check <= 2; check++ {
+		if count := testutil.CollectAndCount(all, "nfsen_collector_flows"); count != 2*int(metrics.NumProtos) {
+			t.Errorf("check %d: got %d flows series, want all %d", check, count, 2*metrics.NumProtos)
+		}
+	}
+	if count := testutil.CollectAndCount(exp, "nfsen_collector_flows"); count != 2*int(metrics.NumProtos) {
+		t.Errorf("scrape after the checks: got %d flows series, want the %d changed", count, 2*metrics.NumProtos)
+	}
+	if count := testutil.CollectAndCount(exp, "nfsen_collector_flows"); count != 0 {
+		t.Errorf("second scrape: got %d flows series, want none unchanged", count)
+	}
+
+} // End of TestAllWithContext
@@ -0,0 +1,141 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package exporter
+
+import (
+	"math"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// runningStats is the Welford online mean and variance of a series
+type runningStats struct {
+	count uint64
+	mean  float64
+	m2    float64
+}
+
+// add adds a value to the statistics
+func (r *runningStats) add(value float64) {
+	r.count++
+	delta := value - r.mean
+	r.mean += delta / float64(r.count)
+	r.m2 += delta * (value - r.mean)
+} // End of add
+
+// variance returns the sample variance, 0 below two values
+func (r *runningStats) variance() float64 {
+	if r.count < 2 {
+		return 0
+	}
+	return r.m2 / float64(r.count-1)
+} // End of variance
+
+// flowRates returns the flows per second of each protocol between prev
+// and cur. valid is false for decreased counters. ok is false, if no
+// time passed between the messages.
+func flowRates(prev, cur metrics.Metric) (rates [metrics.NumProtos]float64, valid [metrics.NumProtos]bool, ok bool) {
+
+	seconds := cur.LastUpdate.Sub(prev.LastUpdate).Seconds()
+	if seconds <= 0 {
+		return rates, valid, false
+	}
+	for proto, after := range cur.Protos {
+		before := prev.Protos[proto]
+		if after.Flows < before.Flows {
+			continue
+		}
+		rates[proto] = float64(after.Flows-before.Flows) / seconds
+		valid[proto] = true
+	}
+	return rates, valid, true
+
+} // End of flowRates
+
+// UpdateFlowRateStats adds the flow rate of each protocol since the
+// previous message to the running variance of the exporter. Decreased
+// counters are skipped. It is a metrics.UpdateFunc.
+func (e *Exporter) UpdateFlowRateStats(ident string, prev, cur metrics.Metric) {
+
+	rates, valid, ok := flowRates(prev, cur)
+	if !ok {
+		return
+	}
+	key := metrics.Key{Ident: ident, ExporterID: cur.ExporterID}
+
+	e.rateMutex.Lock()
+	defer e.rateMutex.Unlock()
+
+	stats, found := e.rateStats[key]
+	if !found {
+		stats = &[metrics.NumProtos]runningStats{}
+		e.rateStats[key] = stats
+	}
+	for proto, rate := range rates {
+		if valid[proto] {
+			stats[proto].add(rate)
+		}
+	}
+
+} // End of UpdateFlowRateStats
+
+// flowRateVariance returns the flow rate variance and standard deviation
+// of each protocol of an exporter. ok is false below two rates.
+func (e *Exporter) flowRateVariance(key metrics.Key) (variance, stddev [metrics.NumProtos]float64, ok bool) {
+
+	e.rateMutex.Lock()
+	defer e.rateMutex.Unlock()
+
+	stats, found := e.rateStats[key]
+	if !found {
+		return variance, stddev, false
+	}
+	for proto := range stats {
+		if stats[proto].count >= 2 {
+			ok = true
+		}
+		variance[proto] = stats[proto].variance()
+		stddev[proto] = math.Sqrt(variance[proto])
+	}
+	return variance, stddev, ok
+
+} // End of flowRateVariance
+
+// ResetFlowRateStats starts the flow rate variance of all exporters
+// anew, e.g. after a change of the network
+func (e *Exporter) ResetFlowRateStats() {
+
+	e.rateMutex.Lock()
+	defer e.rateMutex.Unlock()
+
+	e.rateStats = make(map[metrics.Key]*[metrics.NumProtos]runningStats)
+
+} // End of ResetFlowRateStats
@@ -0,0 +1,144 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package exporter
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// label names of the collector series, in sorted order as expected by
+// the registry
+var (
+	labelExporter = "exporter"
+	labelIdent    = "ident"
+	labelProto    = "proto"
+)
+
+// seriesLabelNames are the variable labels of the descriptors sent as
+// samples. A sample is checked against them, as prometheus.Desc does not
+// expose its labels.
+var seriesLabelNames = make(map[*prometheus.Desc][]string)
+
+// newSeriesDesc returns the descriptor of a collector series, which is
+// sent as sample
+func newSeriesDesc(fqName, help string, labelNames []string) *prometheus.Desc {
+	desc := prometheus.NewDesc(fqName, help, labelNames, nil)
+	seriesLabelNames[desc] = labelNames
+	return desc
+} // End of newSeriesDesc
+
+// seriesLabels are the label pairs of one exporter per proto. They are
+// built once and shared by all families and scrapes, which is fine, as
+// the registry treats label pairs as immutable.
+type seriesLabels struct {
+	protos [metrics.NumProtos][]*dto.LabelPair
+	// err is set for label values, which are invalid
+	err error
+}
+
+func newSeriesLabels(key metrics.Key, exporterStr string) *seriesLabels {
+
+	labels := &seriesLabels{}
+	if !utf8.ValidString(key.Ident) {
+		labels.err = fmt.Errorf("label value %q is not valid UTF-8", key.Ident)
+		return labels
+	}
+
+	ident := key.Ident
+	identPair := &dto.LabelPair{Name: &labelIdent, Value: &ident}
+	exporterPair := &dto.LabelPair{Name: &labelExporter, Value: &exporterStr}
+	for proto := range labels.protos {
+		protoStr := metrics.Proto(proto).String()
+		labels.protos[proto] = []*dto.LabelPair{
+			exporterPair,
+			identPair,
+			{Name: &labelProto, Value: &protoStr},
+		}
+	}
+	return labels
+
+} // End of newSeriesLabels
+
+// labels returns the cached label pairs of an exporter
+func (e *Exporter) labels(key metrics.Key) *seriesLabels {
+
+	e.labelMutex.Lock()
+	defer e.labelMutex.Unlock()
+
+	labels, ok := e.labelCache[key]
+	if !ok {
+		labels = newSeriesLabels(key, e.ExporterLabel(key.ExporterID))
+		e.labelCache[key] = labels
+	}
+	return labels
+
+} // End of labels
+
+// sample is a prometheus.Metric with cached label pairs. Unlike a const
+// metric, writing it allocates nothing. Samples of a scrape are
+// allocated together and must not be copied after they are sent.
+type sample struct {
+	desc    *prometheus.Desc
+	labels  []*dto.LabelPair
+	value   float64
+	counter dto.Counter
+	gauge   dto.Gauge
+	isGauge bool
+	// timestampMs is the explicit timestamp, 0 for the scrape time
+	timestampMs int64
+}
+
+func (s *sample) Desc() *prometheus.Desc {
+	return s.desc
+} // End of Desc
+
+func (s *sample) Write(out *dto.Metric) error {
+
+	out.Label = s.labels
+	if s.isGauge {
+		s.gauge.Value = &s.value
+		out.Gauge = &s.gauge
+	} else {
+		s.counter.Value = &s.value
+		out.Counter = &s.counter
+	}
+	if s.timestampMs != 0 {
+		out.TimestampMs = &s.timestampMs
+	}
+	return nil
+
+} // End of Write
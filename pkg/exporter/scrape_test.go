@@ -0,0 +1,159 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package exporter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// TestDuplicateSeries sends the same exporter and proto twice in one
+// scrape. The registry would reject the scrape, so the duplicate must be
+// dropped and counted.
+func TestDuplicateSeries(t *testing.T) {
+
+	e := New(metrics.NewStore(metrics.Options{}), Options{ValueMode: ValueModeCounter})
+	labels := e.labels(metrics.Key{Ident: "live", ExporterID: 1})
+	ch := make(chan prometheus.Metric, 4)
+	s := &scrape{
+		exporter: e,
+		ctx:      context.Background(),
+		ch:       ch,
+		samples:  make([]sample, 4),
+		seen:     make(map[seriesKey]struct{}),
+	}
+	s.send(flowsReceived, false, 1, labels.protos[metrics.ProtoTCP])
+	s.send(flowsReceived, false, 2, labels.protos[metrics.ProtoTCP])
+	s.send(flowsReceived, false, 3, labels.protos[metrics.ProtoUDP])
+	s.send(packetsReceived, false, 4, labels.protos[metrics.ProtoTCP])
+	close(ch)
+
+	var values []float64
+	for metric := range ch {
+		var out dto.Metric
+		if err := metric.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, out.GetCounter().GetValue())
+	}
+	if len(values) != 3 || values[0] != 1 || values[1] != 3 || values[2] != 4 {
+		t.Errorf("sent %v, want [1 3 4] without the duplicate", values)
+	}
+
+	want := `
+# HELP nfexporter_duplicate_series_dropped_total How many series have been dropped, because the same series was already sent in the scrape.
+# TYPE nfexporter_duplicate_series_dropped_total counter
+nfexporter_duplicate_series_dropped_total 1
+`
+	if err := testutil.CollectAndCompare(e.duplicates, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+} // End of TestDuplicateSeries
+
+// TestDuplicateLabels sends two cached exporters, whose label values are
+// equal, e.g. after two IDs were formatted to the same exporter label.
+// The series of the second one are duplicates.
+func TestDuplicateLabels(t *testing.T) {
+
+	e := New(metrics.NewStore(metrics.Options{}), Options{ValueMode: ValueModeCounter})
+	first := newSeriesLabels(metrics.Key{Ident: "live", ExporterID: 1}, "10.0.0.1")
+	second := newSeriesLabels(metrics.Key{Ident: "live", ExporterID: 2}, "10.0.0.1")
+	ch := make(chan prometheus.Metric, 4)
+	s := &scrape{
+		exporter: e,
+		ctx:      context.Background(),
+		ch:       ch,
+		samples:  make([]sample, 4),
+		seen:     make(map[seriesKey]struct{}),
+	}
+	s.send(flowsReceived, false, 1, first.protos[metrics.ProtoTCP])
+	s.send(flowsReceived, false, 2, second.protos[metrics.ProtoTCP])
+	s.send(flowsReceived, false, 3, second.protos[metrics.ProtoUDP])
+	close(ch)
+
+	if len(ch) != 2 {
+		t.Errorf("sent %d samples, want 2 without the duplicate", len(ch))
+	}
+	if got := testutil.ToFloat64(e.duplicates); got != 1 {
+		t.Errorf("duplicates = %v, want 1", got)
+	}
+
+} // End of TestDuplicateLabels
+
+// TestWrongLabelCount sends samples and const metrics with too few and
+// too many labels. They must be skipped and counted instead of failing
+// the scrape or panicking.
+func TestWrongLabelCount(t *testing.T) {
+
+	e := New(metrics.NewStore(metrics.Options{}), Options{ValueMode: ValueModeCounter})
+	labels := e.labels(metrics.Key{Ident: "live", ExporterID: 1}).protos[metrics.ProtoTCP]
+	extra := append(append([]*dto.LabelPair{}, labels...), labels[0])
+	ch := make(chan prometheus.Metric, 8)
+	s := &scrape{
+		exporter: e,
+		ctx:      context.Background(),
+		ch:       ch,
+		samples:  make([]sample, 8),
+		seen:     make(map[seriesKey]struct{}),
+	}
+	s.send(flowsReceived, false, 1, labels[:2])
+	s.send(flowsReceived, false, 2, extra)
+	s.send(flowsReceived, false, 3, nil)
+	s.send(flowsReceived, false, 4, labels)
+	e.sendConstMetric(ch, flowsReceived, prometheus.CounterValue, 5, "live")
+	e.sendConstMetric(ch, evicted, prometheus.CounterValue, 6, "extra")
+	e.sendConstMetric(ch, flowsReceived, prometheus.CounterValue, 7, "live", "1", "udp")
+	close(ch)
+
+	var values []float64
+	for metric := range ch {
+		var out dto.Metric
+		if err := metric.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, out.GetCounter().GetValue())
+	}
+	if len(values) != 2 || values[0] != 4 || values[1] != 7 {
+		t.Errorf("sent %v, want [4 7] of the valid labels", values)
+	}
+	if got := testutil.ToFloat64(e.errors.WithLabelValues(reasonMetricCreation)); got != 5 {
+		t.Errorf("%s errors = %v, want 5", reasonMetricCreation, got)
+	}
+
+} // End of TestWrongLabelCount
@@ -0,0 +1,95 @@
+//go:build linux
+
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package listener_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"nfsen_exporter/pkg/listener"
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/nfsocktest"
+)
+
+// TestAbstractSocket receives a message on a socket in the abstract
+// namespace, which leaves no file behind and is gone after the stop
+func TestAbstractSocket(t *testing.T) {
+
+	name := fmt.Sprintf("nfsen-exporter-test-%d", os.Getpid())
+	store := metrics.NewStore(metrics.Options{})
+	socket := listener.New(name, store, listener.Options{Abstract: true, QueueSize: 4})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := socket.Open(ctx); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- socket.Run(ctx)
+	}()
+
+	client, err := nfsocktest.Dial("@" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.SendStats("live", 1, nfsocktest.Stats{TCP: metrics.Counters{Flows: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the exporter", func() bool { return store.Len() == 1 })
+
+	if _, err := os.Lstat(name); !os.IsNotExist(err) {
+		t.Errorf("abstract socket created a file %s: %v", name, err)
+	}
+	if err := socket.Check(); err != nil {
+		t.Errorf("Check = %v, want nil without a file", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run = %v, want nil after cancel", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	if client, err := nfsocktest.Dial("@" + name); err == nil {
+		client.Close()
+		t.Errorf("abstract socket %s still accepts after the stop", name)
+	}
+
+} // End of TestAbstractSocket
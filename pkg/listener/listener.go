@@ -0,0 +1,717 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package listener implements a UNIX socket server to receive data from
+// nfcapd. Received messages are queued, decoded and applied to a
+// metrics.Store. Up to now nfcapd reports flows/packets/bytes counters per
+// protocol (tcp/udp/icmp/other) and the source identifier of the collector.
+package listener
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/protocol"
+)
+
+// Options configure a Listener
+type Options struct {
+	// Abstract creates the socket in the Linux abstract namespace instead
+	// of the file system. It is removed by the kernel, when it is closed.
+	Abstract bool
+	// SELinuxLabel sets the SELinux context of the socket file, e.g.
+	// system_u:object_r:nfsen_var_run_t:s0. Empty keeps the context
+	// inherited from the directory.
+	SELinuxLabel string
+	// Backlog is the depth of the listen queue of the socket. 0 uses
+	// the default of net.Listen.
+	Backlog int
+	// QueueSize is the number of received messages waiting for the
+	// metric update of each worker, before messages are dropped
+	QueueSize int
+	// Workers is the number of goroutines, which decode the messages and
+	// update the store. Messages of an ident are always handled by the
+	// same worker, so they are applied in order. 0 uses one worker.
+	Workers int
+	// IdleTimeout closes connections without a message for this
+	// duration. 0 disables the timeout.
+	IdleTimeout time.Duration
+	// OnUpdate is passed to metrics.Store.Update for each message
+	OnUpdate metrics.UpdateFunc
+	// OnRemove is called for each exporter removed by a control message
+	OnRemove func(key metrics.Key)
+	// OnRead is called with each message as read, before it is queued,
+	// and the number of its connection, counted from 1 in the order of
+	// accept, 0 for Input. It must not modify message.
+	OnRead func(conn uint64, message []byte)
+	// OnMessage is called with the decoded metrics of each message after
+	// the store is updated. It must not keep list.
+	OnMessage func(ident string, list []metrics.Metric)
+	// Input replaces the socket: the messages are read as one stream from
+	// Input, e.g. stdin for tests without a collector. Messages are not
+	// dropped, reading waits for the queue instead.
+	Input io.Reader
+}
+
+// connectionBuckets of the connection duration, from 1s to a day
+var connectionBuckets = []float64{1, 5, 10, 30, 60, 300, 900, 1800, 3600, 6 * 3600, 12 * 3600, 24 * 3600}
+
+// Stats describe the state of a Listener
+type Stats struct {
+	// Readers is the number of connections read by a goroutine
+	Readers int
+	// Queued is the number of messages waiting in the queue of each worker
+	Queued []int
+	// Messages is the number of messages processed so far
+	Messages uint64
+	// ParseErrors is the number of messages, which could not be decoded
+	ParseErrors uint64
+}
+
+// Listener receives nfcapd messages on a UNIX socket
+type Listener struct {
+	socketPath string
+	store      *metrics.Store
+	options    Options
+	// messages read from the socket, waiting for the metric update, one
+	// queue per worker
+	queues []chan []byte
+
+	processed     atomic.Uint64
+	accepted      atomic.Uint64
+	parseErrors   atomic.Uint64
+	activeReaders atomic.Int64
+	dropped       prometheus.Counter
+	controls      prometheus.Counter
+	connDuration  *prometheus.HistogramVec
+	// warn only once about each unknown version
+	unknownVersions sync.Map
+
+	// the socket, replaced by Rebind, and the inode of its file
+	listenerMutex sync.Mutex
+	listener      net.Listener
+	inode         uint64
+	stopped       bool
+
+	// open connections, closed on shutdown
+	connMutex sync.Mutex
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// New returns a listener for socketPath, which updates store
+func New(socketPath string, store *metrics.Store, options Options) *Listener {
+	workers := options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	queues := make([]chan []byte, workers)
+	for i := range queues {
+		queues[i] = make(chan []byte, options.QueueSize)
+	}
+	return &Listener{
+		socketPath: socketPath,
+		store:      store,
+		options:    options,
+		queues:     queues,
+		conns:      make(map[net.Conn]struct{}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "socket",
+			Name:      "dropped_messages_total",
+			Help:      "How many messages have been dropped, because the message queue was full.",
+		}),
+		controls: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "socket",
+			Name:      "control_messages_total",
+			Help:      "How many control messages have been processed.",
+		}),
+		connDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "socket",
+			Name:      "connection_duration_seconds",
+			Help:      "Duration of collector connections from accept to close, by the ident of their first message.",
+			Buckets:   connectionBuckets,
+		}, []string{"ident"}),
+	}
+} // End of New
+
+// Open creates the socket. A stale socket file is removed first. With
+// Input, there is no socket to create.
+func (socket *Listener) Open(ctx context.Context) error {
+
+	if socket.options.Input != nil {
+		return nil
+	}
+	listener, inode, err := socket.bind(ctx)
+	if err != nil {
+		return err
+	}
+	socket.listener = listener
+	socket.inode = inode
+	return nil
+
+} // End of Open
+
+// bind creates the socket and returns it with the inode of its file, 0
+// for an abstract socket. A stale socket file is removed first.
+func (socket *Listener) bind(ctx context.Context) (net.Listener, uint64, error) {
+
+	// Go maps the leading @ to the 0 byte of an abstract name
+	address := socket.socketPath
+	if socket.options.Abstract {
+		address = "@" + address
+	} else if err := os.RemoveAll(socket.socketPath); err != nil {
+		return nil, 0, err
+	}
+	var listener net.Listener
+	var err error
+	if socket.options.Backlog > 0 {
+		listener, err = listenBacklog(address, socket.options.Backlog)
+	} else {
+		var config net.ListenConfig
+		listener, err = config.Listen(ctx, "unix", address)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if socket.options.Abstract {
+		return listener, 0, nil
+	}
+
+	if socket.options.SELinuxLabel != "" {
+		if err := setSELinuxLabel(socket.socketPath, socket.options.SELinuxLabel); err != nil {
+			listener.Close()
+			return nil, 0, err
+		}
+	}
+	info, err := os.Lstat(socket.socketPath)
+	if err != nil {
+		listener.Close()
+		return nil, 0, err
+	}
+	return listener, info.Sys().(*syscall.Stat_t).Ino, nil
+
+} // End of bind
+
+// Check returns an error, if the socket file was removed or replaced
+// since it was created, e.g. by a cleanup of /tmp. An abstract socket
+// and Input have no file to check.
+func (socket *Listener) Check() error {
+
+	if socket.options.Input != nil || socket.options.Abstract {
+		return nil
+	}
+	socket.listenerMutex.Lock()
+	inode := socket.inode
+	socket.listenerMutex.Unlock()
+
+	info, err := os.Lstat(socket.socketPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("socket file %s was removed", socket.socketPath)
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Sys().(*syscall.Stat_t).Ino != inode {
+		return fmt.Errorf("socket file %s was replaced", socket.socketPath)
+	}
+	return nil
+
+} // End of Check
+
+// Rebind creates the socket again after a failed Check and replaces the
+// socket accepted by Run. Connections of the old socket are kept. A
+// directory at the socket path is not removed.
+func (socket *Listener) Rebind(ctx context.Context) error {
+
+	if socket.options.Input != nil || socket.options.Abstract {
+		return nil
+	}
+	if info, err := os.Lstat(socket.socketPath); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory", socket.socketPath)
+	}
+	listener, inode, err := socket.bind(ctx)
+	if err != nil {
+		return err
+	}
+
+	socket.listenerMutex.Lock()
+	if socket.stopped {
+		socket.listenerMutex.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	old := socket.listener
+	socket.listener = listener
+	socket.inode = inode
+	socket.listenerMutex.Unlock()
+
+	// the old socket must not unlink the file of the new one
+	if unix, ok := old.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(false)
+	}
+	old.Close()
+	return nil
+
+} // End of Rebind
+
+// currentListener returns the socket accepted by Run
+func (socket *Listener) currentListener() net.Listener {
+	socket.listenerMutex.Lock()
+	defer socket.listenerMutex.Unlock()
+	return socket.listener
+} // End of currentListener
+
+// closeListener closes the socket and prevents a further Rebind
+func (socket *Listener) closeListener() {
+	socket.listenerMutex.Lock()
+	defer socket.listenerMutex.Unlock()
+	socket.stopped = true
+	socket.listener.Close()
+} // End of closeListener
+
+// listenBacklog creates the socket with the raw syscalls, as net.Listen
+// does not allow to set the backlog
+func listenBacklog(path string, backlog int) (net.Listener, error) {
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	// FileListener duplicates the descriptor
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+	return net.FileListener(file)
+
+} // End of listenBacklog
+
+// Processed returns the number of messages processed so far
+func (socket *Listener) Processed() uint64 {
+	return socket.processed.Load()
+} // End of Processed
+
+// Stats returns the current number of readers and queued messages and
+// the message counts
+func (socket *Listener) Stats() Stats {
+
+	stats := Stats{
+		Readers:     int(socket.activeReaders.Load()),
+		Queued:      make([]int, len(socket.queues)),
+		Messages:    socket.processed.Load(),
+		ParseErrors: socket.parseErrors.Load(),
+	}
+	for i, queue := range socket.queues {
+		stats.Queued[i] = len(queue)
+	}
+	return stats
+
+} // End of Stats
+
+// Describe implements prometheus.Collector for the listener statistics
+func (socket *Listener) Describe(ch chan<- *prometheus.Desc) {
+	socket.dropped.Describe(ch)
+	socket.controls.Describe(ch)
+	socket.connDuration.Describe(ch)
+} // End of Describe
+
+// Collect implements prometheus.Collector for the listener statistics
+func (socket *Listener) Collect(ch chan<- prometheus.Metric) {
+	socket.dropped.Collect(ch)
+	socket.controls.Collect(ch)
+	socket.connDuration.Collect(ch)
+} // End of Collect
+
+// readStat reads messages from conn until it is closed and queues them
+// for the worker of their ident. If the queue is full, a message is dropped. A
+// connection without a message for idleTimeout is closed. The connection
+// is closed by Run, when ctx is done. Its duration is observed with the
+// ident of the first message, an empty ident without message. number is
+// the number of conn passed to OnRead.
+func (socket *Listener) readStat(ctx context.Context, conn net.Conn, number uint64, idleTimeout time.Duration) {
+
+	defer conn.Close()
+
+	start := time.Now()
+	ident := ""
+	defer func() {
+		// an ident, which is no valid label value, is not observed
+		if observer, err := socket.connDuration.GetMetricWithLabelValues(ident); err == nil {
+			observer.Observe(time.Since(start).Seconds())
+		}
+	}()
+
+	var idle atomic.Bool
+	var timer *time.Timer
+	if idleTimeout > 0 {
+		timer = time.AfterFunc(idleTimeout, func() {
+			idle.Store(true)
+			log.Printf("Close connection idle for %v\n", idleTimeout)
+			conn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	for {
+		message, err := readMessage(conn)
+		if err != nil {
+			if err != io.EOF && !idle.Load() && ctx.Err() == nil {
+				fmt.Printf("Socket read error: %v\n", err)
+			}
+			return
+		}
+		if timer != nil {
+			timer.Reset(idleTimeout)
+		}
+		if ident == "" {
+			ident = protocol.Ident(message)
+		}
+		if socket.options.OnRead != nil {
+			socket.options.OnRead(number, message)
+		}
+
+		select {
+		case socket.queue(message) <- message:
+		default:
+			socket.dropped.Inc()
+			fmt.Printf("Message queue full - drop message\n")
+		}
+	}
+
+} // End of readStat
+
+// readMessage reads one message. The header up to the ident is followed
+// by the number of metric records given in the header. A header with
+// more than protocol.MaxMetrics records is an error, as the records are
+// not allocated for an untrusted writer.
+func readMessage(conn io.Reader) ([]byte, error) {
+
+	header := make([]byte, protocol.MetricOffset)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	numMetrics := int(binary.LittleEndian.Uint16(header[4:6]))
+	if numMetrics > protocol.MaxMetrics {
+		return nil, fmt.Errorf("%w: %d metrics exceed the maximum of %d", protocol.ErrRange, numMetrics, protocol.MaxMetrics)
+	}
+
+	message := make([]byte, protocol.MetricOffset+numMetrics*protocol.MetricSize)
+	copy(message, header)
+	if _, err := io.ReadFull(conn, message[protocol.MetricOffset:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+
+} // End of readMessage
+
+// queue returns the queue of the worker for the ident of message
+func (socket *Listener) queue(message []byte) chan []byte {
+
+	if len(socket.queues) == 1 {
+		return socket.queues[0]
+	}
+	ident := message[protocol.IdentOffset:protocol.MetricOffset]
+	for i, c := range ident {
+		if c == 0 {
+			ident = ident[:i]
+			break
+		}
+	}
+	hash := fnv.New32a()
+	hash.Write(ident)
+	return socket.queues[hash.Sum32()%uint32(len(socket.queues))]
+
+} // End of queue
+
+// update applies the messages of queue to the store
+func (socket *Listener) update(queue chan []byte) {
+
+	for message := range queue {
+		socket.processStat(message)
+	}
+
+} // End of update
+
+func (socket *Listener) processStat(readBuf []byte) {
+
+	socket.processed.Add(1)
+	if len(readBuf) > 0 && readBuf[0] == protocol.ControlPrefix {
+		socket.processControl(readBuf)
+		return
+	}
+
+	version, err := protocol.HeaderVersion(readBuf)
+	switch {
+	case err == nil:
+	case errors.Is(err, protocol.ErrVersion):
+		if _, warned := socket.unknownVersions.LoadOrStore(version, true); !warned {
+			log.Printf("Unknown protocol version %d - decode as version %d\n", version, protocol.DefaultVersion)
+		}
+		version = protocol.DefaultVersion
+	default:
+		// the parser reports the broken preamble
+		version = protocol.DefaultVersion
+	}
+
+	update, err := protocol.ParseMetricMessageVersion(readBuf, version)
+	if err != nil {
+		socket.parseErrors.Add(1)
+		fmt.Printf("Message error: %v\n", err)
+		return
+	}
+	socket.store.Update(update.Ident, update.Metrics, socket.options.OnUpdate)
+	if socket.options.OnMessage != nil {
+		socket.options.OnMessage(update.Ident, update.Metrics)
+	}
+
+} // end of processStat
+
+// processControl handles a control message
+func (socket *Listener) processControl(readBuf []byte) {
+
+	control, err := protocol.ParseControlMessage(readBuf)
+	if err != nil {
+		socket.parseErrors.Add(1)
+		fmt.Printf("Control message error: %v\n", err)
+		return
+	}
+
+	// ParseControlMessage accepts the known control types only, i.e.
+	// ControlRemoveIdent
+	removed := socket.store.RemoveIdent(control.Ident)
+	if len(removed) == 0 {
+		log.Printf("Remove ident: %s - unknown ident, ignored\n", control.Ident)
+	} else {
+		log.Printf("Remove ident: %s with %d exporters\n", control.Ident, len(removed))
+	}
+	if socket.options.OnRemove != nil {
+		for _, key := range removed {
+			socket.options.OnRemove(key)
+		}
+	}
+	socket.controls.Inc()
+
+} // End of processControl
+
+// Run accepts connections from nfcapd collectors until ctx is done or
+// accepting fails. Then it closes the socket and all connections, waits
+// for the readers, applies the queued messages and returns. The error is
+// nil after ctx is done. With Input, Run reads Input until its end
+// instead. A listener can be run only once.
+func (socket *Listener) Run(ctx context.Context) error {
+
+	var workers sync.WaitGroup
+	for _, queue := range socket.queues {
+		workers.Add(1)
+		go func(queue chan []byte) {
+			defer workers.Done()
+			socket.update(queue)
+		}(queue)
+	}
+
+	if socket.options.Input != nil {
+		err := socket.readInput(ctx)
+		for _, queue := range socket.queues {
+			close(queue)
+		}
+		workers.Wait()
+		return err
+	}
+
+	// unblock Accept and the readers on cancellation
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		socket.closeListener()
+		socket.closeConns()
+		close(stopped)
+	}()
+
+	var readers sync.WaitGroup
+	var err error
+	for {
+		// Accept new connections from nfcapd collectors and
+		// dispatching them to goroutine readStat
+		var conn net.Conn
+		listener := socket.currentListener()
+		conn, err = listener.Accept()
+		if err != nil {
+			// the socket was replaced by Rebind
+			if socket.currentListener() != listener {
+				continue
+			}
+			break
+		}
+		if !socket.addConn(conn) {
+			conn.Close()
+			continue
+		}
+		number := socket.accepted.Add(1)
+		readers.Add(1)
+		socket.activeReaders.Add(1)
+		go func() {
+			defer readers.Done()
+			defer socket.activeReaders.Add(-1)
+			defer socket.removeConn(conn)
+			socket.readStat(ctx, conn, number, socket.options.IdleTimeout)
+		}()
+	}
+
+	close(stop)
+	<-stopped
+	readers.Wait()
+	for _, queue := range socket.queues {
+		close(queue)
+	}
+	workers.Wait()
+
+	if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return fmt.Errorf("accept error: %w", err)
+
+} // End of Run
+
+// readInput queues the messages of Input until its end or ctx is done.
+// A blocked read of Input cannot be interrupted, so it is left behind
+// on ctx done.
+func (socket *Listener) readInput(ctx context.Context) error {
+
+	messages := make(chan []byte)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			message, err := readMessage(socket.options.Input)
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	socket.activeReaders.Add(1)
+	defer socket.activeReaders.Add(-1)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-failed:
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("input read error: %w", err)
+		case message := <-messages:
+			if socket.options.OnRead != nil {
+				socket.options.OnRead(0, message)
+			}
+			select {
+			case socket.queue(message) <- message:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+
+} // End of readInput
+
+// addConn tracks conn for closing on shutdown. It returns false, if the
+// listener is shut down already.
+func (socket *Listener) addConn(conn net.Conn) bool {
+
+	socket.connMutex.Lock()
+	defer socket.connMutex.Unlock()
+
+	if socket.closed {
+		return false
+	}
+	socket.conns[conn] = struct{}{}
+	return true
+
+} // End of addConn
+
+func (socket *Listener) removeConn(conn net.Conn) {
+
+	socket.connMutex.Lock()
+	defer socket.connMutex.Unlock()
+
+	delete(socket.conns, conn)
+
+} // End of removeConn
+
+// closeConns closes all open connections and rejects new ones
+func (socket *Listener) closeConns() {
+
+	socket.connMutex.Lock()
+	defer socket.connMutex.Unlock()
+
+	socket.closed = true
+	for conn := range socket.conns {
+		conn.Close()
+	}
+
+} // End of closeConns
@@ -0,0 +1,394 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package listener_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/goleak"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/listener"
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/nfsocktest"
+	"nfsen_exporter/pkg/protocol"
+)
+
+// startListener runs a listener on a socket in a temporary directory
+// until the returned stop function is called. stop returns the error of
+// Run.
+func startListener(t *testing.T, store *metrics.Store, options listener.Options) (string, func() error) {
+
+	path := filepath.Join(t.TempDir(), "nfsen.sock")
+	if options.QueueSize == 0 {
+		options.QueueSize = 16
+	}
+	socket := listener.New(path, store, options)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := socket.Open(ctx); err != nil {
+		cancel()
+		t.Fatalf("Open: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- socket.Run(ctx)
+	}()
+
+	stopped := false
+	var err error
+	stop := func() error {
+		if !stopped {
+			stopped = true
+			cancel()
+			err = <-done
+		}
+		return err
+	}
+	t.Cleanup(func() { stop() })
+	return path, stop
+
+} // End of startListener
+
+// waitFor polls cond, until it is true or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+} // End of waitFor
+
+func TestEndToEnd(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	exp := exporter.New(store, exporter.Options{ValueMode: exporter.ValueModeCounter})
+	removed := make(chan metrics.Key, 4)
+	path, stop := startListener(t, store, listener.Options{
+		Workers:  2,
+		OnRemove: func(key metrics.Key) { removed <- key },
+	})
+
+	client, err := nfsocktest.Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	stats := nfsocktest.Stats{
+		TCP:   metrics.Counters{Flows: 1, Packets: 2, Bytes: 3},
+		UDP:   metrics.Counters{Flows: 4, Packets: 5, Bytes: 6},
+		ICMP:  metrics.Counters{Flows: 7, Packets: 8, Bytes: 9},
+		Other: metrics.Counters{Flows: 10, Packets: 11, Bytes: 12},
+	}
+	if err := client.SendStats("live", 3, stats); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendStats("backup", 4, stats); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "two exporters", func() bool { return store.Len() == 2 })
+
+	want := `
+# HELP nfsen_collector_bytes How many bytes have been received (per ident and protocol) (tcp/udp/icmp/other).
+# TYPE nfsen_collector_bytes counter
+nfsen_collector_bytes{exporter="3",ident="live",proto="icmp"} 9
+nfsen_collector_bytes{exporter="3",ident="live",proto="other"} 12
+nfsen_collector_bytes{exporter="3",ident="live",proto="tcp"} 3
+nfsen_collector_bytes{exporter="3",ident="live",proto="udp"} 6
+nfsen_collector_bytes{exporter="4",ident="backup",proto="icmp"} 9
+nfsen_collector_bytes{exporter="4",ident="backup",proto="other"} 12
+nfsen_collector_bytes{exporter="4",ident="backup",proto="tcp"} 3
+nfsen_collector_bytes{exporter="4",ident="backup",proto="udp"} 6
+`
+	if err := testutil.CollectAndCompare(exp, strings.NewReader(want), "nfsen_collector_bytes"); err != nil {
+		t.Error(err)
+	}
+
+	if err := client.RemoveIdent("backup"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case key := <-removed:
+		if key != (metrics.Key{Ident: "backup", ExporterID: 4}) {
+			t.Errorf("OnRemove got %v, want backup exporter 4", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for OnRemove")
+	}
+	if store.Len() != 1 {
+		t.Errorf("Len() = %d after RemoveIdent, want 1", store.Len())
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after Run: %v", err)
+	}
+
+} // End of TestEndToEnd
+
+func TestParseErrors(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	path := filepath.Join(t.TempDir(), "nfsen.sock")
+	socket := listener.New(path, store, listener.Options{QueueSize: 4})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := socket.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- socket.Run(ctx) }()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// an unknown control type is a parse error, the connection stays
+	control := protocol.EncodeRemoveIdent("live")
+	control[1] = 99
+	if _, err := conn.Write(control); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(protocol.EncodeMessage("live", 1, 0, nil)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "two messages", func() bool { return socket.Stats().Messages == 2 })
+	if stats := socket.Stats(); stats.ParseErrors != 1 {
+		t.Errorf("Stats() = %+v, want 1 parse error", stats)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+} // End of TestParseErrors
+
+// TestTooManyMetrics sends a header, which claims the most records the
+// size field allows. The listener must close the connection instead of
+// allocating and waiting for the records.
+func TestTooManyMetrics(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	path, _ := startListener(t, store, listener.Options{})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header := protocol.EncodeMessage("live", 1, 0, nil)
+	binary.LittleEndian.PutUint16(header[4:6], 0xffff)
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read = %v, want EOF of the closed connection", err)
+	}
+	if store.Len() != 0 {
+		t.Errorf("store holds %d exporters, want none", store.Len())
+	}
+
+} // End of TestTooManyMetrics
+
+// TestStopLeavesNoGoroutines starts the listener, sends messages on an
+// open connection before and after a Rebind and stops the listener with
+// the connections still open. All goroutines of the listener must have
+// returned, when Run returns.
+func TestStopLeavesNoGoroutines(t *testing.T) {
+
+	ignore := goleak.IgnoreCurrent()
+
+	store := metrics.NewStore(metrics.Options{})
+	path := filepath.Join(t.TempDir(), "nfsen.sock")
+	socket := listener.New(path, store, listener.Options{
+		Workers:     2,
+		QueueSize:   4,
+		IdleTimeout: time.Minute,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := socket.Open(ctx); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- socket.Run(ctx)
+	}()
+
+	stats := nfsocktest.Stats{TCP: metrics.Counters{Flows: 1, Packets: 2, Bytes: 3}}
+	before, err := nfsocktest.Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	if err := before.SendStats("before", 1, stats); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first exporter", func() bool { return store.Len() == 1 })
+
+	// the replaced socket must not leave its accept loop behind
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := socket.Check(); err == nil {
+		t.Fatal("Check of a removed socket file succeeded")
+	}
+	if err := socket.Rebind(ctx); err != nil {
+		t.Fatalf("Rebind: %v", err)
+	}
+	after, err := nfsocktest.Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	if err := after.SendStats("after", 1, stats); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the second exporter", func() bool { return store.Len() == 2 })
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run = %v, want nil after cancel", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	goleak.VerifyNone(t, ignore)
+
+} // End of TestStopLeavesNoGoroutines
+
+func TestInput(t *testing.T) {
+
+	var input bytes.Buffer
+	client := nfsocktest.NewClient(&input)
+	stats := nfsocktest.Stats{TCP: metrics.Counters{Flows: 1, Packets: 2, Bytes: 3}}
+	for _, send := range []func() error{
+		func() error { return client.SendStats("live", 3, stats) },
+		func() error { return client.SendStats("backup", 4, stats) },
+		func() error { return client.RemoveIdent("backup") },
+	} {
+		if err := send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := metrics.NewStore(metrics.Options{})
+	var conns []uint64
+	socket := listener.New("", store, listener.Options{
+		QueueSize: 1,
+		Workers:   2,
+		OnRead:    func(conn uint64, message []byte) { conns = append(conns, conn) },
+		// slow workers, which are still busy at the end of input
+		OnMessage: func(ident string, list []metrics.Metric) { time.Sleep(10 * time.Millisecond) },
+		Input:     &input,
+	})
+	if err := socket.Open(context.Background()); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// Run returns at the end of input, after the workers are done
+	if err := socket.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(conns) != 3 || conns[0] != 0 || conns[1] != 0 || conns[2] != 0 {
+		t.Errorf("got OnRead of connections %v, want 3 times 0 for input", conns)
+	}
+	if processed := socket.Processed(); processed != 3 {
+		t.Errorf("got %d processed messages, want 3", processed)
+	}
+	snapshot, err := store.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot) != 1 || snapshot[0].Ident != "live" || snapshot[0].Metric.ExporterID != 3 ||
+		snapshot[0].Metric.Protos[metrics.ProtoTCP] != stats.TCP {
+		t.Errorf("got %+v, want exporter 3 of live", snapshot)
+	}
+
+} // End of TestInput
+
+func TestInputErrors(t *testing.T) {
+
+	var input bytes.Buffer
+	if err := nfsocktest.NewClient(&input).SendStats("live", 3, nfsocktest.Stats{}); err != nil {
+		t.Fatal(err)
+	}
+	input.Truncate(input.Len() - 1)
+	store := metrics.NewStore(metrics.Options{})
+	socket := listener.New("", store, listener.Options{QueueSize: 1, Input: &input})
+	if err := socket.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "input read error") {
+		t.Errorf("truncated input: got error %v, want input read error", err)
+	}
+	if store.Len() != 0 {
+		t.Errorf("truncated input: got %d exporters, want none", store.Len())
+	}
+
+	// a blocked read is left behind on cancel
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	socket = listener.New("", store, listener.Options{QueueSize: 1, Input: reader})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- socket.Run(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("canceled input: got error %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+
+} // End of TestInputErrors
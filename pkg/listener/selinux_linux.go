@@ -0,0 +1,69 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// selinuxXattr is the extended attribute of the SELinux context
+	selinuxXattr = "security.selinux"
+	// selinuxEnforce exists, if SELinux is enabled and selinuxfs is
+	// mounted
+	selinuxEnforce = "/sys/fs/selinux/enforce"
+)
+
+// setSELinuxLabel sets the SELinux context of path. Without SELinux, the
+// label is not set, which is logged only.
+func setSELinuxLabel(path, label string) error {
+
+	if _, err := os.Stat(selinuxEnforce); err != nil {
+		log.Printf("WARNING: SELinux is not enabled, socket label %s not set\n", label)
+		return nil
+	}
+	err := unix.Setxattr(path, selinuxXattr, []byte(label), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		log.Printf("WARNING: the file system of %s has no SELinux labels, socket label %s not set\n", path, label)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("set SELinux label %s of %s: %w", label, path, err)
+	}
+	log.Printf("Socket SELinux label: %s\n", label)
+	return nil
+
+} // End of setSELinuxLabel
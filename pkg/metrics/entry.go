@@ -0,0 +1,170 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func (c Counters) add(other Counters) Counters {
+	return Counters{Flows: c.Flows + other.Flows, Packets: c.Packets + other.Packets, Bytes: c.Bytes + other.Bytes}
+}
+
+func (c Counters) sub(other Counters) Counters {
+	return Counters{Flows: c.Flows - other.Flows, Packets: c.Packets - other.Packets, Bytes: c.Bytes - other.Bytes}
+}
+
+// grow adds the previous value of each counter, which decreased from
+// previous to current, to the offsets c
+func (c Counters) grow(previous, current Counters) Counters {
+	if current.Flows < previous.Flows {
+		c.Flows += previous.Flows
+	}
+	if current.Packets < previous.Packets {
+		c.Packets += previous.Packets
+	}
+	if current.Bytes < previous.Bytes {
+		c.Bytes += previous.Bytes
+	}
+	return c
+}
+
+// entry holds the metric of one exporter. Its counters are replaced as a
+// whole by each update, so readers get the counters of one message
+// without a lock and never wait for a writer.
+type entry struct {
+	// key and the LRU links are guarded by the store
+	key     Key
+	lruPrev *entry
+	lruNext *entry
+
+	// writer serializes the updates of the entry
+	writer sync.Mutex
+	state  atomic.Pointer[entryState]
+	// changed is set, when a counter changed since SnapshotChanged
+	// returned the entry the last time
+	changed atomic.Bool
+}
+
+// entryState are the counters of an entry. It is not changed after it
+// is stored in the entry.
+type entryState struct {
+	protos      [NumProtos]Counters
+	offsets     [NumProtos]Counters
+	previous    [NumProtos]Counters
+	hasPrevious bool
+	lastUpdate  time.Time
+}
+
+// store sets the entry to metric including its Previous counters
+func (e *entry) store(metric Metric) {
+
+	state := &entryState{
+		protos:      metric.Protos,
+		offsets:     metric.Offsets,
+		hasPrevious: metric.Previous != nil,
+		lastUpdate:  metric.LastUpdate,
+	}
+	if metric.Previous != nil {
+		state.previous = metric.Previous.Protos
+	}
+
+	e.writer.Lock()
+	defer e.writer.Unlock()
+
+	e.state.Store(state)
+	e.changed.Store(true)
+
+} // End of store
+
+// update replaces the counters with metric and keeps the replaced ones
+// as previous counters. It returns the replaced counters as reported by
+// nfcapd. With monotonic, the offsets grow by the previous value of each
+// counter, which decreased.
+func (e *entry) update(metric Metric, monotonic bool) Metric {
+
+	e.writer.Lock()
+	defer e.writer.Unlock()
+
+	previous := e.state.Load()
+
+	// the counters without offsets, as reported by nfcapd
+	reported := Metric{
+		ExporterID: e.key.ExporterID,
+		Offsets:    previous.offsets,
+		LastUpdate: previous.lastUpdate,
+	}
+	for proto := range reported.Protos {
+		reported.Protos[proto] = previous.protos[proto].sub(previous.offsets[proto])
+	}
+
+	state := &entryState{
+		previous:    previous.protos,
+		hasPrevious: true,
+		lastUpdate:  metric.LastUpdate,
+	}
+	for proto := range metric.Protos {
+		if monotonic {
+			state.offsets[proto] = previous.offsets[proto].grow(reported.Protos[proto], metric.Protos[proto])
+		}
+		state.protos[proto] = metric.Protos[proto].add(state.offsets[proto])
+	}
+	e.state.Store(state)
+	if state.protos != previous.protos {
+		e.changed.Store(true)
+	}
+	return reported
+
+} // End of update
+
+// load returns a copy of the entry
+func (e *entry) load() Metric {
+
+	state := e.state.Load()
+	metric := Metric{
+		ExporterID: e.key.ExporterID,
+		Protos:     state.protos,
+		Offsets:    state.offsets,
+		LastUpdate: state.lastUpdate,
+	}
+	if state.hasPrevious {
+		metric.Previous = &Metric{ExporterID: e.key.ExporterID, Protos: state.previous}
+	}
+	return metric
+
+} // End of load
+
+// lastUpdate returns the time of the latest metric of the entry
+func (e *entry) lastUpdate() time.Time {
+	return e.state.Load().lastUpdate
+} // End of lastUpdate
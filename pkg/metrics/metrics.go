@@ -0,0 +1,525 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package metrics holds the statistics reported by nfcapd collectors. The
+// Store is shared between the socket listener, which updates it, and the
+// Prometheus collector, which reads it.
+package metrics
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Namespace is the Prometheus namespace of all exported metrics
+const Namespace = "nfsen"
+
+// Proto is a protocol class, for which nfcapd reports counters
+type Proto int
+
+// Protocol classes in the order of the nfcapd metric record
+const (
+	ProtoTCP Proto = iota
+	ProtoUDP
+	ProtoICMP
+	ProtoOther
+	// NumProtos is the number of protocol classes
+	NumProtos
+)
+
+var protoNames = [NumProtos]string{"tcp", "udp", "icmp", "other"}
+
+// String returns the proto label value of p
+func (p Proto) String() string {
+	if p < 0 || p >= NumProtos {
+		return "unknown"
+	}
+	return protoNames[p]
+} // End of String
+
+// Counters are the statistics of one protocol class
+type Counters struct {
+	Flows   uint64
+	Packets uint64
+	Bytes   uint64
+}
+
+// Metric holds the counters of one exporter as reported by nfcapd
+type Metric struct {
+	// ExporterID identifies the exporter within an ident
+	ExporterID uint64
+	// Protos holds the counters indexed by Proto
+	Protos [NumProtos]Counters
+	// Offsets are added to the counters reported by nfcapd in monotonic
+	// mode, to hide counter resets. Protos includes them already.
+	Offsets [NumProtos]Counters
+	// LastUpdate is the time the metric was received
+	LastUpdate time.Time
+	// Previous holds the counters of the previous message for interval
+	// deltas, nil for the first message of an exporter
+	Previous *Metric
+}
+
+// Key identifies an exporter of an ident
+type Key struct {
+	Ident      string
+	ExporterID uint64
+}
+
+// Entry is the metric of an exporter together with its ident
+type Entry struct {
+	Ident  string
+	Metric Metric
+}
+
+// Stats describe the size of a Store
+type Stats struct {
+	// Idents is the number of idents
+	Idents int
+	// Exporters is the number of exporters of all idents
+	Exporters int
+	// Bytes is a rough estimate of the memory used by the entries
+	Bytes int
+}
+
+// estimated memory of an exporter entry and an ident besides its name,
+// including the map slots
+const (
+	entryBytes = int(unsafe.Sizeof(entry{})) + 16
+	identBytes = 16 + 48
+)
+
+// UpdateFunc is called by Update for each metric, which replaces a
+// previous metric of the same exporter. It is called after the store is
+// unlocked, so it may run concurrently with scrapes and other updates. A
+// slow function delays only the caller of Update.
+type UpdateFunc func(ident string, previous, current Metric)
+
+// replacement is a metric, which replaced a previous one, for the
+// UpdateFunc called after the update
+type replacement struct {
+	previous Metric
+	current  Metric
+}
+
+// Options configure a Store
+type Options struct {
+	// MaxEntries limits the number of exporters in the store. Beyond, the
+	// least recently updated exporters are evicted. 0 is unlimited.
+	MaxEntries int
+	// OnEvict is called with the store locked for each evicted exporter
+	OnEvict func(key Key)
+	// Monotonic keeps the counters from decreasing: after a counter reset
+	// of nfcapd, the last value before the reset is added to the
+	// following values.
+	Monotonic bool
+}
+
+// Store holds the latest metric of each exporter per ident. It is safe
+// for concurrent use. The mutex guards the map structure only; the
+// counters of known exporters are updated and read atomically, so
+// message updates and scrapes do not block each other.
+type Store struct {
+	mutex   sync.RWMutex
+	idents  map[string]map[uint64]*entry
+	size    int
+	options Options
+	evicted atomic.Uint64
+
+	// Stats, maintained with the store write locked and read without lock
+	numIdents    atomic.Int64
+	numExporters atomic.Int64
+	numBytes     atomic.Int64
+
+	// the entries ordered by update, most recent first. The list is
+	// maintained with MaxEntries only.
+	lruMutex sync.Mutex
+	lruHead  *entry
+	lruTail  *entry
+}
+
+// NewStore returns an empty store
+func NewStore(options Options) *Store {
+	return &Store{
+		idents:  make(map[string]map[uint64]*entry),
+		options: options,
+	}
+} // End of NewStore
+
+// Update stores the metrics of ident. A replaced metric becomes Previous
+// of the new one. If fn is not nil, it is called for each replaced metric
+// after the store is unlocked.
+func (s *Store) Update(ident string, metrics []Metric, fn UpdateFunc) {
+
+	var replaced []replacement
+	if fn != nil {
+		replaced = make([]replacement, 0, len(metrics))
+	}
+
+	// fast path: known exporters only need the read lock
+	var added []Metric
+	s.mutex.RLock()
+	exporters := s.idents[ident]
+	for _, metric := range metrics {
+		if e, ok := exporters[metric.ExporterID]; ok {
+			previous := e.update(metric, s.options.Monotonic)
+			s.touch(e)
+			if fn != nil {
+				replaced = append(replaced, replacement{previous: previous, current: metric})
+			}
+		} else {
+			added = append(added, metric)
+		}
+	}
+	s.mutex.RUnlock()
+
+	if len(added) > 0 {
+		replaced = s.add(ident, added, replaced)
+	}
+
+	// scrapes wait for the write lock of Expire, which waits for the read
+	// lock, so a slow function must not run before the unlock
+	if fn == nil {
+		return
+	}
+	for _, r := range replaced {
+		fn(ident, r.previous, r.current)
+	}
+
+} // End of Update
+
+// add stores the metrics of ident, which were not known on the fast path
+// of Update, with the store write locked. Metrics of exporters added by
+// another update in between replace their metric and are appended to
+// replaced.
+func (s *Store) add(ident string, metrics []Metric, replaced []replacement) []replacement {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.addIdent(ident)
+	for _, metric := range metrics {
+		if e, ok := s.idents[ident][metric.ExporterID]; ok {
+			previous := e.update(metric, s.options.Monotonic)
+			s.touch(e)
+			replaced = append(replaced, replacement{previous: previous, current: metric})
+			continue
+		}
+		s.addEntry(ident, metric)
+	}
+	s.evict()
+	return replaced
+
+} // End of add
+
+// Load adds entries to the store, e.g. from a saved state. Existing
+// metrics of the same exporters are replaced.
+func (s *Store) Load(entries []Entry) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, loaded := range entries {
+		s.addIdent(loaded.Ident)
+		if e, ok := s.idents[loaded.Ident][loaded.Metric.ExporterID]; ok {
+			e.store(loaded.Metric)
+			s.touch(e)
+			continue
+		}
+		s.addEntry(loaded.Ident, loaded.Metric)
+	}
+	s.evict()
+
+} // End of Load
+
+// Snapshot returns a copy of all metrics. It gives up waiting for the
+// lock, if ctx is done before, and returns the error of ctx then.
+func (s *Store) Snapshot(ctx context.Context) ([]Entry, error) {
+	return s.snapshot(ctx, false)
+} // End of Snapshot
+
+// SnapshotChanged works like Snapshot, but returns only the metrics,
+// whose counters changed since the previous call. The change is tracked
+// per store, so concurrent callers each get a part of the changes.
+func (s *Store) SnapshotChanged(ctx context.Context) ([]Entry, error) {
+	return s.snapshot(ctx, true)
+} // End of SnapshotChanged
+
+func (s *Store) snapshot(ctx context.Context, changedOnly bool) ([]Entry, error) {
+
+	if err := lockContext(ctx, s.mutex.RLock, s.mutex.RUnlock); err != nil {
+		return nil, err
+	}
+	defer s.mutex.RUnlock()
+
+	size := 0
+	for _, exporters := range s.idents {
+		size += len(exporters)
+	}
+	snapshot := make([]Entry, 0, size)
+	for ident, exporters := range s.idents {
+		for _, e := range exporters {
+			// an update after the flag is cleared is returned again next time
+			if changedOnly && !e.changed.Swap(false) {
+				continue
+			}
+			snapshot = append(snapshot, Entry{Ident: ident, Metric: e.load()})
+		}
+	}
+	return snapshot, nil
+
+} // End of snapshot
+
+// Expire removes all exporters, which did not report since ttl before now,
+// and idents without exporters left. It returns the removed exporters.
+// Like Snapshot, it gives up waiting for the lock, if ctx is done.
+func (s *Store) Expire(ctx context.Context, now time.Time, ttl time.Duration) ([]Key, error) {
+
+	if err := lockContext(ctx, s.mutex.Lock, s.mutex.Unlock); err != nil {
+		return nil, err
+	}
+	defer s.mutex.Unlock()
+
+	var expired []Key
+	for ident, exporters := range s.idents {
+		for exporterID, e := range exporters {
+			lastUpdate := e.lastUpdate()
+			if now.Sub(lastUpdate) > ttl {
+				log.Printf("Expire ident: %s, exporter: %d - last update %v ago\n",
+					ident, exporterID, now.Sub(lastUpdate).Round(time.Second))
+				s.remove(e)
+				expired = append(expired, Key{Ident: ident, ExporterID: exporterID})
+			}
+		}
+		s.removeIdent(ident)
+	}
+	return expired, nil
+
+} // End of Expire
+
+// RemoveIdent removes ident and all its exporters. It returns the
+// removed exporters, none for an unknown ident.
+func (s *Store) RemoveIdent(ident string) []Key {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var removed []Key
+	for _, e := range s.idents[ident] {
+		s.remove(e)
+		removed = append(removed, e.key)
+	}
+	s.removeIdent(ident)
+	return removed
+
+} // End of RemoveIdent
+
+// Len returns the number of exporters in the store
+func (s *Store) Len() int {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.size
+
+} // End of Len
+
+// Evicted returns the number of exporters evicted for MaxEntries so far
+func (s *Store) Evicted() uint64 {
+	return s.evicted.Load()
+} // End of Evicted
+
+// Stats returns the size of the store. It does not lock the store, so
+// it never waits for an update or a scrape.
+func (s *Store) Stats() Stats {
+	return Stats{
+		Idents:    int(s.numIdents.Load()),
+		Exporters: int(s.numExporters.Load()),
+		Bytes:     int(s.numBytes.Load()),
+	}
+} // End of Stats
+
+// addIdent creates the exporter map of ident, if it does not exist. The
+// store must be write locked.
+func (s *Store) addIdent(ident string) {
+
+	if _, ok := s.idents[ident]; ok {
+		return
+	}
+	s.idents[ident] = make(map[uint64]*entry)
+	s.numIdents.Add(1)
+	s.numBytes.Add(int64(identBytes + len(ident)))
+
+} // End of addIdent
+
+// removeIdent deletes ident, if it has no exporters left. The store must
+// be write locked.
+func (s *Store) removeIdent(ident string) {
+
+	exporters, ok := s.idents[ident]
+	if !ok || len(exporters) > 0 {
+		return
+	}
+	delete(s.idents, ident)
+	s.numIdents.Add(-1)
+	s.numBytes.Add(-int64(identBytes + len(ident)))
+
+} // End of removeIdent
+
+// addEntry creates the entry for metric. The store must be write locked
+// and the ident map must exist.
+func (s *Store) addEntry(ident string, metric Metric) {
+
+	e := &entry{key: Key{Ident: ident, ExporterID: metric.ExporterID}}
+	e.store(metric)
+	s.idents[ident][metric.ExporterID] = e
+	s.size++
+	s.numExporters.Add(1)
+	s.numBytes.Add(int64(entryBytes))
+
+	if s.options.MaxEntries > 0 {
+		s.lruMutex.Lock()
+		s.pushFront(e)
+		s.lruMutex.Unlock()
+	}
+
+} // End of addEntry
+
+// remove deletes e from the store. The store must be write locked. An
+// ident without exporters is kept, callers remove it.
+func (s *Store) remove(e *entry) {
+
+	delete(s.idents[e.key.Ident], e.key.ExporterID)
+	s.size--
+	s.numExporters.Add(-1)
+	s.numBytes.Add(-int64(entryBytes))
+
+	if s.options.MaxEntries > 0 {
+		s.lruMutex.Lock()
+		s.unlink(e)
+		s.lruMutex.Unlock()
+	}
+
+} // End of remove
+
+// evict removes the least recently updated exporters beyond MaxEntries.
+// The store must be write locked.
+func (s *Store) evict() {
+
+	for s.options.MaxEntries > 0 && s.size > s.options.MaxEntries {
+		e := s.lruTail
+		log.Printf("Evict ident: %s, exporter: %d - more than %d exporters tracked\n",
+			e.key.Ident, e.key.ExporterID, s.options.MaxEntries)
+		s.remove(e)
+		s.removeIdent(e.key.Ident)
+		s.evicted.Add(1)
+		if s.options.OnEvict != nil {
+			s.options.OnEvict(e.key)
+		}
+	}
+
+} // End of evict
+
+// touch moves e to the front of the LRU list. The store must be locked
+// for reading at least.
+func (s *Store) touch(e *entry) {
+
+	if s.options.MaxEntries == 0 {
+		return
+	}
+	s.lruMutex.Lock()
+	defer s.lruMutex.Unlock()
+
+	if s.lruHead != e {
+		s.unlink(e)
+		s.pushFront(e)
+	}
+
+} // End of touch
+
+// pushFront inserts e as most recently updated. lruMutex must be held.
+func (s *Store) pushFront(e *entry) {
+
+	e.lruPrev = nil
+	e.lruNext = s.lruHead
+	if s.lruHead != nil {
+		s.lruHead.lruPrev = e
+	}
+	s.lruHead = e
+	if s.lruTail == nil {
+		s.lruTail = e
+	}
+
+} // End of pushFront
+
+// unlink removes e from the LRU list. lruMutex must be held.
+func (s *Store) unlink(e *entry) {
+
+	if e.lruPrev != nil {
+		e.lruPrev.lruNext = e.lruNext
+	} else {
+		s.lruHead = e.lruNext
+	}
+	if e.lruNext != nil {
+		e.lruNext.lruPrev = e.lruPrev
+	} else {
+		s.lruTail = e.lruPrev
+	}
+	e.lruPrev = nil
+	e.lruNext = nil
+
+} // End of unlink
+
+// lockContext calls lock unless ctx is done first. If ctx wins, the
+// pending lock is released with unlock as soon as it is acquired.
+func lockContext(ctx context.Context, lock, unlock func()) error {
+
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+
+} // End of lockContext
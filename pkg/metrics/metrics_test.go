@@ -0,0 +1,553 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// metric returns a metric of exporter with flows in all protos
+func metric(exporter, flows uint64, lastUpdate time.Time) metrics.Metric {
+	m := metrics.Metric{ExporterID: exporter, LastUpdate: lastUpdate}
+	for proto := range m.Protos {
+		m.Protos[proto] = metrics.Counters{Flows: flows}
+	}
+	return m
+} // End of metric
+
+// keys returns the keys of a snapshot in order
+func keys(entries []metrics.Entry) []metrics.Key {
+	list := make([]metrics.Key, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, metrics.Key{Ident: entry.Ident, ExporterID: entry.Metric.ExporterID})
+	}
+	sortKeys(list)
+	return list
+} // End of keys
+
+func sortKeys(list []metrics.Key) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Ident != list[j].Ident {
+			return list[i].Ident < list[j].Ident
+		}
+		return list[i].ExporterID < list[j].ExporterID
+	})
+} // End of sortKeys
+
+func TestEvictionOrder(t *testing.T) {
+
+	var evicted []metrics.Key
+	store := metrics.NewStore(metrics.Options{
+		MaxEntries: 3,
+		OnEvict:    func(key metrics.Key) { evicted = append(evicted, key) },
+	})
+	now := time.Now()
+	store.Update("a", []metrics.Metric{metric(1, 1, now), metric(2, 1, now)}, nil)
+	store.Update("b", []metrics.Metric{metric(3, 1, now)}, nil)
+	// 1 becomes the most recently updated, 2 the least
+	store.Update("a", []metrics.Metric{metric(1, 2, now)}, nil)
+
+	store.Update("c", []metrics.Metric{metric(4, 1, now)}, nil)
+	store.Update("c", []metrics.Metric{metric(5, 1, now)}, nil)
+	// a loaded metric counts as update
+	store.Load([]metrics.Entry{{Ident: "a", Metric: metric(1, 3, now)}})
+	store.Update("d", []metrics.Metric{metric(6, 1, now)}, nil)
+
+	want := []metrics.Key{{Ident: "a", ExporterID: 2}, {Ident: "b", ExporterID: 3}, {Ident: "c", ExporterID: 4}}
+	if !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted %v, want %v", evicted, want)
+	}
+	if got := store.Evicted(); got != uint64(len(want)) {
+		t.Errorf("Evicted() = %d, want %d", got, len(want))
+	}
+	if got := store.Len(); got != 3 {
+		t.Errorf("Len() = %d, want 3", got)
+	}
+	snapshot, err := store.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := []metrics.Key{{Ident: "a", ExporterID: 1}, {Ident: "c", ExporterID: 5}, {Ident: "d", ExporterID: 6}}
+	if got := keys(snapshot); !reflect.DeepEqual(got, remaining) {
+		t.Errorf("store holds %v, want %v", got, remaining)
+	}
+	// ident b has no exporter left
+	if stats := store.Stats(); stats.Idents != 3 || stats.Exporters != 3 {
+		t.Errorf("Stats() = %+v, want 3 idents and 3 exporters", stats)
+	}
+
+} // End of TestEvictionOrder
+
+func TestUnlimitedStore(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	for exporter := uint64(0); exporter < 100; exporter++ {
+		store.Update("a", []metrics.Metric{metric(exporter, 1, time.Now())}, nil)
+	}
+	if store.Len() != 100 || store.Evicted() != 0 {
+		t.Errorf("Len() = %d, Evicted() = %d, want 100 and 0", store.Len(), store.Evicted())
+	}
+
+} // End of TestUnlimitedStore
+
+func TestExpire(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{MaxEntries: 10})
+	now := time.Now()
+	store.Update("a", []metrics.Metric{metric(1, 1, now.Add(-2*time.Hour)), metric(2, 1, now)}, nil)
+	store.Update("b", []metrics.Metric{metric(3, 1, now.Add(-time.Hour-time.Second))}, nil)
+	store.Update("c", []metrics.Metric{metric(4, 1, now.Add(-time.Hour))}, nil)
+
+	expired, err := store.Expire(context.Background(), now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortKeys(expired)
+	want := []metrics.Key{{Ident: "a", ExporterID: 1}, {Ident: "b", ExporterID: 3}}
+	if !reflect.DeepEqual(expired, want) {
+		t.Errorf("expired %v, want %v", expired, want)
+	}
+	if stats := store.Stats(); stats.Idents != 2 || stats.Exporters != 2 {
+		t.Errorf("Stats() = %+v, want 2 idents and 2 exporters", stats)
+	}
+
+	// expired exporters leave the LRU list, so they are not evicted again
+	for exporter := uint64(10); exporter < 18; exporter++ {
+		store.Update("d", []metrics.Metric{metric(exporter, 1, now)}, nil)
+	}
+	if store.Evicted() != 0 || store.Len() != 10 {
+		t.Errorf("Evicted() = %d, Len() = %d, want 0 and 10", store.Evicted(), store.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.Expire(ctx, now, time.Hour); err == nil {
+		t.Errorf("Expire with done context: got no error")
+	}
+
+} // End of TestExpire
+
+func TestRemoveIdent(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{MaxEntries: 3})
+	now := time.Now()
+	store.Update("a", []metrics.Metric{metric(1, 1, now), metric(2, 1, now)}, nil)
+	store.Update("b", []metrics.Metric{metric(1, 1, now)}, nil)
+
+	removed := store.RemoveIdent("a")
+	sortKeys(removed)
+	want := []metrics.Key{{Ident: "a", ExporterID: 1}, {Ident: "a", ExporterID: 2}}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("RemoveIdent(a) = %v, want %v", removed, want)
+	}
+	if removed := store.RemoveIdent("unknown"); len(removed) != 0 {
+		t.Errorf("RemoveIdent(unknown) = %v, want none", removed)
+	}
+	if stats := store.Stats(); stats.Idents != 1 || stats.Exporters != 1 {
+		t.Errorf("Stats() = %+v, want 1 ident and 1 exporter", stats)
+	}
+
+	// the removed exporters free their places without eviction
+	store.Update("c", []metrics.Metric{metric(1, 1, now), metric(2, 1, now)}, nil)
+	if store.Evicted() != 0 || store.Len() != 3 {
+		t.Errorf("Evicted() = %d, Len() = %d, want 0 and 3", store.Evicted(), store.Len())
+	}
+
+} // End of TestRemoveIdent
+
+func TestProtoString(t *testing.T) {
+
+	want := map[metrics.Proto]string{
+		metrics.ProtoTCP:   "tcp",
+		metrics.ProtoUDP:   "udp",
+		metrics.ProtoICMP:  "icmp",
+		metrics.ProtoOther: "other",
+		metrics.NumProtos:  "unknown",
+		-1:                 "unknown",
+	}
+	for proto, name := range want {
+		if got := proto.String(); got != name {
+			t.Errorf("Proto(%d).String() = %q, want %q", proto, got, name)
+		}
+	}
+
+} // End of TestProtoString
+
+func TestUpdatePrevious(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	type call struct {
+		ident             string
+		previous, current uint64
+	}
+	var calls []call
+	fn := func(ident string, previous, current metrics.Metric) {
+		calls = append(calls, call{ident, previous.Protos[metrics.ProtoTCP].Flows, current.Protos[metrics.ProtoTCP].Flows})
+	}
+	now := time.Now()
+	store.Update("a", []metrics.Metric{metric(1, 10, now)}, fn)
+	store.Update("a", []metrics.Metric{metric(1, 15, now.Add(time.Minute))}, fn)
+
+	if want := []call{{"a", 10, 15}}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("UpdateFunc calls %v, want %v - only replaced metrics are passed", calls, want)
+	}
+	snapshot, err := store.Snapshot(context.Background())
+	if err != nil || len(snapshot) != 1 {
+		t.Fatalf("Snapshot = %v, %v, want one entry", snapshot, err)
+	}
+	got := snapshot[0].Metric
+	if got.Protos[metrics.ProtoUDP].Flows != 15 || got.Previous == nil || got.Previous.Protos[metrics.ProtoUDP].Flows != 10 {
+		t.Errorf("got %+v with previous %+v, want 15 after 10", got.Protos, got.Previous)
+	}
+	if !got.LastUpdate.Equal(now.Add(time.Minute).Round(0)) {
+		t.Errorf("LastUpdate = %v, want %v", got.LastUpdate, now.Add(time.Minute))
+	}
+
+} // End of TestUpdatePrevious
+
+func TestMonotonic(t *testing.T) {
+
+	var reported []uint64
+	fn := func(ident string, previous, current metrics.Metric) {
+		reported = append(reported, previous.Protos[metrics.ProtoTCP].Flows, current.Protos[metrics.ProtoTCP].Flows)
+	}
+	for _, monotonic := range []bool{false, true} {
+		reported = nil
+		store := metrics.NewStore(metrics.Options{Monotonic: monotonic})
+		for _, flows := range []uint64{10, 3, 5, 2} {
+			store.Update("a", []metrics.Metric{metric(1, flows, time.Now())}, fn)
+		}
+		snapshot, _ := store.Snapshot(context.Background())
+		got := snapshot[0].Metric.Protos[metrics.ProtoTCP].Flows
+		// 10 and 5 are added after the resets to 3 and 2
+		want := uint64(2)
+		if monotonic {
+			want = 17
+		}
+		if got != want {
+			t.Errorf("monotonic %v: flows %d, want %d", monotonic, got, want)
+		}
+		// UpdateFunc gets the counters as sent by nfcapd
+		if wantReported := []uint64{10, 3, 3, 5, 5, 2}; !reflect.DeepEqual(reported, wantReported) {
+			t.Errorf("monotonic %v: UpdateFunc got %v, want %v", monotonic, reported, wantReported)
+		}
+	}
+
+} // End of TestMonotonic
+
+func TestSnapshotChanged(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	now := time.Now()
+	store.Update("a", []metrics.Metric{metric(1, 1, now), metric(2, 1, now)}, nil)
+
+	changed := func() []metrics.Key {
+		snapshot, err := store.SnapshotChanged(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys(snapshot)
+	}
+	if got := changed(); len(got) != 2 {
+		t.Errorf("first SnapshotChanged = %v, want both exporters", got)
+	}
+	if got := changed(); len(got) != 0 {
+		t.Errorf("SnapshotChanged without update = %v, want none", got)
+	}
+	store.Update("a", []metrics.Metric{metric(1, 1, now), metric(2, 2, now)}, nil)
+	if got, want := changed(), []metrics.Key{{Ident: "a", ExporterID: 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SnapshotChanged = %v, want %v", got, want)
+	}
+	// Snapshot neither depends on nor clears the change
+	store.Update("a", []metrics.Metric{metric(1, 2, now)}, nil)
+	if snapshot, _ := store.Snapshot(context.Background()); len(snapshot) != 2 {
+		t.Errorf("Snapshot = %d entries, want 2", len(snapshot))
+	}
+	if got, want := changed(), []metrics.Key{{Ident: "a", ExporterID: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SnapshotChanged after Snapshot = %v, want %v", got, want)
+	}
+
+} // End of TestSnapshotChanged
+
+func TestLoad(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	saved := time.Now().Add(-time.Hour)
+	previous := metric(1, 5, saved)
+	loaded := metric(1, 8, saved)
+	loaded.Previous = &previous
+	store.Load([]metrics.Entry{{Ident: "a", Metric: loaded}, {Ident: "b", Metric: metric(2, 1, saved)}})
+
+	snapshot, _ := store.Snapshot(context.Background())
+	if len(snapshot) != 2 || store.Stats().Idents != 2 {
+		t.Fatalf("Load: store holds %v, want 2 exporters of 2 idents", keys(snapshot))
+	}
+	for _, entry := range snapshot {
+		if entry.Ident != "a" {
+			continue
+		}
+		if entry.Metric.Previous == nil || entry.Metric.Previous.Protos[0].Flows != 5 || entry.Metric.Protos[0].Flows != 8 {
+			t.Errorf("loaded %+v, want 8 after 5", entry.Metric)
+		}
+		if !entry.Metric.LastUpdate.Equal(saved.Round(0)) {
+			t.Errorf("LastUpdate = %v, want the saved %v", entry.Metric.LastUpdate, saved)
+		}
+	}
+
+} // End of TestLoad
+
+// uniform returns a metric of exporter with all counters set to n
+func uniform(exporter, n uint64) metrics.Metric {
+	m := metrics.Metric{ExporterID: exporter, LastUpdate: time.Unix(0, int64(n))}
+	for proto := range m.Protos {
+		m.Protos[proto] = metrics.Counters{Flows: n, Packets: n, Bytes: n}
+	}
+	return m
+} // End of uniform
+
+// consistent reports, whether all counters of protos equal one value
+func consistent(protos [metrics.NumProtos]metrics.Counters) bool {
+	n := protos[0].Flows
+	for _, counters := range protos {
+		if counters != (metrics.Counters{Flows: n, Packets: n, Bytes: n}) {
+			return false
+		}
+	}
+	return true
+} // End of consistent
+
+// TestConcurrentUpdateSnapshot checks, that scrapes never see a half
+// written entry. Run it with -race.
+func TestConcurrentUpdateSnapshot(t *testing.T) {
+
+	const writers, updates = 4, 500
+
+	store := metrics.NewStore(metrics.Options{})
+	var reported sync.Map
+	fn := func(ident string, previous, current metrics.Metric) {
+		reported.Store(ident, current.Protos[0].Flows)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(ident string) {
+			defer wg.Done()
+			for n := uint64(1); n <= updates; n++ {
+				store.Update(ident, []metrics.Metric{uniform(1, n), uniform(2, n)}, fn)
+			}
+		}(fmt.Sprintf("w%d", w))
+	}
+
+	errs := make(chan string, 2)
+	var readers sync.WaitGroup
+	for _, snapshot := range []func(context.Context) ([]metrics.Entry, error){store.Snapshot, store.SnapshotChanged} {
+		readers.Add(1)
+		go func(snapshot func(context.Context) ([]metrics.Entry, error)) {
+			defer readers.Done()
+			for {
+				entries, _ := snapshot(context.Background())
+				for _, entry := range entries {
+					m := entry.Metric
+					if !consistent(m.Protos) || m.LastUpdate.UnixNano() != int64(m.Protos[0].Flows) {
+						errs <- fmt.Sprintf("%s/%d: inconsistent %+v", entry.Ident, m.ExporterID, m)
+						return
+					}
+					if m.Previous != nil && (!consistent(m.Previous.Protos) || m.Previous.Protos[0].Flows >= m.Protos[0].Flows) {
+						errs <- fmt.Sprintf("%s/%d: previous %+v of %+v", entry.Ident, m.ExporterID, m.Previous.Protos, m.Protos)
+						return
+					}
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}(snapshot)
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	snapshot, _ := store.Snapshot(context.Background())
+	if len(snapshot) != 2*writers {
+		t.Fatalf("Snapshot = %d entries, want %d", len(snapshot), 2*writers)
+	}
+	for _, entry := range snapshot {
+		if entry.Metric.Protos[0].Flows != updates {
+			t.Errorf("%s/%d: flows = %d, want %d", entry.Ident, entry.Metric.ExporterID, entry.Metric.Protos[0].Flows, updates)
+		}
+		// the last update reports the counters it replaced
+		if last, _ := reported.Load(entry.Ident); last != uint64(updates) {
+			t.Errorf("%s: last reported flows = %v, want %d", entry.Ident, last, updates)
+		}
+	}
+
+} // End of TestConcurrentUpdateSnapshot
+
+// within fails t, if f does not return within a second
+func within(t *testing.T, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s blocked by a running UpdateFunc", what)
+	}
+} // End of within
+
+// TestSlowUpdateFunc checks, that a blocked UpdateFunc blocks neither
+// scrapes nor other updates. The scrape expires exporters, so it takes
+// the write lock of the store.
+func TestSlowUpdateFunc(t *testing.T) {
+
+	store := metrics.NewStore(metrics.Options{})
+	exp := exporter.New(store, exporter.Options{TTL: time.Hour, ValueMode: exporter.ValueModeCounter})
+	now := time.Now()
+	store.Update("a", []metrics.Metric{metric(1, 1, now)}, nil)
+
+	// exporter 2 is new, so the update takes the write lock as well
+	called := make(chan struct{})
+	release := make(chan struct{})
+	go store.Update("a", []metrics.Metric{metric(1, 2, now), metric(2, 1, now)}, func(string, metrics.Metric, metrics.Metric) {
+		close(called)
+		<-release
+	})
+	defer close(release)
+	<-called
+
+	within(t, "Snapshot", func() {
+		snapshot, err := store.Snapshot(context.Background())
+		if err != nil || len(snapshot) != 2 {
+			t.Errorf("Snapshot = %+v, %v, want both exporters", snapshot, err)
+		}
+		for _, entry := range snapshot {
+			if entry.Metric.ExporterID == 1 && entry.Metric.Protos[0].Flows != 2 {
+				t.Errorf("Snapshot during UpdateFunc = %+v, want the updated counters", entry.Metric)
+			}
+		}
+	})
+	within(t, "Update of another ident", func() {
+		store.Update("b", []metrics.Metric{metric(1, 1, now)}, nil)
+	})
+	within(t, "Collect", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		ch := make(chan prometheus.Metric)
+		go func() {
+			for range ch {
+			}
+		}()
+		if err := exp.CollectWithContext(ctx, ch); err != nil {
+			t.Errorf("CollectWithContext = %v", err)
+		}
+		close(ch)
+	})
+
+} // End of TestSlowUpdateFunc
+
+// BenchmarkConcurrentUpdate updates 200 exporters of 10 idents from
+// parallel writers, while two scrapers take a snapshot every millisecond.
+// It reports the snapshots taken per update as well.
+func BenchmarkConcurrentUpdate(b *testing.B) {
+
+	const exporters, scrapers = 200, 2
+
+	store := metrics.NewStore(metrics.Options{})
+	now := time.Now()
+	idents := make([]string, exporters)
+	for id := range idents {
+		idents[id] = fmt.Sprintf("ident%d", id%10)
+		store.Update(idents[id], []metrics.Metric{metric(uint64(id), 1, now)}, nil)
+	}
+
+	done := make(chan struct{})
+	var snapshots atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < scrapers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				store.Snapshot(context.Background())
+				snapshots.Add(1)
+			}
+		}()
+	}
+
+	var next atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		message := make([]metrics.Metric, 1)
+		for pb.Next() {
+			n := next.Add(1)
+			id := n % exporters
+			message[0] = metric(id, n, now)
+			store.Update(idents[id], message, nil)
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+	b.ReportMetric(float64(snapshots.Load())/float64(b.N), "snapshots/op")
+
+} // End of BenchmarkConcurrentUpdate
@@ -0,0 +1,144 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+// Package nfsocktest simulates nfcapd for tests of the exporter: a Client
+// sends statistics to the metric socket in the format nfcapd uses.
+package nfsocktest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/protocol"
+)
+
+// DefaultVersion is the protocol version of the messages of a new Client
+const DefaultVersion uint8 = 1
+
+// Stats are the counters of one exporter per protocol
+type Stats struct {
+	TCP   metrics.Counters
+	UDP   metrics.Counters
+	ICMP  metrics.Counters
+	Other metrics.Counters
+}
+
+// protos returns the counters in the proto order of metrics
+func (s Stats) protos() [metrics.NumProtos]metrics.Counters {
+	var protos [metrics.NumProtos]metrics.Counters
+	protos[metrics.ProtoTCP] = s.TCP
+	protos[metrics.ProtoUDP] = s.UDP
+	protos[metrics.ProtoICMP] = s.ICMP
+	protos[metrics.ProtoOther] = s.Other
+	return protos
+} // End of protos
+
+// Client sends messages to the exporter like a collector
+type Client struct {
+	w    io.Writer
+	conn net.Conn
+	// Version is the protocol version of the messages, one of
+	// protocol.KnownVersions
+	Version uint8
+	// Start is the start of the simulated collector. The messages carry
+	// the seconds since Start as uptime.
+	Start time.Time
+}
+
+// Dial connects to the exporter socket at path. A leading @ connects to
+// an abstract socket.
+func Dial(path string) (*Client, error) {
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient(conn)
+	client.conn = conn
+	return client, nil
+
+} // End of Dial
+
+// NewClient returns a client, which writes the messages to w, e.g. to
+// stdout for -dry-run-socket
+func NewClient(w io.Writer) *Client {
+	return &Client{w: w, Version: DefaultVersion, Start: time.Now()}
+} // End of NewClient
+
+// SendStats sends the counters of one exporter of ident
+func (c *Client) SendStats(ident string, exporter uint64, stats Stats) error {
+	return c.SendMetrics(ident, []metrics.Metric{{ExporterID: exporter, Protos: stats.protos()}})
+} // End of SendStats
+
+// SendMetrics sends the counters of several exporters of ident in one
+// message
+func (c *Client) SendMetrics(ident string, list []metrics.Metric) error {
+
+	if !protocol.KnownVersion(int(c.Version)) {
+		return fmt.Errorf("protocol version %d not supported - known versions: %v", c.Version, protocol.KnownVersions())
+	}
+	if len(list) > (1<<16-1-protocol.MetricOffset)/protocol.MetricSize {
+		return fmt.Errorf("%d exporters do not fit into one message", len(list))
+	}
+	uptime := uint64(time.Since(c.Start).Seconds())
+	return c.write(protocol.EncodeMessage(ident, c.Version, uptime, list))
+
+} // End of SendMetrics
+
+// SendHeartbeat sends a message of ident without exporters. The exporter
+// counts it as message of ident, but updates no exporter.
+func (c *Client) SendHeartbeat(ident string) error {
+	return c.SendMetrics(ident, nil)
+} // End of SendHeartbeat
+
+// RemoveIdent sends the control message, which removes ident and all its
+// exporters
+func (c *Client) RemoveIdent(ident string) error {
+	return c.write(protocol.EncodeRemoveIdent(ident))
+} // End of RemoveIdent
+
+// Close closes the connection of a client of Dial. The writer of
+// NewClient is left open.
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+} // End of Close
+
+// write writes one message in one call, so messages of several
+// goroutines do not interleave on a connection
+func (c *Client) write(message []byte) error {
+	_, err := c.w.Write(message)
+	return err
+} // End of write
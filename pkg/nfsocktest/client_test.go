@@ -0,0 +1,187 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package nfsocktest_test
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/nfsocktest"
+	"nfsen_exporter/pkg/protocol"
+)
+
+// writes records each Write call
+type writes [][]byte
+
+func (w *writes) Write(b []byte) (int, error) {
+	*w = append(*w, append([]byte(nil), b...))
+	return len(b), nil
+} // End of Write
+
+func TestSendStats(t *testing.T) {
+
+	var w writes
+	client := nfsocktest.NewClient(&w)
+	client.Start = time.Now().Add(-90 * time.Second)
+	stats := nfsocktest.Stats{
+		TCP:   metrics.Counters{Flows: 1, Packets: 2, Bytes: 3},
+		UDP:   metrics.Counters{Flows: 4, Packets: 5, Bytes: 6},
+		ICMP:  metrics.Counters{Flows: 7, Packets: 8, Bytes: 9},
+		Other: metrics.Counters{Flows: 10, Packets: 11, Bytes: 12},
+	}
+	if err := client.SendStats("live", 3, stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(w) != 1 {
+		t.Fatalf("message written in %d calls, want 1", len(w))
+	}
+
+	// the exporter decodes what the client encodes
+	update, err := protocol.ParseMetricMessage(w[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Version != nfsocktest.DefaultVersion || update.Ident != "live" || update.Uptime != 90 {
+		t.Errorf("got version %d ident %q uptime %d, want %d \"live\" 90", update.Version, update.Ident, update.Uptime, nfsocktest.DefaultVersion)
+	}
+	if len(update.Metrics) != 1 || update.Metrics[0].ExporterID != 3 {
+		t.Fatalf("got metrics %+v, want exporter 3", update.Metrics)
+	}
+	want := map[metrics.Proto]metrics.Counters{
+		metrics.ProtoTCP:   stats.TCP,
+		metrics.ProtoUDP:   stats.UDP,
+		metrics.ProtoICMP:  stats.ICMP,
+		metrics.ProtoOther: stats.Other,
+	}
+	for proto, counters := range want {
+		if got := update.Metrics[0].Protos[proto]; got != counters {
+			t.Errorf("%s = %+v, want %+v", proto, got, counters)
+		}
+	}
+
+} // End of TestSendStats
+
+func TestSendHeartbeat(t *testing.T) {
+
+	var buf bytes.Buffer
+	if err := nfsocktest.NewClient(&buf).SendHeartbeat("live"); err != nil {
+		t.Fatal(err)
+	}
+	update, err := protocol.ParseMetricMessage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Ident != "live" || len(update.Metrics) != 0 {
+		t.Errorf("got ident %q with %d metrics, want \"live\" without", update.Ident, len(update.Metrics))
+	}
+
+} // End of TestSendHeartbeat
+
+func TestRemoveIdent(t *testing.T) {
+
+	var buf bytes.Buffer
+	if err := nfsocktest.NewClient(&buf).RemoveIdent("live"); err != nil {
+		t.Fatal(err)
+	}
+	control, err := protocol.ParseControlMessage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if control.Type != protocol.ControlRemoveIdent || control.Ident != "live" {
+		t.Errorf("got control %+v, want remove of \"live\"", control)
+	}
+
+} // End of TestRemoveIdent
+
+func TestSendErrors(t *testing.T) {
+
+	var w writes
+	client := nfsocktest.NewClient(&w)
+	client.Version = 9
+	if err := client.SendHeartbeat("live"); err == nil {
+		t.Error("unknown version 9 sent")
+	}
+	client.Version = nfsocktest.DefaultVersion
+	if err := client.SendMetrics("live", make([]metrics.Metric, 1<<16)); err == nil {
+		t.Error("message too large for the length field sent")
+	}
+	if len(w) != 0 {
+		t.Errorf("%d messages written, want none", len(w))
+	}
+
+} // End of TestSendErrors
+
+func TestDial(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "nfsen.sock")
+	if _, err := nfsocktest.Dial(path); err == nil {
+		t.Fatal("Dial without a socket succeeded")
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var buf bytes.Buffer
+		buf.ReadFrom(conn)
+		received <- buf.Bytes()
+	}()
+
+	client, err := nfsocktest.Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendStats("live", 1, nfsocktest.Stats{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	message := <-received
+	if version, err := protocol.HeaderVersion(message); err != nil || version != int(nfsocktest.DefaultVersion) {
+		t.Errorf("received version %d, %v, want %d", version, err, nfsocktest.DefaultVersion)
+	}
+	if _, err := protocol.ParseMetricMessage(message); err != nil {
+		t.Error(err)
+	}
+
+} // End of TestDial
@@ -0,0 +1,92 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * encode builds messages in the format nfcapd sends to the metric socket.
+ * It is the counterpart of parse and used by test clients.
+ */
+
+package protocol
+
+import (
+	"encoding/binary"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// EncodeMessage encodes the metrics of one ident as a message of the given
+// protocol version. An ident longer than the ident field is truncated.
+func EncodeMessage(ident string, version uint8, uptime uint64, list []metrics.Metric) []byte {
+
+	message := encodeHeader(PacketPrefix, version, ident, len(list))
+	binary.LittleEndian.PutUint64(message[16:24], uptime)
+
+	offset := MetricOffset
+	for _, m := range list {
+		// record layout: exporter id, flows, bytes and packets, each
+		// family in proto order
+		binary.LittleEndian.PutUint64(message[offset:], m.ExporterID)
+		for proto, counters := range m.Protos {
+			binary.LittleEndian.PutUint64(message[offset+8*(1+proto):], counters.Flows)
+			binary.LittleEndian.PutUint64(message[offset+8*(1+int(metrics.NumProtos)+proto):], counters.Bytes)
+			binary.LittleEndian.PutUint64(message[offset+8*(1+2*int(metrics.NumProtos)+proto):], counters.Packets)
+		}
+		offset += MetricSize
+	}
+	return message
+
+} // End of EncodeMessage
+
+// EncodeRemoveIdent encodes the control message, which removes ident
+// and all its exporters
+func EncodeRemoveIdent(ident string) []byte {
+	return encodeHeader(ControlPrefix, ControlRemoveIdent, ident, 0)
+} // End of EncodeRemoveIdent
+
+// encodeHeader allocates a message for numMetrics records and fills its
+// header. An ident longer than the ident field is truncated.
+func encodeHeader(prefix, version byte, ident string, numMetrics int) []byte {
+
+	size := MetricOffset + numMetrics*MetricSize
+	message := make([]byte, size)
+
+	message[0] = prefix
+	message[1] = version
+	binary.LittleEndian.PutUint16(message[2:4], uint16(size))
+	binary.LittleEndian.PutUint16(message[4:6], uint16(numMetrics))
+
+	// keep the terminating zero
+	if len(ident) >= IdentSize {
+		ident = ident[:IdentSize-1]
+	}
+	copy(message[IdentOffset:], ident)
+	return message
+
+} // End of encodeHeader
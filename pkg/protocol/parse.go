@@ -0,0 +1,311 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * parse decodes the messages nfcapd sends to the metric socket. Each
+ * protocol version has its own parser. The parsers check the length of a
+ * message before they allocate its metrics, so no length field can make
+ * them allocate more than the size of the message.
+ */
+
+// Package protocol decodes and encodes the messages of the nfcapd metric
+// socket, independent of the socket handler.
+package protocol
+
+/*
+
+#include <stdint.h>
+
+typedef struct metric_record_s {
+	// Ident
+	uint64_t	exporterID; // 32bit: exporter_id:16 engineType:8 engineID:*
+
+	// flow stat
+	uint64_t numflows_tcp;
+	uint64_t numflows_udp;
+	uint64_t numflows_icmp;
+	uint64_t numflows_other;
+	// bytes stat
+	uint64_t numbytes_tcp;
+	uint64_t numbytes_udp;
+	uint64_t numbytes_icmp;
+	uint64_t numbytes_other;
+	// packet stat
+	uint64_t numpackets_tcp;
+	uint64_t numpackets_udp;
+	uint64_t numpackets_icmp;
+	uint64_t numpackets_other;
+} metric_record_t;
+
+const int record_size = sizeof(metric_record_t);
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"unsafe"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// PacketPrefix is the first byte of each message
+const PacketPrefix byte = '@'
+
+// ControlPrefix is the first byte of a control message. It has the
+// header of a metric message without records, the second byte is the
+// control type instead of the version.
+const ControlPrefix byte = '!'
+
+// Control message types
+const (
+	// ControlRemoveIdent removes the ident and all its exporters
+	ControlRemoveIdent byte = 1
+)
+
+// message layout
+const (
+	// PreambleSize is the size of the prefix, the version and the size
+	// of the message, which select the parser
+	PreambleSize = 4
+	IdentOffset  = 24  // start of the zero terminated ident
+	IdentSize    = 128 // size of the ident field
+	MetricOffset = IdentOffset + IdentSize
+)
+
+// MetricSize is the size of one metric record in a message
+var MetricSize int = int(C.record_size)
+
+// MaxMetrics is the most metric records a message may hold. nfcapd sends
+// a record per exporter of its ident, so a larger count in the header
+// is rejected before the records are read.
+const MaxMetrics = 4096
+
+// DefaultVersion is the layout assumed for unknown versions by a socket
+// handler, which detects the version
+const DefaultVersion = 1
+
+// Parse errors. The errors of the parse functions wrap one of them with
+// the details, to be checked with errors.Is.
+var (
+	// ErrTruncated is returned for a message shorter than its header or
+	// its records
+	ErrTruncated = errors.New("message truncated")
+	// ErrMagic is returned for a message with a wrong prefix
+	ErrMagic = errors.New("bad message prefix")
+	// ErrVersion is returned for an unknown protocol version
+	ErrVersion = errors.New("unknown protocol version")
+	// ErrRange is returned for a field, which contradicts the size of the
+	// message, and for an unknown control type
+	ErrRange = errors.New("field out of range")
+)
+
+// MetricUpdate is a decoded metric message
+type MetricUpdate struct {
+	Version uint8
+	Ident   string
+	// Uptime is the uptime of the collector in seconds
+	Uptime uint64
+	// Metrics are the counters of each exporter of Ident. Their
+	// LastUpdate is the time of the parse.
+	Metrics []metrics.Metric
+}
+
+// ControlMessage is a decoded control message
+type ControlMessage struct {
+	// Type is the control type, e.g. ControlRemoveIdent
+	Type  byte
+	Ident string
+}
+
+// messageParser decodes the metric records of a message, which is
+// checked to hold numMetrics records
+type messageParser func(readBuf []byte, numMetrics int) []metrics.Metric
+
+// messageParsers holds a parser for each known protocol version
+var messageParsers = map[int]messageParser{
+	1: parseV1,
+}
+
+// KnownVersions returns the supported protocol versions in ascending order
+func KnownVersions() []int {
+	versions := make([]int, 0, len(messageParsers))
+	for version := range messageParsers {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+} // End of KnownVersions
+
+// KnownVersion tells, if version is a supported protocol version
+func KnownVersion(version int) bool {
+	_, ok := messageParsers[version]
+	return ok
+} // End of KnownVersion
+
+// HeaderVersion reads the protocol version from the preamble, the first
+// PreambleSize bytes of a metric message. For an unknown version, it
+// returns the version together with ErrVersion.
+func HeaderVersion(b []byte) (int, error) {
+
+	if len(b) < PreambleSize {
+		return 0, fmt.Errorf("%w: %d bytes too short for the preamble of %d bytes", ErrTruncated, len(b), PreambleSize)
+	}
+	// prefix:8 version:8 size:16, little endian
+	preamble := binary.LittleEndian.Uint32(b[:PreambleSize])
+	if prefix := byte(preamble); prefix != PacketPrefix {
+		return 0, fmt.Errorf("%w: got %U, want %U", ErrMagic, prefix, PacketPrefix)
+	}
+	version := int(byte(preamble >> 8))
+	if !KnownVersion(version) {
+		return version, fmt.Errorf("%w: %d - known versions: %v", ErrVersion, version, KnownVersions())
+	}
+	return version, nil
+
+} // End of HeaderVersion
+
+// ParseMetricMessage decodes a metric message with the protocol version
+// of its preamble
+func ParseMetricMessage(b []byte) (*MetricUpdate, error) {
+
+	version, err := HeaderVersion(b)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetricMessageVersion(b, version)
+
+} // End of ParseMetricMessage
+
+// ParseMetricMessageVersion decodes a metric message with the given
+// protocol version, regardless of the version of its header
+func ParseMetricMessageVersion(b []byte, version int) (*MetricUpdate, error) {
+
+	parser, ok := messageParsers[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d - known versions: %v", ErrVersion, version, KnownVersions())
+	}
+	numMetrics, err := checkMessage(b, PacketPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricUpdate{
+		Version: b[1],
+		Ident:   Ident(b),
+		Uptime:  binary.LittleEndian.Uint64(b[16:24]),
+		Metrics: parser(b, numMetrics),
+	}, nil
+
+} // End of ParseMetricMessageVersion
+
+// ParseControlMessage decodes a control message
+func ParseControlMessage(b []byte) (*ControlMessage, error) {
+
+	if _, err := checkMessage(b, ControlPrefix); err != nil {
+		return nil, err
+	}
+	switch b[1] {
+	case ControlRemoveIdent:
+	default:
+		return nil, fmt.Errorf("%w: unknown control type %d", ErrRange, b[1])
+	}
+	return &ControlMessage{Type: b[1], Ident: Ident(b)}, nil
+
+} // End of ParseControlMessage
+
+// Ident returns the zero terminated ident of a message, an empty ident
+// for a message shorter than its header
+func Ident(b []byte) string {
+
+	if len(b) < MetricOffset {
+		return ""
+	}
+	ilen := 0
+	for i := 0; i < IdentSize && b[IdentOffset+i] != 0; i++ {
+		ilen++
+	}
+	return string(b[IdentOffset : IdentOffset+ilen])
+
+} // End of Ident
+
+// checkMessage checks the prefix and the size of a message and returns
+// the number of its metric records
+func checkMessage(b []byte, prefix byte) (int, error) {
+
+	if len(b) < MetricOffset {
+		return 0, fmt.Errorf("%w: %d bytes too short for the header of %d bytes", ErrTruncated, len(b), MetricOffset)
+	}
+	if b[0] != prefix {
+		return 0, fmt.Errorf("%w: got %U, want %U", ErrMagic, b[0], prefix)
+	}
+	numMetrics := int(binary.LittleEndian.Uint16(b[4:6]))
+	if numMetrics > MaxMetrics {
+		return 0, fmt.Errorf("%w: %d metrics exceed the maximum of %d", ErrRange, numMetrics, MaxMetrics)
+	}
+	size := MetricOffset + numMetrics*MetricSize
+	if len(b) < size {
+		return 0, fmt.Errorf("%w: %d bytes too short for %d metrics", ErrTruncated, len(b), numMetrics)
+	}
+	if len(b) > size {
+		return 0, fmt.Errorf("%w: %d bytes exceed %d metrics", ErrRange, len(b), numMetrics)
+	}
+	return numMetrics, nil
+
+} // End of checkMessage
+
+// parseV1 decodes the message layout of nfcapd 1.7
+func parseV1(readBuf []byte, numMetrics int) []metrics.Metric {
+
+	// payloadSize := int(binary.LittleEndian.Uint16(readBuf[2:4]))
+	// collectorID	:= int(binary.LittleEndian.Uint64(readBuf[8:16]))
+	list := make([]metrics.Metric, numMetrics)
+	now := time.Now()
+	offset := MetricOffset
+	for num := range list {
+		metric := &list[num]
+		var s *C.metric_record_t = (*C.metric_record_t)(unsafe.Pointer(&readBuf[offset]))
+		metric.ExporterID = uint64(s.exporterID)
+		metric.Protos[metrics.ProtoTCP] = metrics.Counters{
+			Flows: uint64(s.numflows_tcp), Packets: uint64(s.numpackets_tcp), Bytes: uint64(s.numbytes_tcp)}
+		metric.Protos[metrics.ProtoUDP] = metrics.Counters{
+			Flows: uint64(s.numflows_udp), Packets: uint64(s.numpackets_udp), Bytes: uint64(s.numbytes_udp)}
+		metric.Protos[metrics.ProtoICMP] = metrics.Counters{
+			Flows: uint64(s.numflows_icmp), Packets: uint64(s.numpackets_icmp), Bytes: uint64(s.numbytes_icmp)}
+		metric.Protos[metrics.ProtoOther] = metrics.Counters{
+			Flows: uint64(s.numflows_other), Packets: uint64(s.numpackets_other), Bytes: uint64(s.numbytes_other)}
+
+		metric.LastUpdate = now
+		offset += MetricSize
+	}
+	return list
+
+} // End of parseV1
@@ -0,0 +1,259 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package protocol_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/protocol"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata with EncodeMessage")
+
+// goldenMessage is a message in testdata and its decoded content
+type goldenMessage struct {
+	file    string
+	version uint8
+	ident   string
+	uptime  uint64
+	metrics []metrics.Metric
+}
+
+// testMetric returns a metric of exporter, whose counters all differ
+func testMetric(exporter uint64, base uint64) metrics.Metric {
+	metric := metrics.Metric{ExporterID: exporter}
+	for proto := range metric.Protos {
+		p := uint64(proto)
+		metric.Protos[proto] = metrics.Counters{Flows: base + 10*p + 1, Packets: base + 10*p + 2, Bytes: base + 10*p + 3}
+	}
+	return metric
+} // End of testMetric
+
+// goldenMessages holds at least one message of each known version
+var goldenMessages = []goldenMessage{
+	{file: "v1.bin", version: 1, ident: "nfcapd-live", uptime: 3600,
+		metrics: []metrics.Metric{testMetric(1, 1000), testMetric(0x0a000001, 1<<40)}},
+	{file: "v1-empty.bin", version: 1, ident: "idle", uptime: 1},
+}
+
+func TestGoldenMessages(t *testing.T) {
+
+	tested := make(map[int]bool)
+	for _, golden := range goldenMessages {
+		t.Run(golden.file, func(t *testing.T) {
+			path := filepath.Join("testdata", golden.file)
+			encoded := protocol.EncodeMessage(golden.ident, golden.version, golden.uptime, golden.metrics)
+			if *update {
+				if err := os.WriteFile(path, encoded, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			message, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v - run go test with -update to create it", err)
+			}
+			if !bytes.Equal(message, encoded) {
+				t.Errorf("EncodeMessage differs from %s", path)
+			}
+
+			update, err := protocol.ParseMetricMessage(message)
+			if err != nil {
+				t.Fatalf("ParseMetricMessage: %v", err)
+			}
+			if update.Version != golden.version || update.Ident != golden.ident || update.Uptime != golden.uptime {
+				t.Errorf("header: got version %d, ident %q, uptime %d, want %d, %q, %d",
+					update.Version, update.Ident, update.Uptime, golden.version, golden.ident, golden.uptime)
+			}
+			if len(update.Metrics) != len(golden.metrics) {
+				t.Fatalf("got %d metrics, want %d", len(update.Metrics), len(golden.metrics))
+			}
+			for i, metric := range update.Metrics {
+				if metric.ExporterID != golden.metrics[i].ExporterID || metric.Protos != golden.metrics[i].Protos {
+					t.Errorf("metric %d: got %+v, want %+v", i, metric.Protos, golden.metrics[i].Protos)
+				}
+				if metric.LastUpdate.IsZero() {
+					t.Errorf("metric %d: LastUpdate not set", i)
+				}
+			}
+			tested[int(golden.version)] = true
+		})
+	}
+	for _, version := range protocol.KnownVersions() {
+		if !tested[version] {
+			t.Errorf("version %d: no golden message in testdata", version)
+		}
+	}
+
+} // End of TestGoldenMessages
+
+func TestHeaderVersion(t *testing.T) {
+
+	message, err := os.ReadFile(filepath.Join("testdata", "v1.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withByte := func(i int, b byte) []byte {
+		changed := bytes.Clone(message)
+		changed[i] = b
+		return changed
+	}
+
+	cases := []struct {
+		name    string
+		message []byte
+		version int
+		err     error
+	}{
+		{"v1", message, 1, nil},
+		{"v1 preamble only", message[:protocol.PreambleSize], 1, nil},
+		{"empty", nil, 0, protocol.ErrTruncated},
+		{"short preamble", message[:protocol.PreambleSize-1], 0, protocol.ErrTruncated},
+		{"control prefix", withByte(0, protocol.ControlPrefix), 0, protocol.ErrMagic},
+		{"version 0", withByte(1, 0), 0, protocol.ErrVersion},
+		{"version 2", withByte(1, 2), 2, protocol.ErrVersion},
+		{"version 3", withByte(1, 3), 3, protocol.ErrVersion},
+		{"version 255", withByte(1, 255), 255, protocol.ErrVersion},
+	}
+	for _, c := range cases {
+		version, err := protocol.HeaderVersion(c.message)
+		if version != c.version || !errors.Is(err, c.err) {
+			t.Errorf("%s: HeaderVersion = %d, %v, want %d, %v", c.name, version, err, c.version, c.err)
+		}
+	}
+
+} // End of TestHeaderVersion
+
+// TestTooManyMetrics parses a header with more than MaxMetrics records,
+// which must be rejected as ErrRange without reading them
+func TestTooManyMetrics(t *testing.T) {
+
+	message := protocol.EncodeMessage("live", 1, 0, nil)
+	binary.LittleEndian.PutUint16(message[4:6], protocol.MaxMetrics+1)
+	if _, err := protocol.ParseMetricMessage(message); !errors.Is(err, protocol.ErrRange) {
+		t.Errorf("ParseMetricMessage = %v, want ErrRange", err)
+	}
+
+} // End of TestTooManyMetrics
+
+func TestUnknownVersion(t *testing.T) {
+
+	message, err := os.ReadFile(filepath.Join("testdata", "v1.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []int{0, 2, 3, 255} {
+		if protocol.KnownVersion(version) {
+			continue
+		}
+		changed := bytes.Clone(message)
+		changed[1] = byte(version)
+		if _, err := protocol.ParseMetricMessage(changed); !errors.Is(err, protocol.ErrVersion) {
+			t.Errorf("ParseMetricMessage of version %d: got %v, want ErrVersion", version, err)
+		}
+		if _, err := protocol.ParseMetricMessageVersion(message, version); !errors.Is(err, protocol.ErrVersion) {
+			t.Errorf("ParseMetricMessageVersion %d: got %v, want ErrVersion", version, err)
+		}
+	}
+
+	// an explicit version ignores the header
+	changed := bytes.Clone(message)
+	changed[1] = 2
+	update, err := protocol.ParseMetricMessageVersion(changed, 1)
+	if err != nil {
+		t.Fatalf("ParseMetricMessageVersion 1 of a version 2 header: %v", err)
+	}
+	if want := goldenMessages[0].metrics[1].Protos; !reflect.DeepEqual(update.Metrics[1].Protos, want) {
+		t.Errorf("got %+v, want %+v", update.Metrics[1].Protos, want)
+	}
+
+} // End of TestUnknownVersion
+
+// FuzzParseMetricMessage decodes arbitrary input. The parser must not
+// panic and must fail with one of its errors only. A decoded message
+// must encode to the same records again.
+func FuzzParseMetricMessage(f *testing.F) {
+
+	for _, golden := range goldenMessages {
+		f.Add(protocol.EncodeMessage(golden.ident, golden.version, golden.uptime, golden.metrics))
+	}
+	valid := protocol.EncodeMessage("live", 1, 60, []metrics.Metric{testMetric(1, 1000), testMetric(2, 2000)})
+	modified := func(modify func(b []byte)) []byte {
+		b := append([]byte(nil), valid...)
+		modify(b)
+		return b
+	}
+	f.Add([]byte{})
+	f.Add(valid[:protocol.PreambleSize-1])
+	f.Add(valid[:protocol.MetricOffset-1])
+	f.Add(valid[:len(valid)-1])
+	f.Add(append(append([]byte(nil), valid...), 0))
+	f.Add(modified(func(b []byte) { b[0] = '#' }))
+	f.Add(modified(func(b []byte) { b[1] = 7 }))
+	f.Add(modified(func(b []byte) { b[4], b[5] = 0xff, 0xff }))
+	f.Add(protocol.EncodeRemoveIdent("live"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		update, err := protocol.ParseMetricMessage(b)
+		if err != nil {
+			if update != nil {
+				t.Errorf("got update %+v with error %v", update, err)
+			}
+			for _, known := range []error{protocol.ErrTruncated, protocol.ErrMagic, protocol.ErrVersion, protocol.ErrRange} {
+				if errors.Is(err, known) {
+					return
+				}
+			}
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		again, err := protocol.ParseMetricMessage(protocol.EncodeMessage(update.Ident, update.Version, update.Uptime, update.Metrics))
+		if err != nil {
+			t.Fatalf("decoded message does not encode: %v", err)
+		}
+		if len(again.Metrics) != len(update.Metrics) {
+			t.Fatalf("encoded %d metrics, decoded %d", len(update.Metrics), len(again.Metrics))
+		}
+		for i, metric := range update.Metrics {
+			if again.Metrics[i].ExporterID != metric.ExporterID || again.Metrics[i].Protos != metric.Protos {
+				t.Errorf("metric %d encoded as %+v, decoded %+v", i, metric, again.Metrics[i])
+			}
+		}
+	})
+
+} // End of FuzzParseMetricMessage
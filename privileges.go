@@ -0,0 +1,195 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * privileges drops root privileges after start: the collector socket and
+ * the HTTP listeners are bound as root, e.g. for a socket in /run or a
+ * port below 1024, then the exporter continues as -run-as-user and
+ * -run-as-group.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/user"
+	"strconv"
+)
+
+// identitySystem makes the system calls of the privilege drop. It is
+// implemented by systemIdentity of the platform.
+type identitySystem interface {
+	lchown(path string, uid, gid int) error
+	setgroups(gids []int) error
+	setgid(gid int) error
+	setuid(uid int) error
+	getresuid() (ruid, euid, suid int)
+	getresgid() (rgid, egid, sgid int)
+	getgroups() ([]int, error)
+}
+
+// identity is the user and group, the exporter runs as after the drop
+type identity struct {
+	user  string
+	group string
+	uid   int
+	gid   int
+}
+
+func (id identity) String() string {
+	return fmt.Sprintf("%s(%d):%s(%d)", id.user, id.uid, id.group, id.gid)
+} // End of String
+
+// lookupIdentity resolves the names or numeric IDs of userName and
+// groupName. Without groupName, the primary group of the user is used.
+func lookupIdentity(userName, groupName string) (identity, error) {
+
+	u, err := lookupUser(userName)
+	if err != nil {
+		return identity{}, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return identity{}, fmt.Errorf("user %s: uid %s is not numeric", userName, u.Uid)
+	}
+
+	var g *user.Group
+	if groupName != "" {
+		g, err = lookupGroup(groupName)
+	} else {
+		g, err = user.LookupGroupId(u.Gid)
+	}
+	if err != nil {
+		return identity{}, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return identity{}, fmt.Errorf("group %s: gid %s is not numeric", g.Name, g.Gid)
+	}
+
+	return identity{user: u.Username, group: g.Name, uid: uid, gid: gid}, nil
+
+} // End of lookupIdentity
+
+// lookupUser finds a user by name, or by uid for a numeric name
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if _, isUnknown := err.(user.UnknownUserError); isUnknown {
+		if _, convErr := strconv.Atoi(name); convErr == nil {
+			return user.LookupId(name)
+		}
+	}
+	return u, err
+} // End of lookupUser
+
+// lookupGroup finds a group by name, or by gid for a numeric name
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if _, isUnknown := err.(user.UnknownGroupError); isUnknown {
+		if _, convErr := strconv.Atoi(name); convErr == nil {
+			return user.LookupGroupId(name)
+		}
+	}
+	return g, err
+} // End of lookupGroup
+
+// dropPrivileges hands paths, the socket file and the directories created
+// for it, to id and switches the process to id afterwards. The order
+// matters: once the user is changed, paths can no longer be chowned.
+func dropPrivileges(sys identitySystem, id identity, paths []string) error {
+
+	for _, path := range paths {
+		if err := sys.lchown(path, id.uid, id.gid); err != nil {
+			return fmt.Errorf("chown: %w", err)
+		}
+	}
+	if err := switchIdentity(sys, id.uid, id.gid); err != nil {
+		return err
+	}
+	log.Printf("Dropped privileges, running as %s\n", id)
+	return nil
+
+} // End of dropPrivileges
+
+// switchIdentity sets the supplementary groups, the group and the user,
+// in this order, as only root may change the groups. It verifies
+// afterwards, that root cannot be regained.
+func switchIdentity(sys identitySystem, uid, gid int) error {
+
+	if err := sys.setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := sys.setgid(gid); err != nil {
+		return err
+	}
+	if err := sys.setuid(uid); err != nil {
+		return err
+	}
+	return verifyIdentity(sys, uid, gid)
+
+} // End of switchIdentity
+
+// verifyIdentity checks the real, effective and saved IDs and the
+// supplementary groups, and that setuid(0) and setgid(0) fail
+func verifyIdentity(sys identitySystem, uid, gid int) error {
+
+	if ruid, euid, suid := sys.getresuid(); ruid != uid || euid != uid || suid != uid {
+		return fmt.Errorf("uid is %d/%d/%d, not %d", ruid, euid, suid, uid)
+	}
+	if rgid, egid, sgid := sys.getresgid(); rgid != gid || egid != gid || sgid != gid {
+		return fmt.Errorf("gid is %d/%d/%d, not %d", rgid, egid, sgid, gid)
+	}
+	groups, err := sys.getgroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if group != gid {
+			return fmt.Errorf("still member of group %d", group)
+		}
+	}
+
+	// root may always switch back
+	if uid == 0 {
+		return nil
+	}
+	if err := sys.setuid(0); err == nil {
+		return errors.New("setuid(0) succeeded after the drop")
+	}
+	if gid != 0 {
+		if err := sys.setgid(0); err == nil {
+			return errors.New("setgid(0) succeeded after the drop")
+		}
+	}
+	return nil
+
+} // End of verifyIdentity
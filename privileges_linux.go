@@ -0,0 +1,73 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// systemIdentity changes the IDs of all threads of the process
+var systemIdentity identitySystem = linuxIdentity{}
+
+// linuxIdentity makes the system calls of the privilege drop on Linux
+type linuxIdentity struct{}
+
+func (linuxIdentity) lchown(path string, uid, gid int) error {
+	return os.Lchown(path, uid, gid)
+} // End of lchown
+
+func (linuxIdentity) setgroups(gids []int) error {
+	return os.NewSyscallError("setgroups", syscall.Setgroups(gids))
+} // End of setgroups
+
+func (linuxIdentity) setgid(gid int) error {
+	return os.NewSyscallError("setgid", syscall.Setgid(gid))
+} // End of setgid
+
+func (linuxIdentity) setuid(uid int) error {
+	return os.NewSyscallError("setuid", syscall.Setuid(uid))
+} // End of setuid
+
+func (linuxIdentity) getresuid() (ruid, euid, suid int) {
+	return unix.Getresuid()
+} // End of getresuid
+
+func (linuxIdentity) getresgid() (rgid, egid, sgid int) {
+	return unix.Getresgid()
+} // End of getresgid
+
+func (linuxIdentity) getgroups() ([]int, error) {
+	groups, err := syscall.Getgroups()
+	return groups, os.NewSyscallError("getgroups", err)
+} // End of getgroups
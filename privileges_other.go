@@ -0,0 +1,74 @@
+//go:build !linux
+
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+)
+
+// errPrivilegesUnsupported is returned by all calls of unsupportedIdentity
+var errPrivilegesUnsupported = errors.New("dropping privileges is supported on Linux only")
+
+// systemIdentity fails, as dropping privileges is implemented for Linux
+// only
+var systemIdentity identitySystem = unsupportedIdentity{}
+
+type unsupportedIdentity struct{}
+
+func (unsupportedIdentity) lchown(path string, uid, gid int) error {
+	return errPrivilegesUnsupported
+} // End of lchown
+
+func (unsupportedIdentity) setgroups(gids []int) error {
+	return errPrivilegesUnsupported
+} // End of setgroups
+
+func (unsupportedIdentity) setgid(gid int) error {
+	return errPrivilegesUnsupported
+} // End of setgid
+
+func (unsupportedIdentity) setuid(uid int) error {
+	return errPrivilegesUnsupported
+} // End of setuid
+
+func (unsupportedIdentity) getresuid() (ruid, euid, suid int) {
+	return -1, -1, -1
+} // End of getresuid
+
+func (unsupportedIdentity) getresgid() (rgid, egid, sgid int) {
+	return -1, -1, -1
+} // End of getresgid
+
+func (unsupportedIdentity) getgroups() ([]int, error) {
+	return nil, errPrivilegesUnsupported
+} // End of getgroups
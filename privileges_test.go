@@ -0,0 +1,176 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeIdentity records the calls of the privilege drop and simulates
+// the IDs of a process, which starts as root
+type fakeIdentity struct {
+	calls            []string
+	ruid, euid, suid int
+	rgid, egid, sgid int
+	groups           []int
+	// fail fails the call of this name
+	fail string
+	// keepSaved leaves the saved uid unchanged, like setreuid
+	keepSaved bool
+	// regain lets setuid(0) succeed as unprivileged user
+	regain bool
+}
+
+func newFakeIdentity() *fakeIdentity {
+	return &fakeIdentity{groups: []int{0, 4, 27}}
+} // End of newFakeIdentity
+
+// call records a call and returns the error of fail
+func (f *fakeIdentity) call(name string, args ...interface{}) error {
+	f.calls = append(f.calls, fmt.Sprint(append([]interface{}{name}, args...)...))
+	if f.fail == name {
+		return fmt.Errorf("%s: %w", name, syscall.EPERM)
+	}
+	return nil
+} // End of call
+
+func (f *fakeIdentity) lchown(path string, uid, gid int) error {
+	return f.call("lchown", " ", path)
+} // End of lchown
+
+func (f *fakeIdentity) setgroups(gids []int) error {
+	if err := f.call("setgroups", " ", gids); err != nil {
+		return err
+	}
+	if f.euid != 0 {
+		return syscall.EPERM
+	}
+	f.groups = gids
+	return nil
+} // End of setgroups
+
+func (f *fakeIdentity) setgid(gid int) error {
+	if err := f.call("setgid", " ", gid); err != nil {
+		return err
+	}
+	if f.euid != 0 {
+		return syscall.EPERM
+	}
+	f.rgid, f.egid, f.sgid = gid, gid, gid
+	return nil
+} // End of setgid
+
+func (f *fakeIdentity) setuid(uid int) error {
+	if err := f.call("setuid", " ", uid); err != nil {
+		return err
+	}
+	if f.euid != 0 && !f.regain {
+		return syscall.EPERM
+	}
+	f.ruid, f.euid = uid, uid
+	if !f.keepSaved {
+		f.suid = uid
+	}
+	return nil
+} // End of setuid
+
+func (f *fakeIdentity) getresuid() (ruid, euid, suid int) {
+	f.call("getresuid")
+	return f.ruid, f.euid, f.suid
+} // End of getresuid
+
+func (f *fakeIdentity) getresgid() (rgid, egid, sgid int) {
+	f.call("getresgid")
+	return f.rgid, f.egid, f.sgid
+} // End of getresgid
+
+func (f *fakeIdentity) getgroups() ([]int, error) {
+	return f.groups, f.call("getgroups")
+} // End of getgroups
+
+func TestDropPrivileges(t *testing.T) {
+
+	id := identity{user: "nfsen", group: "nfsen", uid: 1000, gid: 1001}
+	paths := []string{"/run/nfsen", "/run/nfsen/nfsen.sock"}
+	dropped := []string{
+		"lchown /run/nfsen", "lchown /run/nfsen/nfsen.sock",
+		"setgroups [1001]", "setgid 1001", "setuid 1000",
+		"getresuid", "getresgid", "getgroups",
+		"setuid 0", "setgid 0",
+	}
+	cases := []struct {
+		name   string
+		modify func(f *fakeIdentity)
+		// calls is the number of calls of dropped, which are made
+		calls int
+		want  string
+	}{
+		{"dropped", func(f *fakeIdentity) {}, len(dropped), ""},
+		{"chown fails", func(f *fakeIdentity) { f.fail = "lchown" }, 1, "chown: lchown"},
+		{"setgroups fails", func(f *fakeIdentity) { f.fail = "setgroups" }, 3, "setgroups"},
+		{"setgid fails", func(f *fakeIdentity) { f.fail = "setgid" }, 4, "setgid"},
+		{"setuid fails", func(f *fakeIdentity) { f.fail = "setuid" }, 5, "setuid"},
+		{"saved uid kept", func(f *fakeIdentity) { f.keepSaved = true }, 6, "uid is 1000/1000/0, not 1000"},
+		{"getgroups fails", func(f *fakeIdentity) { f.fail = "getgroups" }, 8, "getgroups"},
+		{"root regained", func(f *fakeIdentity) { f.regain = true }, 9, "setuid(0) succeeded after the drop"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeIdentity()
+			c.modify(f)
+			err := dropPrivileges(f, id, paths)
+			if !reflect.DeepEqual(f.calls, dropped[:c.calls]) {
+				t.Errorf("calls %q, want %q", f.calls, dropped[:c.calls])
+			}
+			switch {
+			case c.want == "" && err != nil:
+				t.Errorf("dropPrivileges = %v, want nil", err)
+			case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+				t.Errorf("dropPrivileges = %v, want %q", err, c.want)
+			}
+		})
+	}
+
+} // End of TestDropPrivileges
+
+// TestVerifyIdentityGroups fails for a supplementary group left over
+func TestVerifyIdentityGroups(t *testing.T) {
+
+	f := &fakeIdentity{ruid: 1000, euid: 1000, suid: 1000, rgid: 1001, egid: 1001, sgid: 1001, groups: []int{1001, 27}}
+	if err := verifyIdentity(f, 1000, 1001); err == nil || err.Error() != "still member of group 27" {
+		t.Errorf("verifyIdentity = %v, want group 27", err)
+	}
+
+} // End of TestVerifyIdentityGroups
@@ -0,0 +1,117 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * push pushes the gathered metrics to a Prometheus Pushgateway, for
+ * collector hosts, which Prometheus cannot scrape, e.g. behind NAT.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// pushFirstBackoff is the delay before the first retry of a failed push.
+// It doubles with each retry, until the next push is due.
+const pushFirstBackoff = time.Second
+
+var pushFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "exporter",
+	Name:      "push_failures_total",
+	Help:      "How many pushes to the Pushgateway failed, including retries.",
+})
+
+// runPush pushes the metrics of exp to the Pushgateway at url every
+// interval until ctx is done. The metrics are grouped by job and the
+// host name as instance. A failed push is retried with backoff.
+func runPush(ctx context.Context, exp *exporter.Exporter, url, job string, interval time.Duration) {
+
+	instance, _ := os.Hostname()
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deadline := time.Now().Add(interval)
+		backoff := pushFirstBackoff
+		for {
+			err := pushMetrics(ctx, client, exp, url, job, instance)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			pushFailures.Inc()
+			// the next push is due before the retry
+			if time.Now().Add(backoff).After(deadline) {
+				log.Printf("Push to %s failed: %v\n", url, err)
+				break
+			}
+			log.Printf("Push to %s failed, retry in %v: %v\n", url, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+
+} // End of runPush
+
+// pushMetrics gathers the metrics once and replaces the group of job and
+// instance on the Pushgateway with them
+func pushMetrics(ctx context.Context, client *http.Client, exp *exporter.Exporter, url, job, instance string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	return push.New(url, job).
+		Gatherer(outputGatherer(ctx, exp)).
+		Grouping("instance", instance).
+		Client(client).
+		PushContext(ctx)
+
+} // End of pushMetrics
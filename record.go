@@ -0,0 +1,207 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * record is the JSON representation of the metric of one exporter, used
+ * by the send subcommand and the state file, and of the message of an
+ * ident, published by the Kafka and MQTT outputs.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// metricRecord is the statistic of one exporter together with its ident
+type metricRecord struct {
+	Ident    string `json:"ident"`
+	Exporter uint64 `json:"exporter"`
+	counterRecord
+}
+
+// counterRecord holds the counters of all protocols
+type counterRecord struct {
+	FlowsTCP     uint64 `json:"flows_tcp"`
+	FlowsUDP     uint64 `json:"flows_udp"`
+	FlowsICMP    uint64 `json:"flows_icmp"`
+	FlowsOther   uint64 `json:"flows_other"`
+	BytesTCP     uint64 `json:"bytes_tcp"`
+	BytesUDP     uint64 `json:"bytes_udp"`
+	BytesICMP    uint64 `json:"bytes_icmp"`
+	BytesOther   uint64 `json:"bytes_other"`
+	PacketsTCP   uint64 `json:"packets_tcp"`
+	PacketsUDP   uint64 `json:"packets_udp"`
+	PacketsICMP  uint64 `json:"packets_icmp"`
+	PacketsOther uint64 `json:"packets_other"`
+}
+
+// intervalRecord is the message of an ident: the counters of all its
+// exporters and their deltas to the previous message
+type intervalRecord struct {
+	Ident     string                   `json:"ident"`
+	Time      time.Time                `json:"time"`
+	Exporters []exporterIntervalRecord `json:"exporters"`
+}
+
+type exporterIntervalRecord struct {
+	Exporter uint64         `json:"exporter"`
+	Counters counterRecord  `json:"counters"`
+	Deltas   *counterRecord `json:"deltas,omitempty"`
+}
+
+// deltaRecorder collects the deltas of the exporters of the message being
+// processed, per ident, until the message is complete
+type deltaRecorder struct {
+	mutex  sync.Mutex
+	deltas map[string]map[uint64]counterRecord
+}
+
+func newDeltaRecorder() *deltaRecorder {
+	return &deltaRecorder{deltas: make(map[string]map[uint64]counterRecord)}
+} // End of newDeltaRecorder
+
+// update keeps the deltas of an exporter for the message of ident. A
+// decreased counter counts from 0 after a reset of nfcapd. It is a
+// metrics.UpdateFunc.
+func (d *deltaRecorder) update(ident string, previous, current metrics.Metric) {
+
+	var deltas [metrics.NumProtos]metrics.Counters
+	for proto, after := range current.Protos {
+		deltas[proto] = metrics.Counters{
+			Flows:   counterDelta(previous.Protos[proto].Flows, after.Flows),
+			Packets: counterDelta(previous.Protos[proto].Packets, after.Packets),
+			Bytes:   counterDelta(previous.Protos[proto].Bytes, after.Bytes),
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	exporters, ok := d.deltas[ident]
+	if !ok {
+		exporters = make(map[uint64]counterRecord)
+		d.deltas[ident] = exporters
+	}
+	exporters[current.ExporterID] = newCounterRecord(deltas)
+
+} // End of update
+
+// interval returns the record of the message of ident with the deltas
+// collected by update and removes them
+func (d *deltaRecorder) interval(ident string, list []metrics.Metric) intervalRecord {
+
+	d.mutex.Lock()
+	deltas := d.deltas[ident]
+	delete(d.deltas, ident)
+	d.mutex.Unlock()
+
+	interval := intervalRecord{
+		Ident:     ident,
+		Time:      time.Now().UTC(),
+		Exporters: make([]exporterIntervalRecord, 0, len(list)),
+	}
+	for _, metric := range list {
+		record := exporterIntervalRecord{
+			Exporter: metric.ExporterID,
+			Counters: newCounterRecord(metric.Protos),
+		}
+		if d, ok := deltas[metric.ExporterID]; ok {
+			record.Deltas = &d
+		}
+		interval.Exporters = append(interval.Exporters, record)
+	}
+	if len(list) > 0 {
+		interval.Time = list[0].LastUpdate.UTC()
+	}
+	return interval
+
+} // End of interval
+
+// newMetricRecord converts the metric of an ident to a record
+func newMetricRecord(ident string, metric metrics.Metric) metricRecord {
+	return metricRecord{
+		Ident:         ident,
+		Exporter:      metric.ExporterID,
+		counterRecord: newCounterRecord(metric.Protos),
+	}
+} // End of newMetricRecord
+
+// metric converts the record back to a metric
+func (r metricRecord) metric() metrics.Metric {
+	return metrics.Metric{
+		ExporterID: r.Exporter,
+		Protos:     r.counterRecord.protos(),
+	}
+} // End of metric
+
+// newCounterRecord converts the counters per proto to a record
+func newCounterRecord(protos [metrics.NumProtos]metrics.Counters) counterRecord {
+	tcp := protos[metrics.ProtoTCP]
+	udp := protos[metrics.ProtoUDP]
+	icmp := protos[metrics.ProtoICMP]
+	other := protos[metrics.ProtoOther]
+	return counterRecord{
+		FlowsTCP:     tcp.Flows,
+		FlowsUDP:     udp.Flows,
+		FlowsICMP:    icmp.Flows,
+		FlowsOther:   other.Flows,
+		BytesTCP:     tcp.Bytes,
+		BytesUDP:     udp.Bytes,
+		BytesICMP:    icmp.Bytes,
+		BytesOther:   other.Bytes,
+		PacketsTCP:   tcp.Packets,
+		PacketsUDP:   udp.Packets,
+		PacketsICMP:  icmp.Packets,
+		PacketsOther: other.Packets,
+	}
+} // End of newCounterRecord
+
+// protos converts the record back to counters per proto
+func (r counterRecord) protos() [metrics.NumProtos]metrics.Counters {
+	var protos [metrics.NumProtos]metrics.Counters
+	protos[metrics.ProtoTCP] = metrics.Counters{Flows: r.FlowsTCP, Packets: r.PacketsTCP, Bytes: r.BytesTCP}
+	protos[metrics.ProtoUDP] = metrics.Counters{Flows: r.FlowsUDP, Packets: r.PacketsUDP, Bytes: r.BytesUDP}
+	protos[metrics.ProtoICMP] = metrics.Counters{Flows: r.FlowsICMP, Packets: r.PacketsICMP, Bytes: r.BytesICMP}
+	protos[metrics.ProtoOther] = metrics.Counters{Flows: r.FlowsOther, Packets: r.PacketsOther, Bytes: r.BytesOther}
+	return protos
+} // End of protos
+
+// counterDelta returns the increase from before to after, after itself,
+// if the counter was reset in between
+func counterDelta(before, after uint64) uint64 {
+	if after < before {
+		return after
+	}
+	return after - before
+} // End of counterDelta
@@ -0,0 +1,310 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * recording appends the raw collector messages to a file with
+ * -record-file, so the traffic of a production collector can be replayed
+ * into a test exporter with the replay subcommand.
+ *
+ * The file starts with the magic NFXREC and the format version as uint16.
+ * Each message follows in an envelope of the receive time in unix
+ * nanoseconds as uint64, the number of its connection as uint64 and its
+ * length as uint32. All integers are little endian.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/protocol"
+)
+
+const (
+	recordMagic   = "NFXREC"
+	recordVersion = 1
+
+	recordHeaderSize   = len(recordMagic) + 2
+	recordEnvelopeSize = 8 + 8 + 4
+)
+
+// recordMaxMessage is the size of a message with the most records
+var recordMaxMessage = uint32(protocol.MetricOffset + (1<<16-1)*protocol.MetricSize)
+
+var recordFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "exporter",
+	Name:      "record_failures_total",
+	Help:      "How many messages were not written to the record file.",
+})
+
+// recordedMessage is a message of a record file
+type recordedMessage struct {
+	Time time.Time
+	// Conn is the number of the connection of the message, 0 for stdin
+	Conn    uint64
+	Message []byte
+}
+
+// messageRecorder appends the messages to the record file
+type messageRecorder struct {
+	mutex  sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	failed bool
+	// connBase is added to the connection numbers, so they continue the
+	// numbers of earlier runs in the file
+	connBase uint64
+}
+
+// openRecorder opens the record file at path for appending. A new or
+// empty file gets the header, the header of an existing file must match.
+// A truncated last message of an existing file is removed.
+func openRecorder(path string) (*messageRecorder, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	recorder := &messageRecorder{file: file, w: bufio.NewWriterSize(file, 1<<16)}
+	if info.Size() > 0 {
+		recorder.connBase, err = recoverRecordFile(file, info.Size())
+	} else {
+		err = writeRecordHeader(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recorder, nil
+
+} // End of openRecorder
+
+// recoverRecordFile reads the existing record file of size bytes. It
+// returns the highest connection number and truncates the file after the
+// last complete message.
+func recoverRecordFile(file *os.File, size int64) (uint64, error) {
+
+	reader, err := newRecordReader(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return 0, err
+	}
+	var highest uint64
+	for {
+		message, err := reader.next()
+		if err == io.EOF {
+			return highest, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Remove truncated last message of record file %s\n", file.Name())
+			return highest, file.Truncate(reader.offset)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if message.Conn > highest {
+			highest = message.Conn
+		}
+	}
+
+} // End of recoverRecordFile
+
+// record appends message of connection conn. After a failed write, the
+// file ends and further messages are counted only. It is a
+// listener.Options.OnRead function.
+func (r *messageRecorder) record(conn uint64, message []byte) {
+
+	var envelope [recordEnvelopeSize]byte
+	binary.LittleEndian.PutUint64(envelope[0:8], uint64(time.Now().UnixNano()))
+	if conn > 0 {
+		conn += r.connBase
+	}
+	binary.LittleEndian.PutUint64(envelope[8:16], conn)
+	binary.LittleEndian.PutUint32(envelope[16:20], uint32(len(message)))
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.failed {
+		recordFailures.Inc()
+		return
+	}
+	_, err := r.w.Write(envelope[:])
+	if err == nil {
+		_, err = r.w.Write(message)
+	}
+	if err != nil {
+		r.fail(err)
+	}
+
+} // End of record
+
+// run flushes the file every second until ctx is done. After the last
+// message of the listener, i.e. when done is closed, the file is flushed
+// and closed.
+func (r *messageRecorder) run(ctx context.Context, done <-chan struct{}) {
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			r.close()
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+
+} // End of run
+
+func (r *messageRecorder) flush() {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.failed {
+		return
+	}
+	if err := r.w.Flush(); err != nil {
+		r.fail(err)
+	}
+
+} // End of flush
+
+func (r *messageRecorder) close() {
+
+	r.flush()
+	if err := r.file.Close(); err != nil {
+		log.Printf("Close record file %s failed: %v\n", r.file.Name(), err)
+	}
+
+} // End of close
+
+// fail stops the recording after err. The caller holds the mutex.
+func (r *messageRecorder) fail(err error) {
+	r.failed = true
+	recordFailures.Inc()
+	log.Printf("Write record file %s failed, stop recording: %v\n", r.file.Name(), err)
+} // End of fail
+
+func writeRecordHeader(w io.Writer) error {
+	header := make([]byte, recordHeaderSize)
+	copy(header, recordMagic)
+	binary.LittleEndian.PutUint16(header[len(recordMagic):], recordVersion)
+	_, err := w.Write(header)
+	return err
+} // End of writeRecordHeader
+
+// readRecordHeader reads the header of a record file and checks the
+// magic and the version
+func readRecordHeader(r io.Reader) error {
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("no record file: %w", err)
+	}
+	if string(header[:len(recordMagic)]) != recordMagic {
+		return errors.New("no record file")
+	}
+	if version := binary.LittleEndian.Uint16(header[len(recordMagic):]); version != recordVersion {
+		return fmt.Errorf("record file version %d not supported - supported version: %d", version, recordVersion)
+	}
+	return nil
+
+} // End of readRecordHeader
+
+// recordReader reads the messages of a record file
+type recordReader struct {
+	r *bufio.Reader
+	// offset is the end of the last complete message in the file
+	offset int64
+}
+
+// newRecordReader checks the header of r and returns a reader of its
+// messages
+func newRecordReader(r io.Reader) (*recordReader, error) {
+
+	reader := &recordReader{r: bufio.NewReader(r)}
+	if err := readRecordHeader(reader.r); err != nil {
+		return nil, err
+	}
+	reader.offset = int64(recordHeaderSize)
+	return reader, nil
+
+} // End of newRecordReader
+
+// next returns the next message. It returns io.EOF at the end of the
+// file and io.ErrUnexpectedEOF for a truncated message, e.g. of an
+// exporter, which was killed while writing.
+func (r *recordReader) next() (recordedMessage, error) {
+
+	var envelope [recordEnvelopeSize]byte
+	if _, err := io.ReadFull(r.r, envelope[:]); err != nil {
+		return recordedMessage{}, err
+	}
+	size := binary.LittleEndian.Uint32(envelope[16:20])
+	if size > recordMaxMessage {
+		return recordedMessage{}, fmt.Errorf("message of %d bytes exceeds the maximum of %d - corrupt record file", size, recordMaxMessage)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r.r, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return recordedMessage{}, err
+	}
+	r.offset += int64(recordEnvelopeSize) + int64(size)
+	return recordedMessage{
+		Time:    time.Unix(0, int64(binary.LittleEndian.Uint64(envelope[0:8]))),
+		Conn:    binary.LittleEndian.Uint64(envelope[8:16]),
+		Message: message,
+	}, nil
+
+} // End of next
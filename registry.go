@@ -0,0 +1,136 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * registry registers the collectors with the default registry of
+ * client_golang. Instead of the panic of MustRegister, a conflict of two
+ * metrics, e.g. the same name with other label names, is reported with
+ * the flags, which enabled both.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// descName extracts the metric name from the string of a descriptor, as
+// prometheus.Desc has no accessor for it
+var descName = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// registration registers collectors and records the owner of each metric
+// name, a flag or a component. All collectors are registered in check as
+// well, together with the exporter, which is gathered from an own
+// registry on each scrape, so conflicts with it are found at startup.
+type registration struct {
+	check  *prometheus.Registry
+	owners map[string]string
+	errs   []error
+}
+
+func newRegistration() *registration {
+	return &registration{
+		check:  prometheus.NewRegistry(),
+		owners: make(map[string]string),
+	}
+} // End of newRegistration
+
+// register registers collectors of owner with the default registry. A
+// failed registration is explained and kept in errs.
+func (r *registration) register(owner string, collectors ...prometheus.Collector) {
+
+	for _, collector := range collectors {
+		if r.checkOnly(owner, collector) {
+			if err := prometheus.Register(collector); err != nil {
+				r.errs = append(r.errs, r.explain(owner, collector, err))
+			}
+		}
+	}
+
+} // End of register
+
+// checkOnly registers collector of owner in check only and returns true,
+// if it does not conflict with the collectors registered before
+func (r *registration) checkOnly(owner string, collector prometheus.Collector) bool {
+
+	if err := r.check.Register(collector); err != nil {
+		r.errs = append(r.errs, r.explain(owner, collector, err))
+		return false
+	}
+	for _, name := range metricNames(collector) {
+		if _, ok := r.owners[name]; !ok {
+			r.owners[name] = owner
+		}
+	}
+	return true
+
+} // End of checkOnly
+
+// explain adds the owners of the conflicting metrics to the error of a
+// registration
+func (r *registration) explain(owner string, collector prometheus.Collector, err error) error {
+
+	var already prometheus.AlreadyRegisteredError
+	for _, name := range metricNames(collector) {
+		other, ok := r.owners[name]
+		if !ok {
+			continue
+		}
+		if errors.As(err, &already) {
+			return fmt.Errorf("%s: metric %s is already registered by %s", owner, name, other)
+		}
+		return fmt.Errorf("%s: metric %s conflicts with the one of %s, which has the same name, but other label names or another help text - disable one of both",
+			owner, name, other)
+	}
+	return fmt.Errorf("%s: invalid metric: %v", owner, err)
+
+} // End of explain
+
+// metricNames returns the names of the metrics described by collector
+func metricNames(collector prometheus.Collector) []string {
+
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		collector.Describe(descs)
+		close(descs)
+	}()
+	var names []string
+	for desc := range descs {
+		if match := descName.FindStringSubmatch(desc.String()); match != nil {
+			names = append(names, match[1])
+		}
+	}
+	return names
+
+} // End of metricNames
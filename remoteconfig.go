@@ -0,0 +1,231 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * remoteconfig fetches flag values from a central configuration service
+ * at startup, e.g. the KV HTTP API of Consul. The YAML document maps flag
+ * names to values:
+ *
+ *	listen: ":9141"
+ *	metric-ttl: 30m
+ *	socket-dir-mode: 0750
+ *
+ * Flags given on the command line take precedence over the remote values.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// remoteConfigTimeout limits each attempt to fetch the configuration
+	remoteConfigTimeout = 10 * time.Second
+	// remoteConfigFirstBackoff is the delay before the first retry. It
+	// doubles with each retry.
+	remoteConfigFirstBackoff = time.Second
+	// remoteConfigMaxSize limits the size of the configuration document
+	remoteConfigMaxSize = 1 << 20
+)
+
+// checkRemoteConfigURL verifies the URL of -remote-config-url
+func checkRemoteConfigURL(raw string) error {
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host missing")
+	}
+	return nil
+
+} // End of checkRemoteConfigURL
+
+// applyRemoteConfig fetches the configuration from rawURL, retrying up to
+// retries times, and sets the flags, which were not given on the command
+// line. Either all remote values are applied or none.
+func applyRemoteConfig(rawURL string, retries int) error {
+
+	// reported by validateFlags
+	if checkRemoteConfigURL(rawURL) != nil {
+		return nil
+	}
+	data, err := fetchRemoteConfig(rawURL, retries)
+	if err != nil {
+		return err
+	}
+	values, err := parseRemoteConfig(data)
+	if err != nil {
+		return err
+	}
+
+	var applied, kept []string
+	for _, name := range sortedKeys(values) {
+		if isFlagSet(name) {
+			kept = append(kept, "-"+name)
+			continue
+		}
+		applied = append(applied, name)
+	}
+	if err := setFlags(applied, values); err != nil {
+		return err
+	}
+
+	// values are not logged, they may contain passwords
+	for i, name := range applied {
+		applied[i] = "-" + name
+	}
+	log.Printf("Remote configuration from %s: set %s\n", rawURL, listOrNone(applied))
+	if len(kept) > 0 {
+		log.Printf("Remote configuration from %s: kept command line %s\n", rawURL, strings.Join(kept, ", "))
+	}
+	return nil
+
+} // End of applyRemoteConfig
+
+// fetchRemoteConfig gets the document at rawURL. A failed attempt is
+// retried with backoff up to retries times.
+func fetchRemoteConfig(rawURL string, retries int) ([]byte, error) {
+
+	client := &http.Client{Timeout: remoteConfigTimeout}
+	backoff := remoteConfigFirstBackoff
+	for attempt := 0; ; attempt++ {
+		data, err := fetchOnce(client, rawURL)
+		if err == nil {
+			return data, nil
+		}
+		if attempt >= retries {
+			return nil, err
+		}
+		log.Printf("Fetch remote configuration from %s failed, retry in %v: %v\n", rawURL, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+} // End of fetchRemoteConfig
+
+// fetchOnce gets the document at rawURL, which must answer with 200
+func fetchOnce(client *http.Client, rawURL string) ([]byte, error) {
+
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", rawURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, remoteConfigMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > remoteConfigMaxSize {
+		return nil, fmt.Errorf("configuration exceeds %d bytes", remoteConfigMaxSize)
+	}
+	return data, nil
+
+} // End of fetchOnce
+
+// parseRemoteConfig parses a YAML mapping of flag names to scalar
+// values. The values are kept as written, so a mode like 0750 is not
+// turned into a decimal number.
+func parseRemoteConfig(data []byte) (map[string]string, error) {
+
+	var nodes map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(nodes))
+	for name, node := range nodes {
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%q: unknown flag", name)
+		}
+		if strings.HasPrefix(name, "remote-config-") {
+			return nil, fmt.Errorf("%q: cannot be set by the remote configuration", name)
+		}
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%q: value must be a scalar", name)
+		}
+		values[name] = node.Value
+	}
+	return values, nil
+
+} // End of parseRemoteConfig
+
+// setFlags sets the flags names to their values. If a value is invalid,
+// the flags set before are restored.
+func setFlags(names []string, values map[string]string) error {
+
+	previous := make([]string, 0, len(names))
+	for _, name := range names {
+		previous = append(previous, flag.Lookup(name).Value.String())
+		if err := flag.Set(name, values[name]); err != nil {
+			for i := len(previous) - 2; i >= 0; i-- {
+				flag.Set(names[i], previous[i])
+			}
+			return fmt.Errorf("-%s %q: %w", name, values[name], err)
+		}
+	}
+	return nil
+
+} // End of setFlags
+
+// sortedKeys returns the keys of values in order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+} // End of sortedKeys
+
+// listOrNone joins names or returns none for an empty list
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+} // End of listOrNone
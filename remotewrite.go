@@ -0,0 +1,310 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * remotewrite pushes the gathered metrics with the Prometheus remote write
+ * protocol, for installations where Prometheus cannot scrape the exporter.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// remote write retries of a request, which failed with a network error
+// or a server error. The backoff doubles with each retry.
+const (
+	remoteWriteRetries = 3
+	remoteWriteBackoff = time.Second
+)
+
+var (
+	remoteWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "remote_write_failures_total",
+		Help:      "How many pushes to the remote write endpoint failed after all retries.",
+	})
+	remoteWriteDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "remote_write_dropped_total",
+		Help:      "How many remote write requests have been dropped, because the send queue was full.",
+	})
+)
+
+// runRemoteWrite gathers the metrics of exp every interval and queues
+// them for the sender, which pushes them to url, until ctx is done. If
+// queueSize requests are waiting, new ones are dropped.
+func runRemoteWrite(ctx context.Context, exp *exporter.Exporter, url string, interval time.Duration, queueSize int) error {
+
+	tlsConfig, err := remoteWriteTLSConfig()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout:   interval,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+
+	queue := make(chan []prompb.TimeSeries, queueSize)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		remoteWriteSender(ctx, client, url, queue)
+	}()
+	defer func() {
+		close(queue)
+		<-sent
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		series, err := gatherTimeSeries(ctx, exp, client.Timeout)
+		if err != nil {
+			remoteWriteFailures.Inc()
+			log.Printf("Remote write gather failed: %v\n", err)
+			continue
+		}
+		select {
+		case queue <- series:
+		default:
+			remoteWriteDropped.Inc()
+			log.Printf("Remote write queue full - drop request\n")
+		}
+	}
+
+} // End of runRemoteWrite
+
+// remoteWriteSender sends the queued series to url until the queue is
+// closed. Pending requests are dropped, when ctx is done.
+func remoteWriteSender(ctx context.Context, client *http.Client, url string, queue <-chan []prompb.TimeSeries) {
+
+	for series := range queue {
+		if ctx.Err() != nil {
+			continue
+		}
+		backoff := remoteWriteBackoff
+		for try := 0; ; try++ {
+			retry, err := remoteWrite(ctx, client, url, series)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			if !retry || try == remoteWriteRetries {
+				remoteWriteFailures.Inc()
+				log.Printf("Remote write to %s failed: %v\n", url, err)
+				break
+			}
+			log.Printf("Remote write to %s failed, retry in %v: %v\n", url, backoff, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+
+} // End of remoteWriteSender
+
+// gatherTimeSeries gathers the metrics of exp once as remote write series
+func gatherTimeSeries(ctx context.Context, exp *exporter.Exporter, timeout time.Duration) ([]prompb.TimeSeries, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	families, err := outputGatherer(ctx, exp).Gather()
+	if err != nil {
+		return nil, err
+	}
+	return toTimeSeries(families, time.Now()), nil
+
+} // End of gatherTimeSeries
+
+// remoteWrite sends series to url. retry tells, if the request may
+// succeed, when it is sent again: after a network error, 429 or a 5xx
+// status, as in the remote write specification.
+func remoteWrite(ctx context.Context, client *http.Client, url string, series []prompb.TimeSeries) (retry bool, err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	request := prompb.WriteRequest{Timeseries: series}
+	data, err := request.Marshal()
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "nfsen_exporter/"+version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if *remoteWriteUser != "" {
+		req.SetBasicAuth(*remoteWriteUser, *remoteWritePassword)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return false, nil
+
+} // End of remoteWrite
+
+// remoteWriteTLSConfig builds the TLS configuration of the remote write
+// client from the -remote-write-tls-* flags
+func remoteWriteTLSConfig() (*tls.Config, error) {
+	return loadTLSConfig(*remoteWriteCAFile, *remoteWriteCertFile, *remoteWriteKeyFile, *remoteWriteInsecure)
+} // End of remoteWriteTLSConfig
+
+// loadTLSConfig builds a client TLS configuration. An empty caFile uses
+// the system CAs, an empty certFile sends no client certificate.
+func loadTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificate found", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+
+} // End of loadTLSConfig
+
+// toTimeSeries converts the gathered families to remote write series.
+// Summaries and histograms are split into their sample series, like in
+// the text format. Metrics without timestamp get now.
+func toTimeSeries(families []*dto.MetricFamily, now time.Time) []prompb.TimeSeries {
+
+	var series []prompb.TimeSeries
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			timestamp := now.UnixMilli()
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...prompb.Label) {
+				labels := []prompb.Label{{Name: "__name__", Value: name}}
+				for _, pair := range metric.GetLabel() {
+					labels = append(labels, prompb.Label{Name: pair.GetName(), Value: pair.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+				series = append(series, prompb.TimeSeries{
+					Labels:  labels,
+					Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+				})
+			}
+
+			name := family.GetName()
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					add(name, q.GetValue(), prompb.Label{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", summary.GetSampleSum())
+				add(name+"_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, b := range histogram.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), prompb.Label{Name: "le", Value: formatFloat(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(histogram.GetSampleCount()), prompb.Label{Name: "le", Value: "+Inf"})
+				add(name+"_sum", histogram.GetSampleSum())
+				add(name+"_count", float64(histogram.GetSampleCount()))
+			default:
+				add(name, metric.GetUntyped().GetValue())
+			}
+		}
+	}
+	return series
+
+} // End of toTimeSeries
+
+// formatFloat formats a quantile or bucket bound like the text format
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+} // End of formatFloat
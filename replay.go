@@ -0,0 +1,219 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * replay implements the replay subcommand, which sends the messages of a
+ * file of -record-file to an exporter socket again. The gaps between the
+ * messages are kept, scaled by -speed, and each recorded connection is
+ * replayed on an own connection, so the messages of an ident keep their
+ * order.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runReplay parses the replay arguments, replays the record file and
+// returns the exit code. The flags may follow the file.
+func runReplay(args []string) int {
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	socket := flags.String("socket", "/tmp/nfsen.sock", "Path of the exporter socket. - writes the messages to stdout, e.g. for -dry-run-socket")
+	speedFlag := flags.String("speed", "1x", "Replay speed as factor of the recorded time, e.g. 10x. 0 replays without pauses")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [flags] <record file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Replay one record file only, got %s and %s\n", path, strings.Join(flags.Args(), " "))
+		return 2
+	}
+	speed, err := parseSpeed(*speedFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-speed %q: %v\n", *speedFlag, err)
+		return 2
+	}
+
+	// the last message of each connection closes it, as the collector did
+	last, err := lastMessages(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Read record file %s failed: %v\n", path, err)
+		return 1
+	}
+
+	start := time.Now()
+	count, err := replayFile(path, *socket, speed, last)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Replay failed after %d messages: %v\n", count, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Replayed %d messages of %d connections in %v\n", count, len(last), time.Since(start).Round(time.Millisecond))
+	return 0
+
+} // End of runReplay
+
+// parseSpeed parses a factor like 10x or 0.5
+func parseSpeed(s string) (float64, error) {
+
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil {
+		return 0, errors.New("no factor - use e.g. 10x")
+	}
+	if speed < 0 || math.IsInf(speed, 0) {
+		return 0, errors.New("must be a finite factor, not negative")
+	}
+	return speed, nil
+
+} // End of parseSpeed
+
+// lastMessages returns the index of the last message of each connection
+// of the record file at path
+func lastMessages(path string) (map[uint64]int, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := newRecordReader(file)
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[uint64]int)
+	for i := 0; ; i++ {
+		message, err := reader.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return last, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		last[message.Conn] = i
+	}
+
+} // End of lastMessages
+
+// replayFile sends the messages of the record file at path to socket,
+// or stdout for socket -, and returns the number of messages sent. A
+// truncated last message is skipped.
+func replayFile(path, socket string, speed float64, last map[uint64]int) (int, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader, err := newRecordReader(file)
+	if err != nil {
+		return 0, err
+	}
+
+	conns := make(map[uint64]net.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	var first time.Time
+	start := time.Now()
+	for i := 0; ; i++ {
+		message, err := reader.next()
+		if err == io.EOF {
+			return i, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			fmt.Fprintf(os.Stderr, "Skip truncated last message of %s\n", path)
+			return i, nil
+		}
+		if err != nil {
+			return i, err
+		}
+
+		if i == 0 {
+			first = message.Time
+		}
+		if speed > 0 {
+			// messages of concurrent connections may be recorded
+			// slightly out of order, they are sent without pause
+			offset := time.Duration(float64(message.Time.Sub(first)) / speed)
+			if wait := offset - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		if socket == "-" {
+			if _, err := os.Stdout.Write(message.Message); err != nil {
+				return i, err
+			}
+			continue
+		}
+		conn, ok := conns[message.Conn]
+		if !ok {
+			if conn, err = net.Dial("unix", socket); err != nil {
+				return i, err
+			}
+			conns[message.Conn] = conn
+		}
+		if _, err := conn.Write(message.Message); err != nil {
+			return i, err
+		}
+		if last[message.Conn] == i {
+			delete(conns, message.Conn)
+			conn.Close()
+		}
+	}
+
+} // End of replayFile
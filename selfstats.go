@@ -0,0 +1,93 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * selfstats exposes the state of the store and the socket listener as
+ * gauges under the nfexporter namespace, apart from the nfsen metrics.
+ */
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/listener"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// selfNamespace is the namespace of the self telemetry gauges
+const selfNamespace = "nfexporter"
+
+// registerSelfStats registers the gauges and counters of store and
+// socket. They are read on each scrape and exist with 0, while nothing
+// is tracked.
+func registerSelfStats(registrations *registration, store *metrics.Store, socket *listener.Listener) {
+
+	gauge := func(name, help string, labels prometheus.Labels, value func() float64) {
+		registrations.register("self telemetry", prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   selfNamespace,
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		}, value))
+	}
+
+	counter := func(name, help string, value func() float64) {
+		registrations.register("self telemetry", prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: selfNamespace,
+			Name:      name,
+			Help:      help,
+		}, value))
+	}
+
+	counter("messages_received_total", "Number of messages processed by the parse workers.",
+		func() float64 { return float64(socket.Stats().Messages) })
+	counter("parse_errors_total", "Number of messages, which could not be decoded.",
+		func() float64 { return float64(socket.Stats().ParseErrors) })
+	gauge("tracked_idents", "Number of idents in the metric store.", nil,
+		func() float64 { return float64(store.Stats().Idents) })
+	gauge("tracked_exporters", "Number of exporters of all idents in the metric store.", nil,
+		func() float64 { return float64(store.Stats().Exporters) })
+	gauge("state_bytes_estimate", "Rough estimate of the memory used by the metric store in bytes.", nil,
+		func() float64 { return float64(store.Stats().Bytes) })
+	gauge("active_readers", "Number of collector connections read by a goroutine.", nil,
+		func() float64 { return float64(socket.Stats().Readers) })
+
+	// the number of workers is fixed, so is the set of queues
+	for worker := range socket.Stats().Queued {
+		worker := worker
+		gauge("queue_length", "Number of messages waiting in the queue of a parse worker.",
+			prometheus.Labels{"worker": strconv.Itoa(worker)},
+			func() float64 { return float64(socket.Stats().Queued[worker]) })
+	}
+
+} // End of registerSelfStats
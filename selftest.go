@@ -0,0 +1,349 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * selftest implements -self-test: after the start, the exporter sends
+ * itself messages through its socket and checks the samples of its own
+ * scrape, so a deployment fails early, if any part of the pipeline from
+ * the socket to the HTTP response is broken.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/nfsocktest"
+	"nfsen_exporter/pkg/protocol"
+)
+
+const (
+	// selfTestIdent is the ident of the messages of the self-test. It is
+	// removed after the test.
+	selfTestIdent = "nfsen_exporter_self_test"
+	// selfTestExporter is the exporter ID of the messages of the self-test
+	selfTestExporter = 1
+	// selfTestTimeout limits the wait for the expected samples
+	selfTestTimeout = 10 * time.Second
+)
+
+// selfTestSample is a sample of the self-test ident, which the scrape
+// must contain. For a histogram, value is its sum.
+type selfTestSample struct {
+	family    string
+	proto     string
+	value     float64
+	histogram bool
+}
+
+// selfTestCounters returns the counters of proto in the message of
+// round. Each family and protocol has another value, so swapped labels
+// are found.
+func selfTestCounters(proto metrics.Proto, round uint64) metrics.Counters {
+	p := uint64(proto)
+	return metrics.Counters{Flows: (11 + p) * round, Packets: (21 + p) * round, Bytes: (31 + p) * round}
+} // End of selfTestCounters
+
+// selfTestSamples returns the samples expected after two messages of
+// the self-test ident for the value mode: the totals of the second
+// message as counters, and its difference to the first as gauges or
+// histograms.
+func selfTestSamples(valueMode string, histograms bool) []selfTestSample {
+
+	var samples []selfTestSample
+	for proto := metrics.Proto(0); proto < metrics.NumProtos; proto++ {
+		total := selfTestCounters(proto, 2)
+		delta := selfTestCounters(proto, 1)
+		families := []struct {
+			name         string
+			total, delta uint64
+		}{
+			{"flows", total.Flows, delta.Flows},
+			{"packets", total.Packets, delta.Packets},
+			{"bytes", total.Bytes, delta.Bytes},
+		}
+		for _, family := range families {
+			name := prometheus.BuildFQName(metrics.Namespace, "collector", family.name)
+			switch {
+			case histograms:
+				samples = append(samples, selfTestSample{family: name, proto: proto.String(), value: float64(family.delta), histogram: true})
+			case valueMode != exporter.ValueModeGauge:
+				samples = append(samples, selfTestSample{family: name, proto: proto.String(), value: float64(family.total)})
+			}
+			if valueMode != exporter.ValueModeCounter {
+				samples = append(samples, selfTestSample{family: name + "_last_interval", proto: proto.String(), value: float64(family.delta)})
+			}
+		}
+	}
+	return samples
+
+} // End of selfTestSamples
+
+// runSelfTest sends two messages of the self-test ident to socket and
+// scrapes url, until it has the expected samples of the exporter label
+// exporter or selfTestTimeout has passed. The ident is removed
+// afterwards. It returns nil, if ctx is done before.
+func runSelfTest(ctx context.Context, socket, url string, version uint8, exporter string, expected []selfTestSample) error {
+
+	client, err := nfsocktest.Dial(socket)
+	if err != nil {
+		return err
+	}
+	client.Version = version
+	for round := uint64(1); round <= 2; round++ {
+		stats := nfsocktest.Stats{
+			TCP:   selfTestCounters(metrics.ProtoTCP, round),
+			UDP:   selfTestCounters(metrics.ProtoUDP, round),
+			ICMP:  selfTestCounters(metrics.ProtoICMP, round),
+			Other: selfTestCounters(metrics.ProtoOther, round),
+		}
+		if err := client.SendStats(selfTestIdent, selfTestExporter, stats); err != nil {
+			client.Close()
+			return err
+		}
+	}
+	client.Close()
+	defer removeSelfTestIdent(socket)
+
+	deadline := time.Now().Add(selfTestTimeout)
+	for {
+		err := checkSelfTestScrape(ctx, url, exporter, expected)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+} // End of runSelfTest
+
+// checkSelfTestScrape scrapes url and compares the samples of the
+// self-test ident and the exporter label exporter with expected
+func checkSelfTestScrape(ctx context.Context, url, exporter string, expected []selfTestSample) error {
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return fmt.Errorf("parse scrape of %s: %w", url, err)
+	}
+
+	for _, sample := range expected {
+		metric := findSelfTestMetric(families[sample.family], exporter, sample.proto)
+		if metric == nil {
+			return fmt.Errorf("series %s{exporter=%q,ident=%q,proto=%q} missing in %s", sample.family, exporter, selfTestIdent, sample.proto, url)
+		}
+		var value float64
+		switch {
+		case sample.histogram && metric.GetHistogram() != nil:
+			value = metric.GetHistogram().GetSampleSum()
+		case sample.histogram:
+			return fmt.Errorf("series %s{ident=%q,proto=%q} is no histogram", sample.family, selfTestIdent, sample.proto)
+		case metric.GetCounter() != nil:
+			value = metric.GetCounter().GetValue()
+		default:
+			value = metric.GetGauge().GetValue()
+		}
+		if value != sample.value {
+			return fmt.Errorf("series %s{ident=%q,proto=%q} is %v, want %v", sample.family, selfTestIdent, sample.proto, value, sample.value)
+		}
+	}
+	return nil
+
+} // End of checkSelfTestScrape
+
+// findSelfTestMetric returns the metric of family for the exporter label
+// exporter of the self-test ident and proto, nil for none
+func findSelfTestMetric(family *dto.MetricFamily, exporter, proto string) *dto.Metric {
+
+	for _, metric := range family.GetMetric() {
+		labels := make(map[string]string, len(metric.GetLabel()))
+		for _, pair := range metric.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["ident"] == selfTestIdent && labels["exporter"] == exporter && labels["proto"] == proto {
+			return metric
+		}
+	}
+	return nil
+
+} // End of findSelfTestMetric
+
+// removeSelfTestIdent removes the self-test ident from the exporter
+func removeSelfTestIdent(socket string) {
+
+	client, err := nfsocktest.Dial(socket)
+	if err == nil {
+		err = client.RemoveIdent(selfTestIdent)
+		client.Close()
+	}
+	if err != nil {
+		log.Printf("Remove self-test ident failed: %v\n", err)
+	}
+
+} // End of removeSelfTestIdent
+
+// isSelfTestIdent reports, whether ident is the ident of a running
+// -self-test. Its messages check the scrape only and are kept out of the
+// outputs and the byte total.
+func isSelfTestIdent(ident string) bool {
+	return *selfTest && ident == selfTestIdent
+} // End of isSelfTestIdent
+
+// skipSelfTestUpdates returns fn, which skips the updates of the
+// self-test ident
+func skipSelfTestUpdates(fn metrics.UpdateFunc) metrics.UpdateFunc {
+
+	if fn == nil || !*selfTest {
+		return fn
+	}
+	return func(ident string, previous, current metrics.Metric) {
+		if !isSelfTestIdent(ident) {
+			fn(ident, previous, current)
+		}
+	}
+
+} // End of skipSelfTestUpdates
+
+// skipSelfTestMessages returns fn, which skips the messages of the
+// self-test ident
+func skipSelfTestMessages(fn func(ident string, list []metrics.Metric)) func(ident string, list []metrics.Metric) {
+
+	if fn == nil || !*selfTest {
+		return fn
+	}
+	return func(ident string, list []metrics.Metric) {
+		if !isSelfTestIdent(ident) {
+			fn(ident, list)
+		}
+	}
+
+} // End of skipSelfTestMessages
+
+// skipSelfTestReads returns fn of listener.Options.OnRead, which skips
+// the messages of the self-test ident
+func skipSelfTestReads(fn func(conn uint64, message []byte)) func(conn uint64, message []byte) {
+
+	if fn == nil || !*selfTest {
+		return fn
+	}
+	return func(conn uint64, message []byte) {
+		if !isSelfTestIdent(protocol.Ident(message)) {
+			fn(conn, message)
+		}
+	}
+
+} // End of skipSelfTestReads
+
+// withoutSelfTest removes the entries of the self-test ident from
+// snapshot in place
+func withoutSelfTest(snapshot []metrics.Entry) []metrics.Entry {
+
+	if !*selfTest {
+		return snapshot
+	}
+	kept := snapshot[:0]
+	for _, entry := range snapshot {
+		if !isSelfTestIdent(entry.Ident) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+
+} // End of withoutSelfTest
+
+// selfTestFilter is a gatherer without the series of the self-test
+// ident, for the outputs besides the scrape
+type selfTestFilter struct {
+	gatherer prometheus.Gatherer
+}
+
+func (f selfTestFilter) Gather() ([]*dto.MetricFamily, error) {
+
+	families, err := f.gatherer.Gather()
+	kept := families[:0]
+	for _, family := range families {
+		series := family.Metric[:0]
+		for _, metric := range family.Metric {
+			if !hasSelfTestIdent(metric) {
+				series = append(series, metric)
+			}
+		}
+		family.Metric = series
+		// a family of the self-test ident only is dropped
+		if len(series) > 0 {
+			kept = append(kept, family)
+		}
+	}
+	return kept, err
+
+} // End of Gather
+
+// hasSelfTestIdent reports, whether metric has the self-test ident
+func hasSelfTestIdent(metric *dto.Metric) bool {
+
+	for _, pair := range metric.GetLabel() {
+		if pair.GetName() == "ident" {
+			return isSelfTestIdent(pair.GetValue())
+		}
+	}
+	return false
+
+} // End of hasSelfTestIdent
@@ -0,0 +1,194 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/protocol"
+)
+
+// enableSelfTest sets -self-test for the test
+func enableSelfTest(t *testing.T) {
+	saved := *selfTest
+	*selfTest = true
+	t.Cleanup(func() { *selfTest = saved })
+} // End of enableSelfTest
+
+// selfTestMetric returns a metric of exporter 1 with bytes in all protos
+func selfTestMetric(bytes uint64) metrics.Metric {
+	metric := metrics.Metric{ExporterID: 1, LastUpdate: time.Now()}
+	for proto := range metric.Protos {
+		metric.Protos[proto] = metrics.Counters{Flows: 1, Packets: 1, Bytes: bytes}
+	}
+	return metric
+} // End of selfTestMetric
+
+// identsOf returns the idents of the series of families by family name
+func identsOf(families []*dto.MetricFamily) map[string][]string {
+	idents := make(map[string][]string)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == "ident" {
+					idents[family.GetName()] = append(idents[family.GetName()], pair.GetValue())
+				}
+			}
+		}
+	}
+	return idents
+} // End of identsOf
+
+// TestSelfTestOutputs sends the self-test ident and another one through
+// the output filters. Only the other ident must pass.
+func TestSelfTestOutputs(t *testing.T) {
+
+	enableSelfTest(t)
+	store := metrics.NewStore(metrics.Options{})
+	exp := exporter.New(store, exporter.Options{ValueMode: exporter.ValueModeCounter})
+	var updated, messages, reads []string
+	onUpdate := chainUpdates(exp.UpdateFlowRateStats, skipSelfTestUpdates(chainUpdates(exp.CountBytes,
+		func(ident string, previous, current metrics.Metric) { updated = append(updated, ident) })))
+	onMessage := skipSelfTestMessages(func(ident string, list []metrics.Metric) { messages = append(messages, ident) })
+	onRead := skipSelfTestReads(func(conn uint64, message []byte) { reads = append(reads, protocol.Ident(message)) })
+	for _, ident := range []string{selfTestIdent, "live"} {
+		for round := uint64(1); round <= 2; round++ {
+			list := []metrics.Metric{selfTestMetric(100 * round)}
+			onRead(1, protocol.EncodeMessage(ident, 1, 60, list))
+			store.Update(ident, list, onUpdate)
+			onMessage(ident, list)
+		}
+	}
+
+	// the first message of an exporter is no update
+	if len(updated) != 1 || updated[0] != "live" || len(messages) != 2 || messages[0] != "live" || len(reads) != 2 || reads[0] != "live" {
+		t.Errorf("outputs got updates %v, messages %v, reads %v, want live only", updated, messages, reads)
+	}
+	snapshot, _ := store.Snapshot(context.Background())
+	if snapshot = withoutSelfTest(snapshot); len(snapshot) != 1 || snapshot[0].Ident != "live" {
+		t.Errorf("snapshot without self-test = %+v, want live only", snapshot)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exp)
+	families, err := selfTestFilter{gatherer: registry}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, idents := range identsOf(families) {
+		for _, ident := range idents {
+			if ident != "live" {
+				t.Errorf("%s has series of ident %s", name, ident)
+			}
+		}
+	}
+	for _, family := range families {
+		if family.GetName() != "nfsen_collector_bytes_grand_total" {
+			continue
+		}
+		// the difference of the two messages of live in four protos
+		if got := family.GetMetric()[0].GetCounter().GetValue(); got != 400 {
+			t.Errorf("grand total = %v, want 400 of ident live", got)
+		}
+	}
+
+	// the scrape of the self-test itself gets the ident
+	unfiltered, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idents := identsOf(unfiltered)["nfsen_collector_flows"]; len(idents) != 2*int(metrics.NumProtos) {
+		t.Errorf("scrape has flows of %v, want both idents", idents)
+	}
+
+} // End of TestSelfTestOutputs
+
+// TestSelfTestOutputsDisabled checks, that an ident named like the
+// self-test is exported as usual without -self-test
+func TestSelfTestOutputsDisabled(t *testing.T) {
+
+	saved := *selfTest
+	*selfTest = false
+	defer func() { *selfTest = saved }()
+
+	called := false
+	skipSelfTestMessages(func(ident string, list []metrics.Metric) { called = true })(selfTestIdent, nil)
+	snapshot := withoutSelfTest([]metrics.Entry{{Ident: selfTestIdent}})
+	if !called || len(snapshot) != 1 {
+		t.Errorf("ident %s skipped without -self-test", selfTestIdent)
+	}
+
+} // End of TestSelfTestOutputsDisabled
+
+// TestSelfTestExporterLabel checks the scrape of the self-test messages
+// with both formats of the exporter label
+func TestSelfTestExporterLabel(t *testing.T) {
+
+	for _, asIP := range []bool{false, true} {
+		store := metrics.NewStore(metrics.Options{})
+		exp := exporter.New(store, exporter.Options{ValueMode: exporter.ValueModeCounter, ExporterIDAsIP: asIP})
+		for round := uint64(1); round <= 2; round++ {
+			metric := metrics.Metric{ExporterID: selfTestExporter, LastUpdate: time.Now()}
+			for proto := range metric.Protos {
+				metric.Protos[proto] = selfTestCounters(metrics.Proto(proto), round)
+			}
+			store.Update(selfTestIdent, []metrics.Metric{metric}, nil)
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(exp)
+		server := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+		label := exp.ExporterLabel(selfTestExporter)
+		if want := map[bool]string{false: "1", true: "0.0.0.1"}[asIP]; label != want {
+			t.Errorf("-exporter-id-as-ip=%v: label %q, want %q", asIP, label, want)
+		}
+		expected := selfTestSamples(exporter.ValueModeCounter, false)
+		if err := checkSelfTestScrape(context.Background(), server.URL, label, expected); err != nil {
+			t.Errorf("-exporter-id-as-ip=%v: %v", asIP, err)
+		}
+		// the other format must not match
+		other := map[bool]string{false: "0.0.0.1", true: "1"}[asIP]
+		if err := checkSelfTestScrape(context.Background(), server.URL, other, expected); err == nil {
+			t.Errorf("-exporter-id-as-ip=%v: scrape matched exporter %q", asIP, other)
+		}
+		server.Close()
+	}
+
+} // End of TestSelfTestExporterLabel
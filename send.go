@@ -0,0 +1,174 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * send implements the send subcommand, a small test client, which sends
+ * synthetic statistics to the exporter socket in the same format as nfcapd.
+ * It is useful to test dashboards and deployments without a collector.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"nfsen_exporter/pkg/metrics"
+	"nfsen_exporter/pkg/nfsocktest"
+)
+
+// sendRecord is a metric record or, with Remove, the removal of its ident
+type sendRecord struct {
+	metricRecord
+	Remove bool `json:"remove,omitempty"`
+}
+
+// runSend parses the send arguments, sends the message(s) and returns the
+// exit code
+func runSend(args []string) int {
+
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	socket := flags.String("socket", "/tmp/nfsen.sock", "Path of the exporter socket. - writes the messages to stdout, e.g. for -dry-run-socket")
+	jsonFile := flags.String("json", "", "Read records from this JSON file instead of the counter flags")
+	repeat := flags.Duration("repeat", 0, "Send again in this interval with incremented counters. 0 sends once")
+	count := flags.Int("count", 0, "Stop after this many messages with -repeat. 0 sends forever")
+
+	var record sendRecord
+	flags.StringVar(&record.Ident, "ident", "live", "Ident of the collector")
+	flags.BoolVar(&record.Remove, "remove", false, "Remove the ident and its exporters from the exporter instead of sending counters")
+	flags.Uint64Var(&record.Exporter, "exporter", 1, "Exporter ID")
+	flags.Uint64Var(&record.FlowsTCP, "flows-tcp", 0, "Number of tcp flows")
+	flags.Uint64Var(&record.FlowsUDP, "flows-udp", 0, "Number of udp flows")
+	flags.Uint64Var(&record.FlowsICMP, "flows-icmp", 0, "Number of icmp flows")
+	flags.Uint64Var(&record.FlowsOther, "flows-other", 0, "Number of other flows")
+	flags.Uint64Var(&record.BytesTCP, "bytes-tcp", 0, "Number of tcp bytes")
+	flags.Uint64Var(&record.BytesUDP, "bytes-udp", 0, "Number of udp bytes")
+	flags.Uint64Var(&record.BytesICMP, "bytes-icmp", 0, "Number of icmp bytes")
+	flags.Uint64Var(&record.BytesOther, "bytes-other", 0, "Number of other bytes")
+	flags.Uint64Var(&record.PacketsTCP, "packets-tcp", 0, "Number of tcp packets")
+	flags.Uint64Var(&record.PacketsUDP, "packets-udp", 0, "Number of udp packets")
+	flags.Uint64Var(&record.PacketsICMP, "packets-icmp", 0, "Number of icmp packets")
+	flags.Uint64Var(&record.PacketsOther, "packets-other", 0, "Number of other packets")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	records := []sendRecord{record}
+	if *jsonFile != "" {
+		data, err := os.ReadFile(*jsonFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Read JSON file failed: %v\n", err)
+			return 1
+		}
+		records = nil
+		if err := json.Unmarshal(data, &records); err != nil {
+			fmt.Fprintf(os.Stderr, "Parse JSON file %s failed: %v\n", *jsonFile, err)
+			return 1
+		}
+	}
+
+	start := time.Now()
+	for round := uint64(1); ; round++ {
+		if err := sendRound(*socket, records, round, start); err != nil {
+			fmt.Fprintf(os.Stderr, "Send failed: %v\n", err)
+			return 1
+		}
+		if *repeat == 0 || (*count > 0 && round >= uint64(*count)) {
+			return 0
+		}
+		time.Sleep(*repeat)
+	}
+
+} // End of runSend
+
+// sendRound connects to the socket, or stdout for socket -, and sends
+// the records of one round. The uptime of the messages counts from start.
+func sendRound(socket string, records []sendRecord, round uint64, start time.Time) error {
+
+	client := nfsocktest.NewClient(os.Stdout)
+	if socket != "-" {
+		var err error
+		if client, err = nfsocktest.Dial(socket); err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+	client.Start = start
+	return sendRecords(client, records, round)
+
+} // End of sendRound
+
+// sendRecords sends one message per ident, followed by the removal of
+// the idents of remove records. All counters are multiplied by round, so
+// repeated messages look like growing nfcapd totals.
+func sendRecords(client *nfsocktest.Client, records []sendRecord, round uint64) error {
+
+	var idents, removed []string
+	byIdent := make(map[string][]metrics.Metric)
+	for _, record := range records {
+		if record.Remove {
+			removed = append(removed, record.Ident)
+			continue
+		}
+		if _, ok := byIdent[record.Ident]; !ok {
+			idents = append(idents, record.Ident)
+		}
+		byIdent[record.Ident] = append(byIdent[record.Ident], scaleMetric(record.metric(), round))
+	}
+
+	for _, ident := range idents {
+		if err := client.SendMetrics(ident, byIdent[ident]); err != nil {
+			return err
+		}
+	}
+	for _, ident := range removed {
+		if err := client.RemoveIdent(ident); err != nil {
+			return err
+		}
+	}
+	return nil
+
+} // End of sendRecords
+
+// scaleMetric multiplies all counters of m by factor
+func scaleMetric(m metrics.Metric, factor uint64) metrics.Metric {
+
+	for proto := range m.Protos {
+		m.Protos[proto].Flows *= factor
+		m.Protos[proto].Packets *= factor
+		m.Protos[proto].Bytes *= factor
+	}
+	return m
+
+} // End of scaleMetric
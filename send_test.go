@@ -0,0 +1,185 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nfsen_exporter/pkg/listener"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// sentMessage is a message received from runSend, or the removal of
+// ident
+type sentMessage struct {
+	ident   string
+	list    []metrics.Metric
+	removed bool
+}
+
+// receiveSent runs a listener on a socket in a temporary directory and
+// returns its path and the messages received
+func receiveSent(t *testing.T) (string, <-chan sentMessage) {
+
+	path := filepath.Join(t.TempDir(), "nfsen.sock")
+	received := make(chan sentMessage, 16)
+	socket := listener.New(path, metrics.NewStore(metrics.Options{}), listener.Options{
+		QueueSize: 16,
+		OnMessage: func(ident string, list []metrics.Metric) {
+			received <- sentMessage{ident: ident, list: append([]metrics.Metric(nil), list...)}
+		},
+		OnRemove: func(key metrics.Key) {
+			received <- sentMessage{ident: key.Ident, removed: true}
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := socket.Open(ctx); err != nil {
+		cancel()
+		t.Fatalf("Open: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- socket.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return path, received
+
+} // End of receiveSent
+
+// nextSent returns the next message of received
+func nextSent(t *testing.T, received <-chan sentMessage) sentMessage {
+
+	t.Helper()
+	select {
+	case message := <-received:
+		return message
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for a message")
+	}
+	return sentMessage{}
+
+} // End of nextSent
+
+func TestSendFlags(t *testing.T) {
+
+	path, received := receiveSent(t)
+	code := runSend([]string{"-socket", path, "-ident", "edge", "-exporter", "3",
+		"-flows-tcp", "5", "-bytes-udp", "7", "-packets-other", "9", "-repeat", "1ms", "-count", "2"})
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+
+	// the counters of round 2 are doubled
+	for round := uint64(1); round <= 2; round++ {
+		message := nextSent(t, received)
+		if message.ident != "edge" || len(message.list) != 1 {
+			t.Fatalf("round %d: got ident %q with %d exporters, want edge with one", round, message.ident, len(message.list))
+		}
+		metric := message.list[0]
+		var want [metrics.NumProtos]metrics.Counters
+		want[metrics.ProtoTCP].Flows = 5 * round
+		want[metrics.ProtoUDP].Bytes = 7 * round
+		want[metrics.ProtoOther].Packets = 9 * round
+		if metric.ExporterID != 3 || metric.Protos != want {
+			t.Errorf("round %d: got exporter %d with %+v, want 3 with %+v", round, metric.ExporterID, metric.Protos, want)
+		}
+	}
+
+} // End of TestSendFlags
+
+func TestSendJSON(t *testing.T) {
+
+	path, received := receiveSent(t)
+	if code := runSend([]string{"-socket", path, "-ident", "old"}); code != 0 {
+		t.Fatalf("send old: got exit code %d, want 0", code)
+	}
+	nextSent(t, received)
+
+	jsonFile := filepath.Join(t.TempDir(), "records.json")
+	records := `[
+	{"ident": "live", "exporter": 1, "flows_udp": 2},
+	{"ident": "old", "remove": true},
+	{"ident": "backup", "exporter": 2, "bytes_icmp": 3},
+	{"ident": "live", "exporter": 4, "packets_tcp": 5}
+]`
+	if err := os.WriteFile(jsonFile, []byte(records), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runSend([]string{"-socket", path, "-json", jsonFile}); code != 0 {
+		t.Fatalf("send JSON: got exit code %d, want 0", code)
+	}
+
+	// one message per ident in the order of the records, the removals last
+	live := nextSent(t, received)
+	if live.ident != "live" || len(live.list) != 2 || live.list[0].ExporterID != 1 || live.list[1].ExporterID != 4 ||
+		live.list[0].Protos[metrics.ProtoUDP].Flows != 2 || live.list[1].Protos[metrics.ProtoTCP].Packets != 5 {
+		t.Errorf("got %+v, want exporters 1 and 4 of live", live)
+	}
+	backup := nextSent(t, received)
+	if backup.ident != "backup" || len(backup.list) != 1 || backup.list[0].Protos[metrics.ProtoICMP].Bytes != 3 {
+		t.Errorf("got %+v, want exporter 2 of backup", backup)
+	}
+	if removed := nextSent(t, received); removed.ident != "old" || !removed.removed {
+		t.Errorf("got %+v, want the removal of old", removed)
+	}
+
+} // End of TestSendJSON
+
+func TestSendErrors(t *testing.T) {
+
+	dir := t.TempDir()
+	invalidJSON := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalidJSON, []byte(`{"ident": "live"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-unknown"}, 2},
+		{[]string{"-json", filepath.Join(dir, "missing.json")}, 1},
+		{[]string{"-json", invalidJSON}, 1},
+		{[]string{"-socket", filepath.Join(dir, "missing.sock")}, 1},
+	}
+	for _, c := range cases {
+		if code := runSend(c.args); code != c.code {
+			t.Errorf("runSend(%q): got exit code %d, want %d", c.args, code, c.code)
+		}
+	}
+
+} // End of TestSendErrors
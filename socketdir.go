@@ -0,0 +1,124 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * socketdir creates the missing parent directories of the socket file
+ * with -socket-mkdir, e.g. /run/nfsen after a reboot, and removes them
+ * on shutdown again, if they are empty.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// createdSocketDirs are the directories created by createSocketDirs,
+// the deepest last
+var createdSocketDirs []string
+
+// missingDirs returns the missing directories of the parents of path, the
+// topmost first. Existing directories are followed through symlinks.
+func missingDirs(path string) ([]string, error) {
+
+	var missing []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return nil, fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		missing = append([]string{dir}, missing...)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return missing, nil
+
+} // End of missingDirs
+
+// createSocketDirs creates the missing parent directories of path with
+// mode, independent of the umask. A directory created concurrently by
+// someone else is not taken over.
+func createSocketDirs(path string, mode os.FileMode) error {
+
+	missing, err := missingDirs(path)
+	if err != nil {
+		return err
+	}
+	for _, dir := range missing {
+		if err := os.Mkdir(dir, mode); err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			return err
+		}
+		createdSocketDirs = append(createdSocketDirs, dir)
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+		log.Printf("Created socket directory %s with mode %04o\n", dir, mode)
+	}
+	return nil
+
+} // End of createSocketDirs
+
+// removeSocketDirs removes the directories created by createSocketDirs,
+// the deepest first, as long as they are empty. A directory, which was
+// replaced by a symlink or is reached through one, is never removed.
+func removeSocketDirs() {
+
+	for i := len(createdSocketDirs) - 1; i >= 0; i-- {
+		dir := createdSocketDirs[i]
+		if resolved, err := filepath.EvalSymlinks(dir); err != nil || resolved != filepath.Clean(dir) {
+			log.Printf("Keep socket directory %s: path contains a symlink\n", dir)
+			return
+		}
+		if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+			log.Printf("Keep socket directory %s: no longer a directory\n", dir)
+			return
+		}
+		// fails for a directory, which is not empty
+		if err := os.Remove(dir); err != nil {
+			log.Printf("Keep socket directory %s: %v\n", dir, err)
+			return
+		}
+	}
+	createdSocketDirs = nil
+
+} // End of removeSocketDirs
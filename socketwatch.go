@@ -0,0 +1,97 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * socketwatch checks the collector socket file periodically and creates
+ * the socket again, if the file was removed or replaced, e.g. by tmpwatch
+ * cleaning up /tmp. Without it, nfcapd could no longer connect, while the
+ * exporter keeps running.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/listener"
+)
+
+var listenerRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: selfNamespace,
+	Name:      "listener_restarts_total",
+	Help:      "How many times the collector socket was created again, after its file was removed or replaced.",
+})
+
+// watchSocket returns true, if the socket watchdog is enabled and there
+// is a socket file to check
+func watchSocket() bool {
+	return *socketWatchdog && !*socketAbstract && !*dryRunSocket
+} // End of watchSocket
+
+// runSocketWatchdog checks socket every interval until ctx is done and
+// rebinds it after a failed check. A failed rebind is retried with the
+// next check.
+func runSocketWatchdog(ctx context.Context, socket *listener.Listener, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := socket.Check()
+		if err == nil {
+			continue
+		}
+		log.Printf("WARNING: collector socket broken, nfcapd cannot connect: %v\n", err)
+		if *socketMkdir {
+			// validated by validateFlags
+			mode, _ := parseFileMode(*socketDirMode)
+			if err := createSocketDirs(*socketPath, mode); err != nil {
+				log.Printf("WARNING: create socket directory failed: %v\n", err)
+				continue
+			}
+		}
+		if err := socket.Rebind(ctx); err != nil {
+			log.Printf("WARNING: recreate collector socket %s failed: %v\n", *socketPath, err)
+			continue
+		}
+		listenerRestarts.Inc()
+		log.Printf("WARNING: collector socket %s recreated\n", *socketPath)
+	}
+
+} // End of runSocketWatchdog
@@ -0,0 +1,168 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * state persists the metric store in a JSON file, so accumulated state
+ * survives a restart of the exporter. The file is written atomically
+ * on shutdown and periodically, and loaded at startup, if it is recent.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// stateVersion is incremented, when the format of the state file changes
+const stateVersion = 1
+
+type stateFile struct {
+	Version int           `json:"version"`
+	Saved   time.Time     `json:"saved"`
+	Metrics []stateRecord `json:"metrics"`
+}
+
+type stateRecord struct {
+	metricRecord
+	LastUpdate time.Time `json:"last_update"`
+	// Offsets of -monotonic, omitted without resets
+	Offsets *counterRecord `json:"offsets,omitempty"`
+}
+
+// saveState writes the metrics of store to path. The file is replaced
+// atomically, so a crash never leaves a partial state file.
+func saveState(store *metrics.Store, path string) error {
+
+	snapshot, err := store.Snapshot(context.Background())
+	if err != nil {
+		return err
+	}
+	state := stateFile{Version: stateVersion, Saved: time.Now()}
+	for _, entry := range withoutSelfTest(snapshot) {
+		record := stateRecord{
+			metricRecord: newMetricRecord(entry.Ident, entry.Metric),
+			LastUpdate:   entry.Metric.LastUpdate,
+		}
+		if entry.Metric.Offsets != ([metrics.NumProtos]metrics.Counters{}) {
+			offsets := newCounterRecord(entry.Metric.Offsets)
+			record.Offsets = &offsets
+		}
+		state.Metrics = append(state.Metrics, record)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+
+} // End of saveState
+
+// loadState fills store from path. A missing file is no error, a state
+// older than maxAge is ignored. maxAge 0 accepts any age.
+func loadState(store *metrics.Store, path string, maxAge time.Duration) error {
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("corrupt state file: %v", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("state file version %d, expected %d", state.Version, stateVersion)
+	}
+	if age := time.Since(state.Saved); maxAge > 0 && age > maxAge {
+		return fmt.Errorf("state file is %v old, exceeds -state-max-age", age.Round(time.Second))
+	}
+
+	entries := make([]metrics.Entry, 0, len(state.Metrics))
+	for _, record := range state.Metrics {
+		metric := record.metric()
+		metric.LastUpdate = record.LastUpdate
+		if record.Offsets != nil {
+			metric.Offsets = record.Offsets.protos()
+		}
+		entries = append(entries, metrics.Entry{Ident: record.Ident, Metric: metric})
+	}
+	store.Load(entries)
+
+	log.Printf("Loaded %d metrics from state file %s\n", len(state.Metrics), path)
+	return nil
+
+} // End of loadState
+
+// runStateSaver saves the state every interval until ctx is done
+func runStateSaver(ctx context.Context, store *metrics.Store, path string, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := saveState(store, path); err != nil {
+			log.Printf("Save state file %s failed: %v\n", path, err)
+		}
+	}
+
+} // End of runStateSaver
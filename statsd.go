@@ -0,0 +1,214 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * statsd sends the per interval deltas of the collector counters as StatsD
+ * counters over UDP, plain or with DogStatsD tags.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+const (
+	// statsdMaxPacket keeps a packet within the MTU of common networks
+	statsdMaxPacket = 1432
+	// statsdQueueSize is the number of messages waiting to be sent
+	statsdQueueSize = 1024
+)
+
+var (
+	statsdPackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "statsd_packets_total",
+		Help:      "How many packets have been sent to StatsD.",
+	})
+	statsdDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "statsd_dropped_total",
+		Help:      "How many StatsD metrics have been dropped, because the queue was full or the send failed.",
+	})
+)
+
+// statsdEmitter queues the deltas of each message until they are sent
+type statsdEmitter struct {
+	address       string
+	prefix        string
+	dogstatsd     bool
+	exporterLabel func(uint64) string
+	queue         chan []string
+}
+
+// newStatsdEmitter returns an emitter to the StatsD server at address.
+// tags selects the format: dogstatsd or plain. exporterLabel formats the
+// exporter IDs like the exporter label of the scrape.
+func newStatsdEmitter(address, prefix, tags string, exporterLabel func(uint64) string) *statsdEmitter {
+
+	return &statsdEmitter{
+		address:       address,
+		prefix:        prefix,
+		dogstatsd:     tags == "dogstatsd",
+		exporterLabel: exporterLabel,
+		queue:         make(chan []string, statsdQueueSize),
+	}
+
+} // End of newStatsdEmitter
+
+// update queues the deltas between previous and current. Decreased
+// counters and zero deltas are not sent. It is a metrics.UpdateFunc.
+func (s *statsdEmitter) update(ident string, previous, current metrics.Metric) {
+
+	exporter := s.exporterLabel(current.ExporterID)
+	lines := make([]string, 0, 3*int(metrics.NumProtos))
+	for proto, after := range current.Protos {
+		before := previous.Protos[proto]
+		name := metrics.Proto(proto).String()
+		lines = s.appendDelta(lines, "flows", before.Flows, after.Flows, ident, exporter, name)
+		lines = s.appendDelta(lines, "packets", before.Packets, after.Packets, ident, exporter, name)
+		lines = s.appendDelta(lines, "bytes", before.Bytes, after.Bytes, ident, exporter, name)
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	select {
+	case s.queue <- lines:
+	default:
+		statsdDropped.Add(float64(len(lines)))
+	}
+
+} // End of update
+
+// appendDelta appends the counter line of a delta in the format of s
+func (s *statsdEmitter) appendDelta(lines []string, family string, before, after uint64, ident, exporter, proto string) []string {
+
+	if after <= before {
+		return lines
+	}
+	if s.dogstatsd {
+		return append(lines, fmt.Sprintf("%s.%s:%d|c|#ident:%s,exporter:%s,proto:%s",
+			s.prefix, family, after-before, statsdName(ident), exporter, proto))
+	}
+	return append(lines, fmt.Sprintf("%s.%s.%s.%s.%s:%d|c",
+		s.prefix, statsdName(ident), statsdName(exporter), proto, family, after-before))
+
+} // End of appendDelta
+
+// run sends the queued deltas until ctx is done. The queue is emptied,
+// when drained is closed, so it includes the messages the listener
+// applies on shutdown.
+func (s *statsdEmitter) run(ctx context.Context, drained <-chan struct{}) error {
+
+	conn, err := net.Dial("udp", s.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			<-drained
+			for {
+				select {
+				case lines := <-s.queue:
+					s.send(conn, lines)
+				default:
+					return nil
+				}
+			}
+		case lines := <-s.queue:
+			s.send(conn, lines)
+		}
+	}
+
+} // End of run
+
+// send writes lines in packets of at most statsdMaxPacket bytes, a
+// single longer line is sent alone
+func (s *statsdEmitter) send(conn net.Conn, lines []string) {
+
+	var packet strings.Builder
+	count := 0
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		if _, err := conn.Write([]byte(packet.String())); err != nil {
+			statsdDropped.Add(float64(count))
+			log.Printf("StatsD send to %s failed: %v\n", s.address, err)
+		} else {
+			statsdPackets.Inc()
+		}
+		packet.Reset()
+		count = 0
+	}
+
+	for _, line := range lines {
+		if count > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			flush()
+		}
+		if count > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+		count++
+	}
+	flush()
+
+} // End of send
+
+// statsdName replaces the characters, which separate names, values and
+// tags in the StatsD protocol, and white space with underscores
+func statsdName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', ',', '#':
+			return '_'
+		}
+		if unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, name)
+} // End of statsdName
@@ -0,0 +1,64 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// TestStatsdExporterLabel queues the deltas of an exporter, whose ID is
+// formatted as IPv4 address like the exporter label of the scrape
+func TestStatsdExporterLabel(t *testing.T) {
+
+	exp := exporter.New(metrics.NewStore(metrics.Options{}), exporter.Options{ValueMode: exporter.ValueModeCounter, ExporterIDAsIP: true})
+	previous := metrics.Metric{ExporterID: 0x0a000001, LastUpdate: time.Unix(1700000000, 0)}
+	current := previous
+	current.Protos[metrics.ProtoTCP] = metrics.Counters{Flows: 2}
+
+	for _, c := range []struct {
+		tags string
+		want []string
+	}{
+		{"dogstatsd", []string{"nfsen.flows:2|c|#ident:edge_1,exporter:10.0.0.1,proto:tcp"}},
+		{"plain", []string{"nfsen.edge_1.10_0_0_1.tcp.flows:2|c"}},
+	} {
+		emitter := newStatsdEmitter("127.0.0.1:0", "nfsen", c.tags, exp.ExporterLabel)
+		emitter.update("edge.1", previous, current)
+		if lines := <-emitter.queue; !reflect.DeepEqual(lines, c.want) {
+			t.Errorf("%s: queued %q, want %q", c.tags, lines, c.want)
+		}
+	}
+
+} // End of TestStatsdExporterLabel
@@ -0,0 +1,168 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * textfile writes the metrics in the text format to a file for the
+ * textfile collector of node_exporter, on hosts which run node_exporter
+ * already and should not open another scrape port.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+var textfileFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "exporter",
+	Name:      "textfile_failures_total",
+	Help:      "How many writes of the textfile failed.",
+})
+
+// textfileSkipped are the prefixes of the families, which node_exporter
+// exposes itself. They would collide with its own.
+var textfileSkipped = []string{"go_", "process_", "promhttp_"}
+
+// textfileWriter renders the metrics into a textfile
+type textfileWriter struct {
+	path    string
+	mode    os.FileMode
+	trigger chan struct{}
+}
+
+func newTextfileWriter(path string, mode os.FileMode) *textfileWriter {
+	return &textfileWriter{path: path, mode: mode, trigger: make(chan struct{}, 1)}
+} // End of newTextfileWriter
+
+// notify requests a write after a message. Requests during a write are
+// merged. It is a listener.Options.OnMessage function.
+func (t *textfileWriter) notify(ident string, list []metrics.Metric) {
+	select {
+	case t.trigger <- struct{}{}:
+	default:
+	}
+} // End of notify
+
+// run writes the metrics of exp every interval, or after each message
+// with interval 0, until ctx is done. The file is removed then, so
+// node_exporter does not expose stale values.
+func (t *textfileWriter) run(ctx context.Context, exp *exporter.Exporter, interval time.Duration) {
+
+	var tick <-chan time.Time
+	trigger := t.trigger
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		trigger = nil
+	}
+
+	t.write(ctx, exp)
+	for {
+		select {
+		case <-ctx.Done():
+			if err := os.Remove(t.path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Remove textfile %s failed: %v\n", t.path, err)
+			}
+			return
+		case <-tick:
+		case <-trigger:
+		}
+		t.write(ctx, exp)
+	}
+
+} // End of run
+
+// write renders the metrics into a temporary file in the directory of
+// the textfile and renames it into place, so node_exporter never reads
+// a partial file
+func (t *textfileWriter) write(ctx context.Context, exp *exporter.Exporter) {
+
+	if err := t.render(ctx, exp); err != nil {
+		textfileFailures.Inc()
+		log.Printf("Write textfile %s failed: %v\n", t.path, err)
+	}
+
+} // End of write
+
+func (t *textfileWriter) render(ctx context.Context, exp *exporter.Exporter) error {
+
+	families, err := outputGatherer(ctx, exp).Gather()
+	if err != nil {
+		return err
+	}
+
+	// the textfile collector reads *.prom files only
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), "."+filepath.Base(t.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	encoder := expfmt.NewEncoder(tmp, expfmt.FmtText)
+	for _, family := range families {
+		if textfileSkip(family.GetName()) {
+			continue
+		}
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Chmod(t.mode); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+
+} // End of render
+
+func textfileSkip(name string) bool {
+	for _, prefix := range textfileSkipped {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+} // End of textfileSkip
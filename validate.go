@@ -0,0 +1,832 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * validate checks the parsed command line flags for consistency before
+ * any socket or listener is opened. Every rule lives in validateFlags, so
+ * a new flag has to be considered here. The same rules run for -dry-run,
+ * which additionally prints a summary of what would be started.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"nfsen_exporter/pkg/exporter"
+)
+
+// access(2) mode bits
+const (
+	accessW = 0x2
+	accessX = 0x1
+)
+
+// validateFlags checks all flags and returns one error per failed rule.
+// With checkHost false, rules depending on the local host, such as
+// existing directories or resolvable names, are skipped.
+func validateFlags(checkHost bool) []error {
+	var errs []error
+
+	// listener
+	if err := checkListenAddress(*listenAddress, checkHost); err != nil {
+		errs = append(errs, fmt.Errorf("-listen %q: %v", *listenAddress, err))
+	}
+
+	// metrics path
+	if *metricsPathPrefix != "" {
+		if !strings.HasPrefix(*metricsPathPrefix, "/") || strings.HasSuffix(*metricsPathPrefix, "/") {
+			errs = append(errs, fmt.Errorf("-metrics-path-prefix %q: must start with '/' and not end with '/', such as /nfexporter", *metricsPathPrefix))
+		} else if path.Clean(*metricsPathPrefix) != *metricsPathPrefix {
+			errs = append(errs, fmt.Errorf("-metrics-path-prefix %q: must be a clean path, such as %s", *metricsPathPrefix, path.Clean(*metricsPathPrefix)))
+		}
+	}
+	if !strings.HasPrefix(*metricsURI, "/") {
+		errs = append(errs, fmt.Errorf("-path %q: must start with '/'", *metricsURI))
+	} else if *metricsURI == "/" {
+		errs = append(errs, fmt.Errorf("-path %q: conflicts with the landing page - use a sub path such as /metrics", *metricsURI))
+	} else if *metricsURI == healthPath || *metricsURI == readyPath {
+		errs = append(errs, fmt.Errorf("-path %q: conflicts with the health endpoint", *metricsURI))
+	} else if *enableExpvar && *metricsURI == expvarPath {
+		errs = append(errs, fmt.Errorf("-path %q: conflicts with -enable-expvar", *metricsURI))
+	}
+
+	// landing page
+	if _, err := loadLandingTemplate(*landingTemplatePath); err != nil {
+		errs = append(errs, fmt.Errorf("-web-landing-template %q: %v", *landingTemplatePath, err))
+	}
+
+	if *descriptionsPath != "" {
+		if _, err := loadDescriptions(*descriptionsPath); err != nil {
+			errs = append(errs, fmt.Errorf("-metric-descriptions-file %q: %v", *descriptionsPath, err))
+		}
+	}
+
+	// collector socket
+	if *socketPath == "" {
+		errs = append(errs, fmt.Errorf("-socket: path must not be empty"))
+	} else if *socketAbstract {
+		if runtime.GOOS != "linux" {
+			errs = append(errs, fmt.Errorf("-socket-abstract: abstract sockets exist on Linux only"))
+		}
+	} else if checkHost && !*dryRunSocket {
+		errs = append(errs, checkSocketDir(*socketPath, *socketMkdir)...)
+	}
+	if _, err := parseFileMode(*socketDirMode); err != nil {
+		errs = append(errs, fmt.Errorf("-socket-dir-mode %q: %v", *socketDirMode, err))
+	}
+
+	if *socketSELinuxLabel != "" && (*socketAbstract || *dryRunSocket) {
+		errs = append(errs, fmt.Errorf("-socket-selinux-label: needs a socket file, not used with -socket-abstract or -dry-run-socket"))
+	}
+
+	if *runAsGroup != "" && *runAsUser == "" {
+		errs = append(errs, fmt.Errorf("-run-as-group %s: needs -run-as-user", *runAsGroup))
+	}
+	if *runAsUser != "" {
+		if runtime.GOOS != "linux" {
+			errs = append(errs, fmt.Errorf("-run-as-user: dropping privileges is supported on Linux only"))
+		} else if _, err := lookupIdentity(*runAsUser, *runAsGroup); err != nil {
+			errs = append(errs, fmt.Errorf("-run-as-user %s: %v", *runAsUser, err))
+		}
+	}
+
+	if *socketWatchdog && *socketCheckInterval <= 0 {
+		errs = append(errs, fmt.Errorf("-socket-watchdog-interval %v: must be positive - use -socket-watchdog=false to disable the checks", *socketCheckInterval))
+	}
+
+	if *socketBacklog < 1 {
+		errs = append(errs, fmt.Errorf("-socket-backlog %d: must be at least 1", *socketBacklog))
+	}
+	if *maxConnIdle < 0 {
+		errs = append(errs, fmt.Errorf("-max-connection-idle %v: must not be negative - use 0 to disable", *maxConnIdle))
+	}
+	if *maxQueue < 1 {
+		errs = append(errs, fmt.Errorf("-max-message-queue %d: must be at least 1", *maxQueue))
+	}
+	if *parseWorkers < 0 {
+		errs = append(errs, fmt.Errorf("-parse-workers %d: must not be negative - use 0 for the number of CPUs", *parseWorkers))
+	}
+
+	// remote configuration
+	if *remoteConfigURL != "" {
+		if err := checkRemoteConfigURL(*remoteConfigURL); err != nil {
+			errs = append(errs, fmt.Errorf("-remote-config-url %q: %v", *remoteConfigURL, err))
+		}
+		if *remoteConfigRetries < 0 {
+			errs = append(errs, fmt.Errorf("-remote-config-retries %d: must not be negative", *remoteConfigRetries))
+		}
+	}
+
+	// log file
+	if *logFilePath != "" {
+		if *logMaxSizeMB < 0 {
+			errs = append(errs, fmt.Errorf("-log-max-size-mb %d: must not be negative - use 0 to disable the rotation", *logMaxSizeMB))
+		}
+		if *logMaxBackups < 0 {
+			errs = append(errs, fmt.Errorf("-log-max-backups %d: must not be negative", *logMaxBackups))
+		}
+		if checkHost {
+			if info, err := os.Stat(*logFilePath); err == nil && info.IsDir() {
+				errs = append(errs, fmt.Errorf("-log-file %q: path is a directory", *logFilePath))
+			} else if err := checkDirWritable(filepath.Dir(*logFilePath)); err != nil {
+				errs = append(errs, fmt.Errorf("-log-file %q: %v", *logFilePath, err))
+			}
+		}
+	}
+
+	// timeouts
+	if *scrapeTimeout < 0 {
+		errs = append(errs, fmt.Errorf("-scrape-timeout %v: must not be negative - use 0 to disable the timeout", *scrapeTimeout))
+	}
+	if *terminationDrain < 0 {
+		errs = append(errs, fmt.Errorf("-termination-drain %v: must not be negative - use 0 to shut down at once", *terminationDrain))
+	} else if *terminationDrain > 0 && *onceMode {
+		errs = append(errs, fmt.Errorf("-termination-drain: not used with -once, which serves no readiness"))
+	}
+
+	// metric expiry
+	if *metricTTL < 0 {
+		errs = append(errs, fmt.Errorf("-metric-ttl %v: must not be negative - use 0 to keep metrics forever", *metricTTL))
+	}
+	if *maxTrackedSeries < 0 {
+		errs = append(errs, fmt.Errorf("-max-tracked-series %d: must not be negative - use 0 for no limit", *maxTrackedSeries))
+	}
+
+	switch *valueMode {
+	case exporter.ValueModeCounter, exporter.ValueModeGauge, exporter.ValueModeBoth:
+	default:
+		errs = append(errs, fmt.Errorf("-value-mode %q: unknown mode - use counter, gauge or both", *valueMode))
+	}
+
+	// state file
+	if *stateFilePath != "" {
+		if checkHost {
+			if err := checkDirWritable(filepath.Dir(*stateFilePath)); err != nil {
+				errs = append(errs, fmt.Errorf("-state-file %q: %v", *stateFilePath, err))
+			}
+		}
+		if *stateInterval <= 0 {
+			errs = append(errs, fmt.Errorf("-state-interval %v: must be positive", *stateInterval))
+		}
+	}
+	if *stateMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("-state-max-age %v: must not be negative - use 0 to accept any age", *stateMaxAge))
+	}
+
+	if *exportOnlyChanged && (*remoteWriteURL != "" || *pushURL != "" || *vmImportURL != "") {
+		errs = append(errs, fmt.Errorf("-export-only-changed: not used with -remote-write-url, -push-url or -vm-import-url, they would take the changes from the scrapes"))
+	}
+
+	// remote write
+	if *remoteWriteURL != "" {
+		if u, err := url.Parse(*remoteWriteURL); err != nil {
+			errs = append(errs, fmt.Errorf("-remote-write-url %q: %v", *remoteWriteURL, err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("-remote-write-url %q: must be an http or https URL", *remoteWriteURL))
+		}
+		if *remoteWriteInterval <= 0 {
+			errs = append(errs, fmt.Errorf("-remote-write-interval %v: must be positive", *remoteWriteInterval))
+		}
+		if *remoteWriteQueue < 1 {
+			errs = append(errs, fmt.Errorf("-remote-write-queue %d: must be at least 1", *remoteWriteQueue))
+		}
+		if (*remoteWriteCertFile == "") != (*remoteWriteKeyFile == "") {
+			errs = append(errs, fmt.Errorf("-remote-write-tls-cert-file and -remote-write-tls-key-file: must be given together"))
+		} else if checkHost {
+			if _, err := remoteWriteTLSConfig(); err != nil {
+				errs = append(errs, fmt.Errorf("-remote-write-tls-*: %v", err))
+			}
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-remote-write-url: not used with -once"))
+		}
+	}
+	if *remoteWritePassword != "" && *remoteWriteUser == "" {
+		errs = append(errs, fmt.Errorf("-remote-write-password: requires -remote-write-username"))
+	}
+
+	// VictoriaMetrics import
+	if *vmImportURL != "" {
+		if u, err := url.Parse(*vmImportURL); err != nil {
+			errs = append(errs, fmt.Errorf("-vm-import-url %q: %v", *vmImportURL, err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("-vm-import-url %q: must be an http or https URL", *vmImportURL))
+		}
+		if *vmImportInterval <= 0 {
+			errs = append(errs, fmt.Errorf("-vm-import-interval %v: must be positive", *vmImportInterval))
+		}
+		if *vmSpoolMaxBytes < 1 {
+			errs = append(errs, fmt.Errorf("-vm-spool-max-bytes %d: must be at least 1", *vmSpoolMaxBytes))
+		}
+		if *vmSpoolDir != "" && checkHost {
+			if err := checkDirWritable(*vmSpoolDir); err != nil {
+				errs = append(errs, fmt.Errorf("-vm-spool-dir %q: %v", *vmSpoolDir, err))
+			}
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-vm-import-url: not used with -once"))
+		}
+	} else if *vmSpoolDir != "" {
+		errs = append(errs, fmt.Errorf("-vm-spool-dir: only used with -vm-import-url - add -vm-import-url or remove -vm-spool-dir"))
+	}
+
+	// Pushgateway
+	if *pushURL != "" {
+		if u, err := url.Parse(*pushURL); err != nil {
+			errs = append(errs, fmt.Errorf("-push-url %q: %v", *pushURL, err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("-push-url %q: must be an http or https URL", *pushURL))
+		}
+		if *pushInterval <= 0 {
+			errs = append(errs, fmt.Errorf("-push-interval %v: must be positive", *pushInterval))
+		}
+		if *pushJob == "" {
+			errs = append(errs, fmt.Errorf("-push-job: must not be empty"))
+		}
+		if *timestampedMetrics {
+			errs = append(errs, fmt.Errorf("-push-url: the Pushgateway rejects -timestamped-metrics"))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-push-url: not used with -once"))
+		}
+	}
+
+	if *histogramMode && *valueMode == exporter.ValueModeGauge {
+		errs = append(errs, fmt.Errorf("-enable-histogram-mode: not used with -value-mode gauge, which exposes no counters"))
+	}
+
+	if *perIdentHistograms {
+		if _, err := parseBuckets(*histogramBuckets); err != nil {
+			errs = append(errs, fmt.Errorf("-histogram-buckets %q: %v", *histogramBuckets, err))
+		}
+	}
+
+	if *recordFile != "" && checkHost {
+		if err := checkRecordFile(*recordFile); err != nil {
+			errs = append(errs, fmt.Errorf("-record-file %q: %v", *recordFile, err))
+		}
+	}
+
+	if *lintMetricsFlag && *onceMode {
+		errs = append(errs, fmt.Errorf("-lint-metrics: not used with -once"))
+	}
+
+	if *selfTest {
+		if _, port, err := net.SplitHostPort(*listenAddress); err == nil && port == "0" {
+			errs = append(errs, fmt.Errorf("-self-test: not used with -listen port 0, the scrape needs a known port"))
+		}
+		if *dryRunSocket {
+			errs = append(errs, fmt.Errorf("-self-test: not used with -dry-run-socket, which has no socket to send to"))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-self-test: not used with -once, which has no HTTP server"))
+		}
+		if *exportOnlyChanged {
+			errs = append(errs, fmt.Errorf("-self-test: not used with -export-only-changed, its scrapes would take the changes from the next scrape"))
+		}
+	}
+
+	if *logIntervals && *onceMode {
+		errs = append(errs, fmt.Errorf("-log-intervals: not used with -once, which prints the metrics to stdout"))
+	}
+
+	if *emaAlpha < 0 || *emaAlpha > 1 {
+		errs = append(errs, fmt.Errorf("-ema-alpha %v: must be between 0 and 1", *emaAlpha))
+	}
+
+	// InfluxDB
+	if *influxURL != "" {
+		if u, err := url.Parse(*influxURL); err != nil {
+			errs = append(errs, fmt.Errorf("-influx-url %q: %v", *influxURL, err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("-influx-url %q: must be an http or https URL", *influxURL))
+		}
+		if *influxBucket == "" {
+			errs = append(errs, fmt.Errorf("-influx-bucket: required with -influx-url"))
+		}
+		if *influxInterval <= 0 {
+			errs = append(errs, fmt.Errorf("-influx-interval %v: must be positive", *influxInterval))
+		}
+		if *influxMaxPoints < 1 {
+			errs = append(errs, fmt.Errorf("-influx-max-points %d: must be at least 1", *influxMaxPoints))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-influx-url: not used with -once"))
+		}
+	}
+
+	// Graphite
+	if *graphiteHost != "" {
+		if _, _, err := net.SplitHostPort(*graphiteHost); err != nil {
+			errs = append(errs, fmt.Errorf("-graphite-host %q: %v", *graphiteHost, err))
+		}
+		if *graphitePrefix == "" {
+			errs = append(errs, fmt.Errorf("-graphite-prefix: must not be empty"))
+		}
+		if *graphiteInterval <= 0 {
+			errs = append(errs, fmt.Errorf("-graphite-interval %v: must be positive", *graphiteInterval))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-graphite-host: not used with -once"))
+		}
+	}
+
+	// node_exporter textfile
+	if *textfilePath != "" {
+		if filepath.Ext(*textfilePath) != ".prom" {
+			errs = append(errs, fmt.Errorf("-textfile-path %q: must end with .prom, the textfile collector ignores other files", *textfilePath))
+		}
+		if checkHost {
+			if err := checkDirWritable(filepath.Dir(*textfilePath)); err != nil {
+				errs = append(errs, fmt.Errorf("-textfile-path %q: %v", *textfilePath, err))
+			}
+		}
+		if *textfileInterval < 0 {
+			errs = append(errs, fmt.Errorf("-textfile-interval %v: must not be negative - use 0 to write after each message", *textfileInterval))
+		}
+		if _, err := parseFileMode(*textfileMode); err != nil {
+			errs = append(errs, fmt.Errorf("-textfile-mode %q: %v", *textfileMode, err))
+		}
+		if *exportOnlyChanged {
+			errs = append(errs, fmt.Errorf("-textfile-path: not used with -export-only-changed"))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-textfile-path: not used with -once"))
+		}
+	}
+
+	// webhook
+	if *webhookConfigPath != "" {
+		if _, err := loadWebhookConfig(*webhookConfigPath); err != nil {
+			errs = append(errs, fmt.Errorf("-webhook-config %q: %v", *webhookConfigPath, err))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-webhook-config: not used with -once"))
+		}
+	}
+
+	// Kafka
+	if *kafkaBrokers != "" {
+		if !kafkaSupported {
+			errs = append(errs, fmt.Errorf("-kafka-brokers: %v", errKafkaUnsupported))
+		}
+		for _, broker := range strings.Split(*kafkaBrokers, ",") {
+			if _, _, err := net.SplitHostPort(broker); err != nil {
+				errs = append(errs, fmt.Errorf("-kafka-brokers %q: %v", broker, err))
+			}
+		}
+		if *kafkaTopic == "" {
+			errs = append(errs, fmt.Errorf("-kafka-topic: required with -kafka-brokers"))
+		}
+		if *kafkaBuffer < 1 {
+			errs = append(errs, fmt.Errorf("-kafka-buffer %d: must be at least 1", *kafkaBuffer))
+		}
+		if *kafkaTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("-kafka-timeout %v: must be positive", *kafkaTimeout))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-kafka-brokers: not used with -once"))
+		}
+	}
+
+	// MQTT
+	if *mqttBroker != "" {
+		if u, err := url.Parse(*mqttBroker); err != nil {
+			errs = append(errs, fmt.Errorf("-mqtt-broker %q: %v", *mqttBroker, err))
+		} else if !mqttSchemes[u.Scheme] || u.Host == "" {
+			errs = append(errs, fmt.Errorf("-mqtt-broker %q: must be a tcp, mqtt, ssl, tls, mqtts, ws or wss URL", *mqttBroker))
+		}
+		if *mqttTopicPrefix == "" || strings.ContainsAny(*mqttTopicPrefix, "+#") {
+			errs = append(errs, fmt.Errorf("-mqtt-topic-prefix %q: must not be empty or contain + or #", *mqttTopicPrefix))
+		}
+		if *mqttQoS < 0 || *mqttQoS > 2 {
+			errs = append(errs, fmt.Errorf("-mqtt-qos %d: must be 0, 1 or 2", *mqttQoS))
+		}
+		if *mqttTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("-mqtt-timeout %v: must be positive", *mqttTimeout))
+		}
+		if (*mqttCertFile == "") != (*mqttKeyFile == "") {
+			errs = append(errs, fmt.Errorf("-mqtt-tls-cert-file and -mqtt-tls-key-file: must be given together"))
+		} else if checkHost {
+			if _, err := loadTLSConfig(*mqttCAFile, *mqttCertFile, *mqttKeyFile, *mqttInsecure); err != nil {
+				errs = append(errs, fmt.Errorf("-mqtt-tls-*: %v", err))
+			}
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-mqtt-broker: not used with -once"))
+		}
+	}
+	if *mqttPassword != "" && *mqttUser == "" {
+		errs = append(errs, fmt.Errorf("-mqtt-password: requires -mqtt-username"))
+	}
+
+	// StatsD
+	if *statsdHost != "" {
+		if _, _, err := net.SplitHostPort(*statsdHost); err != nil {
+			errs = append(errs, fmt.Errorf("-statsd-host %q: %v", *statsdHost, err))
+		}
+		if *statsdPrefix == "" {
+			errs = append(errs, fmt.Errorf("-statsd-prefix: must not be empty"))
+		}
+		if *statsdTags != "dogstatsd" && *statsdTags != "plain" {
+			errs = append(errs, fmt.Errorf("-statsd-tags %q: must be dogstatsd or plain", *statsdTags))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-statsd-host: not used with -once"))
+		}
+	}
+
+	// OpenTelemetry
+	if *otlpEndpoint != "" {
+		if u, err := url.Parse(*otlpEndpoint); err != nil {
+			errs = append(errs, fmt.Errorf("-otlp-endpoint %q: %v", *otlpEndpoint, err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("-otlp-endpoint %q: must be an http or https URL - gRPC is not supported", *otlpEndpoint))
+		}
+		if *otlpInterval <= 0 {
+			errs = append(errs, fmt.Errorf("-otlp-interval %v: must be positive", *otlpInterval))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-otlp-endpoint: not used with -once"))
+		}
+	}
+	switch *otlpTemporality {
+	case temporalityCumulative, temporalityDelta:
+	default:
+		errs = append(errs, fmt.Errorf("-otlp-temporality %q: must be %s or %s", *otlpTemporality, temporalityCumulative, temporalityDelta))
+	}
+
+	// admin listener
+	if *splitListen {
+		if err := checkListenAddress(*adminAddress, checkHost); err != nil {
+			errs = append(errs, fmt.Errorf("-admin-listen %q: %v", *adminAddress, err))
+		} else if *adminAddress == *listenAddress {
+			errs = append(errs, fmt.Errorf("-admin-listen %q: must differ from -listen", *adminAddress))
+		} else if *profileAddress != "" && *adminAddress == *profileAddress {
+			errs = append(errs, fmt.Errorf("-admin-listen %q: must differ from -profile-addr", *adminAddress))
+		}
+		if *onceMode {
+			errs = append(errs, fmt.Errorf("-split-listen: not used with -once"))
+		}
+	} else if isFlagSet("admin-listen") {
+		errs = append(errs, fmt.Errorf("-admin-listen: only used with -split-listen - add -split-listen or remove -admin-listen"))
+	}
+
+	// profiling
+	if *profileAddress != "" {
+		if err := checkListenAddress(*profileAddress, checkHost); err != nil {
+			errs = append(errs, fmt.Errorf("-profile-addr %q: %v", *profileAddress, err))
+		} else if *profileAddress == *listenAddress {
+			errs = append(errs, fmt.Errorf("-profile-addr %q: must differ from -listen", *profileAddress))
+		}
+	}
+	if *mutexProfileFraction < 0 {
+		errs = append(errs, fmt.Errorf("-mutex-profile-fraction %d: must not be negative - use 0 to disable", *mutexProfileFraction))
+	}
+
+	// one-shot mode
+	if *onceWait <= 0 {
+		errs = append(errs, fmt.Errorf("-wait %v: must be positive", *onceWait))
+	}
+	if isFlagSet("wait") && !*onceMode {
+		errs = append(errs, fmt.Errorf("-wait: only used with -once - add -once or remove -wait"))
+	}
+
+	return errs
+
+} // End of validateFlags
+
+// checkListenAddress checks a host:port listen address. The host is only
+// resolved with checkHost.
+func checkListenAddress(address string, checkHost bool) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%v - use host:port, e.g. :9141", err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("invalid port %q - use a number between 0 and 65535", port)
+	}
+	if checkHost && host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("cannot resolve host %q", host)
+		}
+	}
+	return nil
+} // End of checkListenAddress
+
+// printSummary describes, what the exporter would start with the flags
+func printSummary(w io.Writer) {
+
+	socket := *socketPath
+	if *socketAbstract {
+		socket = "@" + socket + " abstract"
+	}
+	if *socketSELinuxLabel != "" {
+		socket += " label " + *socketSELinuxLabel
+	}
+	if *dryRunSocket {
+		socket = "stdin"
+	}
+	fmt.Fprintf(w, "Collector socket : %s (backlog %d, %s, queue %d)\n",
+		socket, *socketBacklog, workerSummary(), *maxQueue)
+	if *runAsUser != "" {
+		if id, err := lookupIdentity(*runAsUser, *runAsGroup); err == nil {
+			fmt.Fprintf(w, "Run as           : %s\n", id)
+		}
+	}
+	if *socketMkdir && !*socketAbstract && !*dryRunSocket {
+		if missing, err := missingDirs(*socketPath); err == nil && len(missing) > 0 {
+			fmt.Fprintf(w, "Socket directory : create %s (mode %s)\n", strings.Join(missing, ", "), *socketDirMode)
+		}
+	}
+	if watchSocket() {
+		fmt.Fprintf(w, "Socket watchdog  : every %v\n", *socketCheckInterval)
+	}
+	if *onceMode {
+		fmt.Fprintf(w, "Mode             : once, print metrics after %v\n", *onceWait)
+	} else {
+		if *splitListen {
+			fmt.Fprintf(w, "HTTP listener    : %s (metrics %s)\n", *listenAddress, *metricsPathPrefix+*metricsURI)
+			fmt.Fprintf(w, "Admin listener   : %s (health %s, ready %s)\n", *adminAddress, healthPath, readyPath)
+		} else {
+			prefix := *metricsPathPrefix
+			fmt.Fprintf(w, "HTTP listener    : %s (metrics %s, health %s, ready %s)\n",
+				*listenAddress, prefix+*metricsURI, prefix+healthPath, prefix+readyPath)
+		}
+	}
+	fmt.Fprintf(w, "Connection idle  : %v\n", *maxConnIdle)
+	fmt.Fprintf(w, "Labels           : ident, exporter, proto\n")
+	fmt.Fprintf(w, "Value mode       : %s\n", *valueMode)
+	if *logFilePath != "" {
+		if *logMaxSizeMB > 0 {
+			fmt.Fprintf(w, "Log file         : %s (rotate at %d MiB, keep %d)\n", *logFilePath, *logMaxSizeMB, *logMaxBackups)
+		} else {
+			fmt.Fprintf(w, "Log file         : %s (no rotation)\n", *logFilePath)
+		}
+	}
+	if *remoteConfigURL != "" {
+		fmt.Fprintf(w, "Remote config    : %s\n", *remoteConfigURL)
+	}
+	if *terminationDrain > 0 {
+		fmt.Fprintf(w, "Drain on signal  : %v\n", *terminationDrain)
+	}
+	if *scrapeTimeout > 0 {
+		fmt.Fprintf(w, "Scrape timeout   : %v\n", *scrapeTimeout)
+	} else {
+		fmt.Fprintf(w, "Scrape timeout   : none\n")
+	}
+	if *metricTTL > 0 {
+		fmt.Fprintf(w, "Metric TTL       : %v\n", *metricTTL)
+	} else {
+		fmt.Fprintf(w, "Metric TTL       : keep forever\n")
+	}
+	if *maxTrackedSeries > 0 {
+		fmt.Fprintf(w, "Tracked series   : at most %d exporters\n", *maxTrackedSeries)
+	}
+	fmt.Fprintf(w, "Counter resets   : %v\n", *alertFlowDrop)
+	fmt.Fprintf(w, "Monotonic        : %v\n", *monotonic)
+	fmt.Fprintf(w, "Timestamps       : %v\n", *timestampedMetrics)
+	if *exportOnlyChanged {
+		fmt.Fprintf(w, "Only changed     : true (breaks the staleness handling)\n")
+	}
+	fmt.Fprintf(w, "Runtime metrics  : %v\n", *goRuntimeMetrics)
+	if *exporterIDAsIP {
+		fmt.Fprintf(w, "Exporter label   : IPv4 address of IDs up to 32 bits\n")
+	}
+	if *histogramMode {
+		fmt.Fprintf(w, "Histogram mode   : flows, packets and bytes as histograms of the message intervals\n")
+	}
+	if *perIdentHistograms {
+		fmt.Fprintf(w, "Bytes per flow   : histogram with buckets %s\n", *histogramBuckets)
+	}
+	if *emaAlpha > 0 {
+		fmt.Fprintf(w, "Flow rate EMA    : alpha %v\n", *emaAlpha)
+	}
+	if *stateFilePath != "" {
+		fmt.Fprintf(w, "State file       : %s (save every %v, max age %v)\n",
+			*stateFilePath, *stateInterval, *stateMaxAge)
+	}
+	if *remoteWriteURL != "" {
+		fmt.Fprintf(w, "Remote write     : %s (every %v, queue %d)\n", *remoteWriteURL, *remoteWriteInterval, *remoteWriteQueue)
+	}
+	if *vmImportURL != "" {
+		spool := "memory"
+		if *vmSpoolDir != "" {
+			spool = *vmSpoolDir
+		}
+		fmt.Fprintf(w, "VictoriaMetrics  : %s (every %v, spool %s up to %d bytes)\n", *vmImportURL, *vmImportInterval, spool, *vmSpoolMaxBytes)
+	}
+	if *influxURL != "" {
+		fmt.Fprintf(w, "InfluxDB         : %s (bucket %s, every %v)\n", *influxURL, *influxBucket, *influxInterval)
+	}
+	if *graphiteHost != "" {
+		fmt.Fprintf(w, "Graphite         : %s (prefix %s, every %v)\n", *graphiteHost, *graphitePrefix, *graphiteInterval)
+	}
+	if *textfilePath != "" {
+		fmt.Fprintf(w, "Textfile         : %s (mode %s, %s)\n", *textfilePath, *textfileMode, textfileSummary())
+	}
+	if *webhookConfigPath != "" {
+		if config, err := loadWebhookConfig(*webhookConfigPath); err == nil {
+			fmt.Fprintf(w, "Webhook          : %s (threshold %v, %d overrides, cooldown %v)\n",
+				config.URL, config.Threshold, len(config.Idents), config.Cooldown)
+		}
+	}
+	if *logIntervals {
+		fmt.Fprintf(w, "Interval log     : JSON lines to stdout\n")
+	}
+	if *lintMetricsFlag {
+		fmt.Fprintf(w, "Metrics lint     : promlint every %v, %d findings suppressed\n", lintInterval, len(lintSuppressed))
+	}
+	if *selfTest {
+		fmt.Fprintf(w, "Self-test        : ident %s after the start\n", selfTestIdent)
+	}
+	if *recordFile != "" {
+		fmt.Fprintf(w, "Record file      : %s (format version %d)\n", *recordFile, recordVersion)
+	}
+	if *kafkaBrokers != "" {
+		fmt.Fprintf(w, "Kafka            : %s (topic %s, buffer %d)\n", *kafkaBrokers, *kafkaTopic, *kafkaBuffer)
+	}
+	if *mqttBroker != "" {
+		fmt.Fprintf(w, "MQTT             : %s (topics %s/<ident>/stats, QoS %d)\n", *mqttBroker, *mqttTopicPrefix, *mqttQoS)
+	}
+	if *statsdHost != "" {
+		fmt.Fprintf(w, "StatsD           : %s (prefix %s, %s)\n", *statsdHost, *statsdPrefix, *statsdTags)
+	}
+	if *otlpEndpoint != "" {
+		fmt.Fprintf(w, "OTLP export      : %s (%s, every %v)\n", *otlpEndpoint, *otlpTemporality, *otlpInterval)
+	}
+	if *pushURL != "" {
+		fmt.Fprintf(w, "Pushgateway      : %s (job %s, every %v)\n", *pushURL, *pushJob, *pushInterval)
+	}
+	if *enableExpvar {
+		fmt.Fprintf(w, "Expvar           : %s\n", expvarPath)
+	}
+	if *profileAddress != "" {
+		fmt.Fprintf(w, "Profiling        : %s (mutex fraction %d, block rate 1)\n", *profileAddress, *mutexProfileFraction)
+	}
+
+} // End of printSummary
+
+// parseBuckets parses comma separated, increasing bucket upper bounds
+func parseBuckets(list string) ([]float64, error) {
+
+	var buckets []float64
+	for _, field := range strings.Split(list, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %q: not a number", field)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket %v: must be greater than %v", bound, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+
+} // End of parseBuckets
+
+// parseFileMode parses octal file permissions like 0644
+func parseFileMode(mode string) (os.FileMode, error) {
+
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("not an octal number")
+	}
+	if perm&^0777 != 0 {
+		return 0, fmt.Errorf("only permission bits 0777 are allowed")
+	}
+	return os.FileMode(perm), nil
+
+} // End of parseFileMode
+
+// textfileSummary describes when the textfile is written
+func textfileSummary() string {
+	if *textfileInterval == 0 {
+		return "after each message"
+	}
+	return fmt.Sprintf("every %v", *textfileInterval)
+} // End of textfileSummary
+
+// workerSummary describes the -parse-workers setting
+func workerSummary() string {
+	if *parseWorkers == 0 {
+		return fmt.Sprintf("workers %d (number of CPUs)", runtime.NumCPU())
+	}
+	return fmt.Sprintf("workers %d", *parseWorkers)
+} // End of workerSummary
+
+// isFlagSet returns true, if the flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+} // End of isFlagSet
+
+// checkSocketDir verifies the directory of the socket path exists and
+// allows to create the socket file. With mkdir, a missing directory is
+// fine, if the nearest existing parent allows to create it.
+func checkSocketDir(path string, mkdir bool) []error {
+
+	dir := filepath.Dir(path)
+	if mkdir {
+		missing, err := missingDirs(path)
+		if err != nil {
+			return []error{fmt.Errorf("-socket %q: %v", path, err)}
+		}
+		if len(missing) > 0 {
+			dir = filepath.Dir(missing[0])
+		}
+	}
+	if err := checkDirWritable(dir); err != nil {
+		return []error{fmt.Errorf("-socket %q: %v", path, err)}
+	}
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return []error{fmt.Errorf("-socket %q: path is a directory", path)}
+	}
+	return nil
+
+} // End of checkSocketDir
+
+// checkRecordFile checks, that the record file at path can be created or
+// is a record file of the supported version, which is appended to
+func checkRecordFile(path string) error {
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return checkDirWritable(filepath.Dir(path))
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	return readRecordHeader(file)
+
+} // End of checkRecordFile
+
+// checkDirWritable verifies dir exists and allows to create files
+func checkDirWritable(dir string) error {
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("directory %s does not exist - create it or choose another path", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := syscall.Access(dir, accessW|accessX); err != nil {
+		return fmt.Errorf("directory %s is not writable for this user", dir)
+	}
+	return nil
+
+} // End of checkDirWritable
@@ -0,0 +1,377 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// validateCase is a combination of flags and the error it must cause,
+// "" for an accepted combination
+type validateCase struct {
+	name string
+	args []string
+	want string
+}
+
+// rejectedFlags are combinations, which validateFlags must reject
+var rejectedFlags = []validateCase{
+	// listener and paths
+	{"listen without port", []string{"-listen", "9141"}, `-listen "9141"`},
+	{"listen port out of range", []string{"-listen", ":70000"}, `invalid port "70000"`},
+	{"path prefix without slash", []string{"-metrics-path-prefix", "nfexporter"}, "-metrics-path-prefix \"nfexporter\": must start with '/'"},
+	{"path prefix with trailing slash", []string{"-metrics-path-prefix", "/nfexporter/"}, "-metrics-path-prefix \"/nfexporter/\": must start with '/'"},
+	{"path prefix not clean", []string{"-metrics-path-prefix", "/a//b"}, "must be a clean path, such as /a/b"},
+	{"path without slash", []string{"-path", "metrics"}, "-path \"metrics\": must start with '/'"},
+	{"path on landing page", []string{"-path", "/"}, "conflicts with the landing page"},
+	{"path on health endpoint", []string{"-path", healthPath}, "conflicts with the health endpoint"},
+	{"path on ready endpoint", []string{"-path", readyPath}, "conflicts with the health endpoint"},
+	{"path on expvar", []string{"-enable-expvar", "-path", expvarPath}, "conflicts with -enable-expvar"},
+	{"landing template missing", []string{"-web-landing-template", "/nonexistent/landing.html"}, "-web-landing-template"},
+	{"descriptions missing", []string{"-metric-descriptions-file", "/nonexistent/descriptions.yaml"}, "-metric-descriptions-file"},
+
+	// collector socket
+	{"socket empty", []string{"-socket", ""}, "-socket: path must not be empty"},
+	{"socket dir mode", []string{"-socket-dir-mode", "999"}, "-socket-dir-mode \"999\""},
+	{"selinux label with abstract socket", []string{"-socket-selinux-label", "system_u:object_r:var_run_t:s0", "-socket-abstract"}, "-socket-selinux-label: needs a socket file"},
+	{"selinux label with dry-run socket", []string{"-socket-selinux-label", "system_u:object_r:var_run_t:s0", "-dry-run-socket"}, "-socket-selinux-label: needs a socket file"},
+	{"group without user", []string{"-run-as-group", "nogroup"}, "-run-as-group nogroup: needs -run-as-user"},
+	{"unknown user", []string{"-run-as-user", "nfsen-exporter-no-such-user"}, "-run-as-user nfsen-exporter-no-such-user"},
+	{"socket watchdog interval", []string{"-socket-watchdog-interval", "0s"}, "-socket-watchdog-interval 0s: must be positive"},
+	{"socket backlog", []string{"-socket-backlog", "0"}, "-socket-backlog 0: must be at least 1"},
+	{"connection idle", []string{"-max-connection-idle", "-1s"}, "-max-connection-idle -1s: must not be negative"},
+	{"message queue", []string{"-max-message-queue", "0"}, "-max-message-queue 0: must be at least 1"},
+	{"parse workers", []string{"-parse-workers", "-1"}, "-parse-workers -1: must not be negative"},
+
+	// remote configuration and log file
+	{"remote config scheme", []string{"-remote-config-url", "ftp://config.example.com/nfsen"}, "scheme must be http or https"},
+	{"remote config retries", []string{"-remote-config-url", "http://config.example.com/nfsen", "-remote-config-retries", "-1"}, "-remote-config-retries -1: must not be negative"},
+	{"log file size", []string{"-log-file", "/tmp/nfsen_exporter.log", "-log-max-size-mb", "-1"}, "-log-max-size-mb -1: must not be negative"},
+	{"log file backups", []string{"-log-file", "/tmp/nfsen_exporter.log", "-log-max-backups", "-1"}, "-log-max-backups -1: must not be negative"},
+
+	// scrape and expiry
+	{"scrape timeout", []string{"-scrape-timeout", "-1s"}, "-scrape-timeout -1s: must not be negative"},
+	{"termination drain", []string{"-termination-drain", "-1s"}, "-termination-drain -1s: must not be negative"},
+	{"termination drain with once", []string{"-termination-drain", "5s", "-once"}, "-termination-drain: not used with -once"},
+	{"metric ttl", []string{"-metric-ttl", "-1s"}, "-metric-ttl -1s: must not be negative"},
+	{"tracked series", []string{"-max-tracked-series", "-1"}, "-max-tracked-series -1: must not be negative"},
+	{"value mode", []string{"-value-mode", "rate"}, "-value-mode \"rate\": unknown mode"},
+	{"state interval", []string{"-state-file", "/tmp/nfsen_exporter.state", "-state-interval", "0s"}, "-state-interval 0s: must be positive"},
+	{"state age", []string{"-state-max-age", "-1s"}, "-state-max-age -1s: must not be negative"},
+	{"only changed with remote write", []string{"-export-only-changed", "-remote-write-url", "http://prometheus:9090/api/v1/write"}, "-export-only-changed: not used with"},
+	{"only changed with push", []string{"-export-only-changed", "-push-url", "http://pushgateway:9091"}, "-export-only-changed: not used with"},
+	{"only changed with vm import", []string{"-export-only-changed", "-vm-import-url", "http://victoria:8428"}, "-export-only-changed: not used with"},
+	{"histograms with gauges", []string{"-enable-histogram-mode", "-value-mode", "gauge"}, "-enable-histogram-mode: not used with -value-mode gauge"},
+	{"histogram buckets", []string{"-enable-per-ident-histograms", "-histogram-buckets", "100,10"}, "-histogram-buckets \"100,10\""},
+	{"ema alpha", []string{"-ema-alpha", "2"}, "-ema-alpha 2: must be between 0 and 1"},
+	{"lint with once", []string{"-lint-metrics", "-once"}, "-lint-metrics: not used with -once"},
+	{"self-test with port 0", []string{"-self-test", "-listen", ":0"}, "-self-test: not used with -listen port 0"},
+	{"self-test with dry-run socket", []string{"-self-test", "-dry-run-socket"}, "-self-test: not used with -dry-run-socket"},
+	{"self-test with once", []string{"-self-test", "-once"}, "-self-test: not used with -once"},
+	{"self-test with only changed", []string{"-self-test", "-export-only-changed"}, "-self-test: not used with -export-only-changed"},
+	{"interval log with once", []string{"-log-intervals", "-once"}, "-log-intervals: not used with -once"},
+
+	// remote write
+	{"remote write scheme", []string{"-remote-write-url", "ftp://prometheus:9090"}, "must be an http or https URL"},
+	{"remote write interval", []string{"-remote-write-url", "http://prometheus:9090/api/v1/write", "-remote-write-interval", "0s"}, "-remote-write-interval 0s: must be positive"},
+	{"remote write queue", []string{"-remote-write-url", "http://prometheus:9090/api/v1/write", "-remote-write-queue", "0"}, "-remote-write-queue 0: must be at least 1"},
+	{"remote write cert without key", []string{"-remote-write-url", "http://prometheus:9090/api/v1/write", "-remote-write-tls-cert-file", "client.pem"}, "must be given together"},
+	{"remote write with once", []string{"-remote-write-url", "http://prometheus:9090/api/v1/write", "-once"}, "-remote-write-url: not used with -once"},
+	{"remote write password without user", []string{"-remote-write-password", "secret"}, "-remote-write-password: requires -remote-write-username"},
+
+	// VictoriaMetrics import
+	{"vm import scheme", []string{"-vm-import-url", "victoria:8428"}, "must be an http or https URL"},
+	{"vm import interval", []string{"-vm-import-url", "http://victoria:8428", "-vm-import-interval", "0s"}, "-vm-import-interval 0s: must be positive"},
+	{"vm spool size", []string{"-vm-import-url", "http://victoria:8428", "-vm-spool-max-bytes", "0"}, "-vm-spool-max-bytes 0: must be at least 1"},
+	{"vm import with once", []string{"-vm-import-url", "http://victoria:8428", "-once"}, "-vm-import-url: not used with -once"},
+	{"vm spool without import", []string{"-vm-spool-dir", "/var/spool/nfsen"}, "-vm-spool-dir: only used with -vm-import-url"},
+
+	// Pushgateway
+	{"push scheme", []string{"-push-url", "pushgateway:9091"}, "must be an http or https URL"},
+	{"push interval", []string{"-push-url", "http://pushgateway:9091", "-push-interval", "0s"}, "-push-interval 0s: must be positive"},
+	{"push job", []string{"-push-url", "http://pushgateway:9091", "-push-job", ""}, "-push-job: must not be empty"},
+	{"push with timestamps", []string{"-push-url", "http://pushgateway:9091", "-timestamped-metrics"}, "the Pushgateway rejects -timestamped-metrics"},
+	{"push with once", []string{"-push-url", "http://pushgateway:9091", "-once"}, "-push-url: not used with -once"},
+
+	// InfluxDB
+	{"influx scheme", []string{"-influx-url", "influx:8086", "-influx-bucket", "nfsen"}, "must be an http or https URL"},
+	{"influx without bucket", []string{"-influx-url", "http://influx:8086"}, "-influx-bucket: required with -influx-url"},
+	{"influx interval", []string{"-influx-url", "http://influx:8086", "-influx-bucket", "nfsen", "-influx-interval", "0s"}, "-influx-interval 0s: must be positive"},
+	{"influx points", []string{"-influx-url", "http://influx:8086", "-influx-bucket", "nfsen", "-influx-max-points", "0"}, "-influx-max-points 0: must be at least 1"},
+	{"influx with once", []string{"-influx-url", "http://influx:8086", "-influx-bucket", "nfsen", "-once"}, "-influx-url: not used with -once"},
+
+	// Graphite
+	{"graphite without port", []string{"-graphite-host", "carbon"}, "-graphite-host \"carbon\""},
+	{"graphite prefix", []string{"-graphite-host", "carbon:2003", "-graphite-prefix", ""}, "-graphite-prefix: must not be empty"},
+	{"graphite interval", []string{"-graphite-host", "carbon:2003", "-graphite-interval", "0s"}, "-graphite-interval 0s: must be positive"},
+	{"graphite with once", []string{"-graphite-host", "carbon:2003", "-once"}, "-graphite-host: not used with -once"},
+
+	// node_exporter textfile
+	{"textfile extension", []string{"-textfile-path", "/tmp/nfsen.txt"}, "must end with .prom"},
+	{"textfile interval", []string{"-textfile-path", "/tmp/nfsen.prom", "-textfile-interval", "-1s"}, "-textfile-interval -1s: must not be negative"},
+	{"textfile mode", []string{"-textfile-path", "/tmp/nfsen.prom", "-textfile-mode", "rw"}, "-textfile-mode \"rw\""},
+	{"textfile with only changed", []string{"-textfile-path", "/tmp/nfsen.prom", "-export-only-changed"}, "-textfile-path: not used with -export-only-changed"},
+	{"textfile with once", []string{"-textfile-path", "/tmp/nfsen.prom", "-once"}, "-textfile-path: not used with -once"},
+
+	// webhook
+	{"webhook config missing", []string{"-webhook-config", "/nonexistent/webhook.yaml"}, "-webhook-config \"/nonexistent/webhook.yaml\""},
+	{"webhook with once", []string{"-webhook-config", "/nonexistent/webhook.yaml", "-once"}, "-webhook-config: not used with -once"},
+
+	// Kafka
+	{"kafka broker without port", []string{"-kafka-brokers", "kafka"}, "-kafka-brokers \"kafka\""},
+	{"kafka topic", []string{"-kafka-brokers", "kafka:9092", "-kafka-topic", ""}, "-kafka-topic: required with -kafka-brokers"},
+	{"kafka buffer", []string{"-kafka-brokers", "kafka:9092", "-kafka-buffer", "0"}, "-kafka-buffer 0: must be at least 1"},
+	{"kafka timeout", []string{"-kafka-brokers", "kafka:9092", "-kafka-timeout", "0s"}, "-kafka-timeout 0s: must be positive"},
+	{"kafka with once", []string{"-kafka-brokers", "kafka:9092", "-once"}, "-kafka-brokers: not used with -once"},
+
+	// MQTT
+	{"mqtt scheme", []string{"-mqtt-broker", "http://mosquitto:1883"}, "must be a tcp, mqtt, ssl, tls, mqtts, ws or wss URL"},
+	{"mqtt topic wildcard", []string{"-mqtt-broker", "tcp://mosquitto:1883", "-mqtt-topic-prefix", "nfsen/#"}, "must not be empty or contain + or #"},
+	{"mqtt qos", []string{"-mqtt-broker", "tcp://mosquitto:1883", "-mqtt-qos", "3"}, "-mqtt-qos 3: must be 0, 1 or 2"},
+	{"mqtt timeout", []string{"-mqtt-broker", "tcp://mosquitto:1883", "-mqtt-timeout", "0s"}, "-mqtt-timeout 0s: must be positive"},
+	{"mqtt key without cert", []string{"-mqtt-broker", "tcp://mosquitto:1883", "-mqtt-tls-key-file", "client.key"}, "must be given together"},
+	{"mqtt with once", []string{"-mqtt-broker", "tcp://mosquitto:1883", "-once"}, "-mqtt-broker: not used with -once"},
+	{"mqtt password without user", []string{"-mqtt-password", "secret"}, "-mqtt-password: requires -mqtt-username"},
+
+	// StatsD
+	{"statsd without port", []string{"-statsd-host", "statsd"}, "-statsd-host \"statsd\""},
+	{"statsd prefix", []string{"-statsd-host", "statsd:8125", "-statsd-prefix", ""}, "-statsd-prefix: must not be empty"},
+	{"statsd tags", []string{"-statsd-host", "statsd:8125", "-statsd-tags", "influx"}, "-statsd-tags \"influx\""},
+	{"statsd with once", []string{"-statsd-host", "statsd:8125", "-once"}, "-statsd-host: not used with -once"},
+
+	// OpenTelemetry
+	{"otlp grpc", []string{"-otlp-endpoint", "grpc://collector:4317"}, "gRPC is not supported"},
+	{"otlp interval", []string{"-otlp-endpoint", "http://collector:4318/v1/metrics", "-otlp-interval", "0s"}, "-otlp-interval 0s: must be positive"},
+	{"otlp with once", []string{"-otlp-endpoint", "http://collector:4318/v1/metrics", "-once"}, "-otlp-endpoint: not used with -once"},
+	{"otlp temporality", []string{"-otlp-temporality", "gauge"}, "-otlp-temporality \"gauge\""},
+
+	// admin listener and profiling
+	{"admin on listen", []string{"-split-listen", "-admin-listen", ":9141"}, "-admin-listen \":9141\": must differ from -listen"},
+	{"admin on profile", []string{"-split-listen", "-admin-listen", ":9142", "-profile-addr", ":9142"}, "must differ from -profile-addr"},
+	{"split listen with once", []string{"-split-listen", "-once"}, "-split-listen: not used with -once"},
+	{"admin without split listen", []string{"-admin-listen", ":9142"}, "-admin-listen: only used with -split-listen"},
+	{"profile on listen", []string{"-profile-addr", ":9141"}, "-profile-addr \":9141\": must differ from -listen"},
+	{"profile without port", []string{"-profile-addr", "localhost"}, "-profile-addr \"localhost\""},
+	{"mutex fraction", []string{"-mutex-profile-fraction", "-1"}, "-mutex-profile-fraction -1: must not be negative"},
+
+	// one-shot mode
+	{"wait not positive", []string{"-once", "-wait", "0s"}, "-wait 0s: must be positive"},
+	{"wait without once", []string{"-wait", "5s"}, "-wait: only used with -once"},
+}
+
+// acceptedFlags are combinations, which validateFlags must accept
+var acceptedFlags = []validateCase{
+	{name: "defaults"},
+	{name: "once", args: []string{"-once", "-wait", "5s", "-enable-go-runtime-metrics"}},
+	{name: "paths", args: []string{"-metrics-path-prefix", "/nfexporter", "-path", "/nfsen/metrics", "-enable-expvar"}},
+	{name: "socket", args: []string{"-socket", "/run/nfsen/nfsen.sock", "-socket-mkdir=false", "-socket-dir-mode", "0750",
+		"-socket-backlog", "512", "-socket-watchdog=false", "-socket-watchdog-interval", "0s",
+		"-max-connection-idle", "0s", "-max-message-queue", "1", "-parse-workers", "0", "-record-file", "/tmp/nfsen.rec"}},
+	{name: "dry-run socket", args: []string{"-dry-run", "-dry-run-socket"}},
+	{name: "privileges", args: []string{"-run-as-user", "root", "-run-as-group", "root"}},
+	{name: "logging", args: []string{"-log-file", "/tmp/nfsen_exporter.log", "-log-max-size-mb", "0", "-log-max-backups", "0", "-log-intervals"}},
+	{name: "remote config", args: []string{"-remote-config-url", "https://config.example.com/nfsen", "-remote-config-retries", "0"}},
+	{name: "collector", args: []string{"-metric-ttl", "0s", "-max-tracked-series", "0", "-monotonic", "-alert-on-flow-drop",
+		"-exporter-id-as-ip", "-timestamped-metrics", "-ema-alpha", "1", "-value-mode", "both", "-enable-histogram-mode",
+		"-enable-per-ident-histograms", "-histogram-buckets", "10,100,1000"}},
+	{name: "scrapes", args: []string{"-scrape-timeout", "0s", "-termination-drain", "5s", "-lint-metrics", "-self-test",
+		"-metric-descriptions-file", ""}},
+	{name: "only changed", args: []string{"-export-only-changed", "-graphite-host", "carbon:2003", "-influx-url", "http://influx:8086", "-influx-bucket", "nfsen"}},
+	{name: "state", args: []string{"-state-file", "/tmp/nfsen_exporter.state", "-state-interval", "1m", "-state-max-age", "0s"}},
+	{name: "remote write", args: []string{"-remote-write-url", "https://prometheus:9090/api/v1/write", "-remote-write-interval", "30s",
+		"-remote-write-queue", "1", "-remote-write-username", "nfsen", "-remote-write-password", "secret",
+		"-remote-write-tls-cert-file", "client.pem", "-remote-write-tls-key-file", "client.key",
+		"-remote-write-tls-ca-file", "ca.pem", "-remote-write-tls-insecure-skip-verify"}},
+	{name: "vm import", args: []string{"-vm-import-url", "http://victoria:8428", "-vm-import-interval", "30s",
+		"-vm-spool-dir", "/var/spool/nfsen", "-vm-spool-max-bytes", "1"}},
+	{name: "push", args: []string{"-push-url", "http://pushgateway:9091", "-push-interval", "30s", "-push-job", "nfsen"}},
+	{name: "influx", args: []string{"-influx-url", "https://influx:8086", "-influx-org", "noc", "-influx-bucket", "nfsen",
+		"-influx-token", "secret", "-influx-interval", "10s", "-influx-max-points", "1"}},
+	{name: "graphite", args: []string{"-graphite-host", "carbon:2003", "-graphite-prefix", "nfsen", "-graphite-interval", "1m"}},
+	{name: "textfile", args: []string{"-textfile-path", "/tmp/nfsen.prom", "-textfile-interval", "0s", "-textfile-mode", "0600"}},
+	{name: "mqtt", args: []string{"-mqtt-broker", "ssl://mosquitto:8883", "-mqtt-client-id", "nfsen", "-mqtt-topic-prefix", "nfsen",
+		"-mqtt-qos", "2", "-mqtt-timeout", "1s", "-mqtt-username", "nfsen", "-mqtt-password", "secret",
+		"-mqtt-tls-ca-file", "ca.pem", "-mqtt-tls-cert-file", "client.pem", "-mqtt-tls-key-file", "client.key",
+		"-mqtt-tls-insecure-skip-verify"}},
+	{name: "statsd", args: []string{"-statsd-host", "statsd:8125", "-statsd-prefix", "nfsen", "-statsd-tags", "plain"}},
+	{name: "otlp", args: []string{"-otlp-endpoint", "http://collector:4318/v1/metrics", "-otlp-interval", "1m", "-otlp-temporality", "delta"}},
+	{name: "split listen", args: []string{"-listen", ":9141", "-split-listen", "-admin-listen", "127.0.0.1:9142",
+		"-profile-addr", "127.0.0.1:6060", "-mutex-profile-fraction", "0"}},
+	{name: "landing template", args: []string{"-web-landing-template", ""}},
+}
+
+// hostFlags are combinations, whose rules depend on the local host. dir
+// in the args is replaced with a temporary directory.
+var hostFlags = []validateCase{
+	{"socket dir missing", []string{"-socket", "{dir}/missing/nfsen.sock", "-socket-mkdir=false"}, "-socket \"{dir}/missing/nfsen.sock\": directory {dir}/missing does not exist"},
+	{"socket is dir", []string{"-socket", "{dir}"}, "-socket \"{dir}\": path is a directory"},
+	{"socket dir created", []string{"-socket", "{dir}/missing/nfsen.sock"}, ""},
+	{"log file is dir", []string{"-log-file", "{dir}"}, "-log-file \"{dir}\": path is a directory"},
+	{"log file dir missing", []string{"-log-file", "{dir}/missing/nfsen.log"}, "-log-file \"{dir}/missing/nfsen.log\": directory {dir}/missing does not exist"},
+	{"state dir missing", []string{"-state-file", "{dir}/missing/nfsen.state"}, "-state-file \"{dir}/missing/nfsen.state\""},
+	{"textfile dir missing", []string{"-textfile-path", "{dir}/missing/nfsen.prom"}, "-textfile-path \"{dir}/missing/nfsen.prom\""},
+	{"vm spool dir missing", []string{"-vm-import-url", "http://victoria:8428", "-vm-spool-dir", "{dir}/missing"}, "-vm-spool-dir \"{dir}/missing\""},
+	{"record dir missing", []string{"-record-file", "{dir}/missing/nfsen.rec"}, "-record-file \"{dir}/missing/nfsen.rec\""},
+	{"files in dir", []string{"-socket", "{dir}/nfsen.sock", "-log-file", "{dir}/nfsen.log", "-state-file", "{dir}/nfsen.state",
+		"-textfile-path", "{dir}/nfsen.prom", "-record-file", "{dir}/nfsen.rec"}, ""},
+}
+
+// parseTestFlags resets all flags to their defaults and parses args as a
+// new command line, so isFlagSet sees the flags of args only. The
+// command line is restored after the test.
+func parseTestFlags(t *testing.T, args []string) {
+
+	saved := flag.CommandLine
+	t.Cleanup(func() {
+		flag.CommandLine = saved
+		resetFlags(t, saved)
+	})
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	resetFlags(t, saved)
+	saved.VisitAll(func(f *flag.Flag) {
+		if !isTestingFlag(f.Name) {
+			flags.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	flag.CommandLine = flags
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("parse %v: %v", args, err)
+	}
+
+} // End of parseTestFlags
+
+// resetFlags sets the exporter flags of flags to their defaults
+func resetFlags(t *testing.T, flags *flag.FlagSet) {
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if isTestingFlag(f.Name) {
+			return
+		}
+		if err := f.Value.Set(f.DefValue); err != nil {
+			t.Fatalf("reset -%s: %v", f.Name, err)
+		}
+	})
+
+} // End of resetFlags
+
+// isTestingFlag tells, if name is a flag of the testing package
+func isTestingFlag(name string) bool {
+	return strings.HasPrefix(name, "test.")
+} // End of isTestingFlag
+
+// checkValidation validates the flags of c and compares the errors
+func checkValidation(t *testing.T, c validateCase, checkHost bool) {
+
+	parseTestFlags(t, c.args)
+	errs := validateFlags(checkHost)
+	if c.want == "" {
+		for _, err := range errs {
+			t.Errorf("%v: unexpected error: %v", c.args, err)
+		}
+		return
+	}
+	for _, err := range errs {
+		if strings.Contains(err.Error(), c.want) {
+			return
+		}
+	}
+	t.Errorf("%v: got %v, want an error containing %q", c.args, errs, c.want)
+
+} // End of checkValidation
+
+func TestValidateFlagsRejected(t *testing.T) {
+
+	for _, c := range rejectedFlags {
+		t.Run(c.name, func(t *testing.T) {
+			checkValidation(t, c, false)
+		})
+	}
+
+} // End of TestValidateFlagsRejected
+
+func TestValidateFlagsAccepted(t *testing.T) {
+
+	for _, c := range acceptedFlags {
+		t.Run(c.name, func(t *testing.T) {
+			if runtime.GOOS != "linux" && strings.Contains(strings.Join(c.args, " "), "-run-as-user") {
+				t.Skip("dropping privileges is supported on Linux only")
+			}
+			checkValidation(t, c, false)
+		})
+	}
+
+} // End of TestValidateFlagsAccepted
+
+func TestValidateFlagsHost(t *testing.T) {
+
+	for _, c := range hostFlags {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			replace := func(s string) string {
+				return strings.ReplaceAll(s, "{dir}", dir)
+			}
+			args := make([]string, len(c.args))
+			for i, arg := range c.args {
+				args[i] = replace(arg)
+			}
+			checkValidation(t, validateCase{args: args, want: replace(c.want)}, true)
+		})
+	}
+
+} // End of TestValidateFlagsHost
+
+// TestValidateFlagsCoverage requires each flag in a case, so a new flag
+// gets its validation rules decided
+func TestValidateFlagsCoverage(t *testing.T) {
+
+	covered := make(map[string]bool)
+	for _, cases := range [][]validateCase{rejectedFlags, acceptedFlags, hostFlags} {
+		for _, c := range cases {
+			for _, arg := range c.args {
+				if strings.HasPrefix(arg, "-") {
+					name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+					covered[name] = true
+				}
+			}
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !isTestingFlag(f.Name) && !covered[f.Name] {
+			t.Errorf("-%s: no validation case - add it to rejectedFlags or acceptedFlags", f.Name)
+		}
+	})
+
+} // End of TestValidateFlagsCoverage
@@ -0,0 +1,430 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * vmimport pushes the gathered metrics to the JSON line import endpoint
+ * of VictoriaMetrics. Batches wait in a spool, in memory or on disk,
+ * until they are sent, so short outages of the link lose no samples.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+
+	"nfsen_exporter/pkg/exporter"
+	"nfsen_exporter/pkg/metrics"
+)
+
+// import retries of a batch, which failed with a network error or a
+// server error. The backoff doubles with each retry.
+const (
+	vmImportRetries = 3
+	vmImportBackoff = time.Second
+	// vmSpoolSuffix marks the complete batches in the spool directory
+	vmSpoolSuffix = ".json.gz"
+)
+
+var (
+	vmImportFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "vm_import_failures_total",
+		Help:      "How many imports to VictoriaMetrics failed after all retries.",
+	})
+	vmImportDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "vm_import_dropped_total",
+		Help:      "How many batches have been dropped, because the spool exceeded its size or VictoriaMetrics rejected them.",
+	})
+	vmSpoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "vm_import_spool_bytes",
+		Help:      "Size of the batches waiting for VictoriaMetrics in bytes.",
+	})
+)
+
+// vmSeries is a line of the JSON line import format
+type vmSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// vmBatch is a gzip compressed import request in the spool
+type vmBatch struct {
+	name string
+	data []byte
+}
+
+// vmSpool keeps the batches in order until they are sent. Without dir,
+// they are kept in memory. Beyond maxBytes, the oldest are dropped.
+type vmSpool struct {
+	dir      string
+	maxBytes int64
+
+	mutex   sync.Mutex
+	batches []vmBatch
+	size    int64
+	last    int64
+}
+
+// newVMSpool returns a spool in dir, which keeps the batches of a
+// previous run
+func newVMSpool(dir string, maxBytes int64) (*vmSpool, error) {
+
+	spool := &vmSpool{dir: dir, maxBytes: maxBytes}
+	if dir == "" {
+		return spool, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), vmSpoolSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		spool.batches = append(spool.batches, vmBatch{name: entry.Name()})
+		spool.size += info.Size()
+	}
+	// the names are zero padded times, so they sort in order
+	sort.Slice(spool.batches, func(i, j int) bool { return spool.batches[i].name < spool.batches[j].name })
+	if len(spool.batches) > 0 {
+		log.Printf("VictoriaMetrics spool %s: %d batches of a previous run\n", dir, len(spool.batches))
+	}
+	spool.trim()
+	return spool, nil
+
+} // End of newVMSpool
+
+// add appends a batch. On disk, it is written to a temporary file and
+// renamed, so a crash leaves no partial batch.
+func (s *vmSpool) add(data []byte) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// unique, increasing names, even if the clock goes back
+	now := time.Now().UnixNano()
+	if now <= s.last {
+		now = s.last + 1
+	}
+	s.last = now
+	batch := vmBatch{name: fmt.Sprintf("%020d%s", now, vmSpoolSuffix)}
+
+	if s.dir == "" {
+		batch.data = data
+	} else {
+		tmp, err := os.CreateTemp(s.dir, ".batch.*.tmp")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), filepath.Join(s.dir, batch.name))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	s.batches = append(s.batches, batch)
+	s.size += int64(len(data))
+	s.trim()
+	return nil
+
+} // End of add
+
+// trim drops the oldest batches beyond maxBytes. Call it with the mutex
+// held.
+func (s *vmSpool) trim() {
+
+	dropped := 0
+	for s.size > s.maxBytes && len(s.batches) > 0 {
+		s.removeFirst()
+		dropped++
+	}
+	if dropped > 0 {
+		vmImportDropped.Add(float64(dropped))
+		log.Printf("VictoriaMetrics spool full - dropped the %d oldest batches\n", dropped)
+	}
+	vmSpoolBytes.Set(float64(s.size))
+
+} // End of trim
+
+// first returns the oldest batch
+func (s *vmSpool) first() (vmBatch, bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.batches) == 0 {
+		return vmBatch{}, false, nil
+	}
+	batch := s.batches[0]
+	if s.dir != "" {
+		data, err := os.ReadFile(filepath.Join(s.dir, batch.name))
+		if err != nil {
+			return vmBatch{}, false, err
+		}
+		batch.data = data
+	}
+	return batch, true, nil
+
+} // End of first
+
+// remove removes the batch returned by first, unless trim dropped it
+// in the meantime
+func (s *vmSpool) remove(batch vmBatch) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.batches) > 0 && s.batches[0].name == batch.name {
+		s.removeFirst()
+	}
+	vmSpoolBytes.Set(float64(s.size))
+
+} // End of remove
+
+// removeFirst removes the oldest batch. Call it with the mutex held.
+func (s *vmSpool) removeFirst() {
+
+	batch := s.batches[0]
+	s.batches = s.batches[1:]
+	if s.dir == "" {
+		s.size -= int64(len(batch.data))
+		return
+	}
+	path := filepath.Join(s.dir, batch.name)
+	if info, err := os.Stat(path); err == nil {
+		s.size -= info.Size()
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("VictoriaMetrics spool: %v\n", err)
+	}
+
+} // End of removeFirst
+
+// runVMImport gathers the metrics of exp every interval into the spool
+// and sends the spooled batches to url, until ctx is done. Batches,
+// which could not be sent, are sent again after the next gather.
+func runVMImport(ctx context.Context, exp *exporter.Exporter, url string, interval time.Duration, spool *vmSpool) {
+
+	client := &http.Client{Timeout: interval}
+	ready := make(chan struct{}, 1)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ready:
+			}
+			vmImportSpool(ctx, client, url, spool)
+		}
+	}()
+	defer func() {
+		<-sent
+		spool.mutex.Lock()
+		if spool.dir == "" && len(spool.batches) > 0 {
+			log.Printf("VictoriaMetrics: %d batches not sent on shutdown\n", len(spool.batches))
+		}
+		spool.mutex.Unlock()
+	}()
+
+	// send the batches of a previous run
+	ready <- struct{}{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		series, err := gatherTimeSeries(ctx, exp, interval)
+		if err != nil {
+			vmImportFailures.Inc()
+			log.Printf("VictoriaMetrics gather failed: %v\n", err)
+			continue
+		}
+		data, err := vmImportBatch(series)
+		if err == nil {
+			err = spool.add(data)
+		}
+		if err != nil {
+			vmImportFailures.Inc()
+			log.Printf("VictoriaMetrics spool failed: %v\n", err)
+			continue
+		}
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}
+
+} // End of runVMImport
+
+// vmImportSpool sends the spooled batches in order, until the spool is
+// empty or a batch fails
+func vmImportSpool(ctx context.Context, client *http.Client, url string, spool *vmSpool) {
+
+	for ctx.Err() == nil {
+		batch, ok, err := spool.first()
+		if err != nil {
+			vmImportFailures.Inc()
+			log.Printf("VictoriaMetrics spool read failed: %v\n", err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		backoff := vmImportBackoff
+		for try := 0; ; try++ {
+			retry, err := vmImport(ctx, client, url, batch.data)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if !retry {
+				// sending it again gives the same answer
+				vmImportDropped.Inc()
+				log.Printf("VictoriaMetrics import to %s rejected, drop batch: %v\n", url, err)
+				break
+			}
+			if try == vmImportRetries {
+				vmImportFailures.Inc()
+				log.Printf("VictoriaMetrics import to %s failed, keep %s for the next interval: %v\n", url, batch.name, err)
+				return
+			}
+			log.Printf("VictoriaMetrics import to %s failed, retry in %v: %v\n", url, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		spool.remove(batch)
+	}
+
+} // End of vmImportSpool
+
+// vmImportBatch renders series as gzip compressed JSON lines. Samples,
+// which are not finite, cannot be written as JSON and are skipped.
+func vmImportBatch(series []prompb.TimeSeries) ([]byte, error) {
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(writer)
+	for _, s := range series {
+		line := vmSeries{Metric: make(map[string]string, len(s.Labels))}
+		for _, label := range s.Labels {
+			line.Metric[label.Name] = label.Value
+		}
+		for _, sample := range s.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue
+			}
+			line.Values = append(line.Values, sample.Value)
+			line.Timestamps = append(line.Timestamps, sample.Timestamp)
+		}
+		if len(line.Values) == 0 {
+			continue
+		}
+		if err := encoder.Encode(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+
+} // End of vmImportBatch
+
+// vmImport posts a batch to url. retry tells, if the request may
+// succeed, when it is sent again: after a network error, 429 or a 5xx
+// status.
+func vmImport(ctx context.Context, client *http.Client, url string, data []byte) (retry bool, err error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "nfsen_exporter/"+version)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return false, nil
+
+} // End of vmImport
@@ -0,0 +1,395 @@
+/*
+ *  Copyright (c) 2021, Peter Haag
+ *  All rights reserved.
+ *
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *   * Neither the name of the author nor the names of its contributors may be
+ *     used to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+/*
+ * webhook notifies a webhook, e.g. of Slack, when an ident stops sending
+ * messages for longer than a threshold and when it recovers, for sites
+ * without Prometheus alerting.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+
+	"nfsen_exporter/pkg/metrics"
+)
+
+// webhook retries of a notification, which failed with a network error
+// or a server error. The backoff doubles with each retry.
+const (
+	webhookRetries   = 3
+	webhookBackoff   = time.Second
+	webhookTimeout   = 10 * time.Second
+	webhookQueueSize = 100
+)
+
+// states of an ident in the notifications
+const (
+	webhookSilent    = "silent"
+	webhookRecovered = "recovered"
+)
+
+var (
+	webhookNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "webhook_notifications_total",
+		Help:      "How many webhook notifications have been sent, by state silent or recovered.",
+	}, []string{"state"})
+	webhookFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "exporter",
+		Name:      "webhook_failures_total",
+		Help:      "How many webhook notifications failed after all retries or were dropped, because the queue was full.",
+	})
+)
+
+// webhookConfig is the YAML file of -webhook-config
+type webhookConfig struct {
+	// URL receives the notifications as POST requests
+	URL string `yaml:"url"`
+	// Threshold is the time without message, after which an ident is silent
+	Threshold time.Duration `yaml:"threshold"`
+	// Idents overrides Threshold per ident
+	Idents map[string]time.Duration `yaml:"idents"`
+	// Cooldown is the minimum time between two notifications of an ident.
+	// A flapping ident is notified with its latest state after it.
+	Cooldown time.Duration `yaml:"cooldown"`
+	// CheckInterval is the interval to compare the idents with the threshold
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// Template is a text/template of the request body. Empty sends JSON.
+	Template string `yaml:"template"`
+}
+
+// webhookEvent is the data of a notification and of the template
+type webhookEvent struct {
+	Ident     string        `json:"ident"`
+	State     string        `json:"state"`
+	LastSeen  time.Time     `json:"last_seen"`
+	Silence   time.Duration `json:"-"`
+	Threshold time.Duration `json:"-"`
+	// the durations in seconds for the JSON body
+	SilenceSeconds   float64 `json:"silence_seconds"`
+	ThresholdSeconds float64 `json:"threshold_seconds"`
+}
+
+// webhookIdent is the tracked state of an ident
+type webhookIdent struct {
+	lastSeen time.Time
+	// notified is the state of the last notification, empty before
+	notified     string
+	lastNotified time.Time
+}
+
+// webhookNotifier tracks the last message of each ident
+type webhookNotifier struct {
+	config   webhookConfig
+	template *template.Template
+	queue    chan webhookEvent
+
+	mutex  sync.Mutex
+	idents map[string]*webhookIdent
+}
+
+// loadWebhookConfig reads and checks the YAML file of -webhook-config
+func loadWebhookConfig(path string) (webhookConfig, error) {
+
+	config := webhookConfig{
+		Cooldown:      time.Hour,
+		CheckInterval: 30 * time.Second,
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return config, err
+	}
+
+	if u, err := url.Parse(config.URL); err != nil {
+		return config, fmt.Errorf("url %q: %v", config.URL, err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return config, fmt.Errorf("url %q: must be an http or https URL", config.URL)
+	}
+	if config.Threshold <= 0 {
+		return config, fmt.Errorf("threshold %v: must be positive", config.Threshold)
+	}
+	for ident, threshold := range config.Idents {
+		if threshold <= 0 {
+			return config, fmt.Errorf("idents %q: threshold %v must be positive", ident, threshold)
+		}
+	}
+	if config.Cooldown < 0 {
+		return config, fmt.Errorf("cooldown %v: must not be negative", config.Cooldown)
+	}
+	if config.CheckInterval <= 0 {
+		return config, fmt.Errorf("check_interval %v: must be positive", config.CheckInterval)
+	}
+	if _, err := parseWebhookTemplate(config.Template); err != nil {
+		return config, fmt.Errorf("template: %v", err)
+	}
+	return config, nil
+
+} // End of loadWebhookConfig
+
+// parseWebhookTemplate parses the body template. The function json
+// quotes a value, e.g. {{json .Ident}}. An empty text returns nil.
+func parseWebhookTemplate(text string) (*template.Template, error) {
+
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(text)
+
+} // End of parseWebhookTemplate
+
+// newWebhookNotifier returns a notifier for config, which is validated
+func newWebhookNotifier(config webhookConfig) *webhookNotifier {
+
+	tmpl, _ := parseWebhookTemplate(config.Template)
+	return &webhookNotifier{
+		config:   config,
+		template: tmpl,
+		queue:    make(chan webhookEvent, webhookQueueSize),
+		idents:   make(map[string]*webhookIdent),
+	}
+
+} // End of newWebhookNotifier
+
+// seen records a message of ident. It is a listener.Options.OnMessage
+// function.
+func (n *webhookNotifier) seen(ident string, list []metrics.Metric) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	state, ok := n.idents[ident]
+	if !ok {
+		state = &webhookIdent{}
+		n.idents[ident] = state
+	}
+	state.lastSeen = time.Now()
+
+} // End of seen
+
+// forget stops tracking the ident of key, e.g. after its removal by a
+// control message, so a removed ident does not turn silent
+func (n *webhookNotifier) forget(key metrics.Key) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.idents, key.Ident)
+
+} // End of forget
+
+// run checks the idents every CheckInterval and sends the notifications
+// until ctx is done
+func (n *webhookNotifier) run(ctx context.Context) {
+
+	client := &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+	}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		n.sender(ctx, client)
+	}()
+	defer func() {
+		close(n.queue)
+		<-sent
+	}()
+
+	ticker := time.NewTicker(n.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, event := range n.check(now) {
+				select {
+				case n.queue <- event:
+				default:
+					webhookFailures.Inc()
+					log.Printf("Webhook queue full - drop %s notification of ident %s\n", event.State, event.Ident)
+				}
+			}
+		}
+	}
+
+} // End of run
+
+// check returns the notifications of the idents, whose state differs
+// from their last notification and whose cooldown is over. An ident is
+// notified as recovered only after it was notified as silent.
+func (n *webhookNotifier) check(now time.Time) []webhookEvent {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var events []webhookEvent
+	for ident, state := range n.idents {
+		threshold, ok := n.config.Idents[ident]
+		if !ok {
+			threshold = n.config.Threshold
+		}
+		silence := now.Sub(state.lastSeen)
+
+		current := webhookRecovered
+		if silence > threshold {
+			current = webhookSilent
+		}
+		if current == state.notified || (state.notified == "" && current == webhookRecovered) {
+			continue
+		}
+		if !state.lastNotified.IsZero() && now.Sub(state.lastNotified) < n.config.Cooldown {
+			continue
+		}
+		state.notified = current
+		state.lastNotified = now
+		events = append(events, webhookEvent{
+			Ident:            ident,
+			State:            current,
+			LastSeen:         state.lastSeen,
+			Silence:          silence,
+			Threshold:        threshold,
+			SilenceSeconds:   silence.Seconds(),
+			ThresholdSeconds: threshold.Seconds(),
+		})
+	}
+	return events
+
+} // End of check
+
+// sender posts the queued notifications until the queue is closed.
+// Pending notifications are dropped, when ctx is done.
+func (n *webhookNotifier) sender(ctx context.Context, client *http.Client) {
+
+	for event := range n.queue {
+		if ctx.Err() != nil {
+			continue
+		}
+		body, err := n.body(event)
+		if err != nil {
+			webhookFailures.Inc()
+			log.Printf("Webhook body of ident %s failed: %v\n", event.Ident, err)
+			continue
+		}
+		backoff := webhookBackoff
+		for try := 0; ; try++ {
+			retry, err := n.post(ctx, client, body)
+			if err == nil {
+				webhookNotifications.WithLabelValues(event.State).Inc()
+				log.Printf("Webhook: ident %s %s\n", event.Ident, event.State)
+				break
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			if !retry || try == webhookRetries {
+				webhookFailures.Inc()
+				log.Printf("Webhook %s notification of ident %s failed: %v\n", event.State, event.Ident, err)
+				break
+			}
+			log.Printf("Webhook notification failed, retry in %v: %v\n", backoff, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+
+} // End of sender
+
+// body renders the request body of event with the template or as JSON
+func (n *webhookNotifier) body(event webhookEvent) ([]byte, error) {
+
+	if n.template == nil {
+		return json.Marshal(event)
+	}
+	var buffer bytes.Buffer
+	if err := n.template.Execute(&buffer, event); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+
+} // End of body
+
+// post sends body to the webhook. retry tells, if the request may
+// succeed, when it is sent again: after a network error, 429 or a 5xx
+// status.
+func (n *webhookNotifier) post(ctx context.Context, client *http.Client, body []byte) (retry bool, err error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nfsen_exporter/"+version)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(text))
+	}
+	return false, nil
+
+} // End of post